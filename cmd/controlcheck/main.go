@@ -0,0 +1,226 @@
+// Command controlcheck checks a running server conforms to control
+// protocol, connecting to it as agents sending valid and invalid requests.
+// Same checks run against an in-process server by go test ./pkg/proxy,
+// this is for checking deployed servers.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zryfish/kunnel/pkg/agent"
+	"github.com/zryfish/kunnel/pkg/control"
+	"github.com/zryfish/kunnel/pkg/mux"
+	"github.com/zryfish/kunnel/pkg/transport"
+	"github.com/zryfish/kunnel/pkg/utils"
+	"github.com/zryfish/kunnel/pkg/version"
+)
+
+// check sends requests to a connection of its own, failing by error.
+type check struct {
+	name string
+	run  func(conn mux.Conn) error
+}
+
+func main() {
+	server := flag.String("server", "ws://127.0.0.1:80", "Server to check")
+	token := flag.String("token", "", "Token authenticating agents, named tunnels are checked to require one if empty")
+	flag.Parse()
+
+	u, err := url.Parse(*server)
+	if err != nil {
+		log.Fatalf("Invalid server %s, %v", *server, err)
+	}
+
+	checks := []check{
+		{"handshake", checkHandshake},
+		{"legacy config", checkLegacyConfig},
+		{"ping", checkPing},
+		{"invalid config", func(conn mux.Conn) error {
+			config := newConfig()
+			config.ProxyProtocol = "v9"
+			return expectError(conn, handshake(config), control.InvalidConfig)
+		}},
+		{"unsupported version", func(conn mux.Conn) error {
+			h := handshake(newConfig())
+			h.Version = control.Version + 1
+			return expectError(conn, h, control.UnsupportedVersion)
+		}},
+		{"malformed handshake", func(conn mux.Conn) error {
+			return expectReply(conn, control.HandshakeRequest, []byte("{"), control.InvalidRequest)
+		}},
+		{"unexpected request", func(conn mux.Conn) error {
+			return expectReply(conn, control.PingRequest, nil, control.InvalidRequest)
+		}},
+	}
+	if len(*token) == 0 {
+		checks = append(checks, check{"unauthenticated named tunnel", func(conn mux.Conn) error {
+			config := newConfig()
+			config.Tunnel = "controlcheck"
+			return expectError(conn, handshake(config), control.Unauthorized)
+		}})
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+	for _, c := range checks {
+		err := run(u, *token, c)
+		if err != nil {
+			failed = true
+			fmt.Fprintf(w, "%s\tFAIL\t%v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\tPASS\t\n", c.name)
+	}
+	w.Flush()
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// run connects to server by protocol version it picks, then runs check.
+func run(server *url.URL, token string, c check) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := &transport.DialOptions{Protocols: version.Protocols}
+	discovery, err := transport.Discover(ctx, server, options)
+	if err != nil {
+		return fmt.Errorf("unable to discover server, %v", err)
+	}
+	if discovery.Control != control.Version {
+		return fmt.Errorf("server speaks control protocol version %d, expecting %d", discovery.Control, control.Version)
+	}
+	options.Protocol = discovery.Protocol
+
+	conn, protocol, err := transport.Get(transport.WebSocket).Dial(ctx, server, options)
+	if err != nil {
+		return err
+	}
+	agentConn, _, reqs, err := mux.NewClientConn(conn, protocol, &mux.ClientConfig{User: "controlcheck", Token: token, Timeout: 10 * time.Second})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer agentConn.Close()
+	go func() {
+		for req := range reqs {
+			req.Reply(false, nil)
+		}
+	}()
+
+	return c.run(agentConn)
+}
+
+func newConfig() *agent.Config {
+	return &agent.Config{Name: "controlcheck", LocalHost: "127.0.0.1", LocalPort: 80, Protocol: "http"}
+}
+
+func handshake(config *agent.Config) *control.Handshake {
+	conf, _ := config.Marshal()
+	return &control.Handshake{Version: control.Version, Capabilities: []control.Capability{control.Events}, Config: conf}
+}
+
+func checkHandshake(conn mux.Conn) error {
+	ok, response, err := send(conn, control.HandshakeRequest, control.Marshal(handshake(newConfig())))
+	if err != nil {
+		return err
+	}
+	if err := response.Err(); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("reply is not ok without error")
+	}
+	if response.Version != control.Version {
+		return fmt.Errorf("response version is %d, expecting %d", response.Version, control.Version)
+	}
+	if len(response.Endpoints) == 0 {
+		return fmt.Errorf("no endpoints assigned")
+	}
+	for _, endpoint := range response.Endpoints {
+		if len(endpoint.Hostname) == 0 || len(endpoint.URL) == 0 {
+			return fmt.Errorf("incomplete endpoint %+v", endpoint)
+		}
+	}
+	return nil
+}
+
+func checkLegacyConfig(conn mux.Conn) error {
+	conf, _ := newConfig().Marshal()
+	ok, payload, err := conn.SendRequest(control.ConfigRequest, true, conf)
+	if err != nil {
+		return err
+	}
+	msg := &utils.Message{}
+	if err := msg.Unmarshal(payload); err != nil {
+		return err
+	}
+	if !ok || msg.Err != nil {
+		return fmt.Errorf("config rejected, %s", msg.Err)
+	}
+	if len(msg.Domain) == 0 {
+		return fmt.Errorf("no domain assigned")
+	}
+	return nil
+}
+
+func checkPing(conn mux.Conn) error {
+	if err := checkHandshake(conn); err != nil {
+		return err
+	}
+	ok, _, err := conn.SendRequest(control.PingRequest, true, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("ping is not replied ok")
+	}
+	return nil
+}
+
+// expectError sends handshake expecting it rejected by error of code.
+func expectError(conn mux.Conn, h *control.Handshake, code control.Code) error {
+	return expectReply(conn, control.HandshakeRequest, control.Marshal(h), code)
+}
+
+// expectReply sends request expecting it rejected by error of code.
+func expectReply(conn mux.Conn, name string, payload []byte, code control.Code) error {
+	ok, response, err := send(conn, name, payload)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("reply is ok, expecting error %s", code)
+	}
+	if response.Error == nil {
+		return fmt.Errorf("no error in response, expecting %s", code)
+	}
+	if response.Error.Code != code {
+		return fmt.Errorf("error is %v, expecting %s", response.Error, code)
+	}
+	if response.Version != control.Version {
+		return fmt.Errorf("response version is %d, expecting %d", response.Version, control.Version)
+	}
+	return nil
+}
+
+func send(conn mux.Conn, name string, payload []byte) (bool, *control.Response, error) {
+	ok, reply, err := conn.SendRequest(name, true, payload)
+	if err != nil {
+		return false, nil, err
+	}
+	response := &control.Response{}
+	if err := control.Unmarshal(reply, response); err != nil {
+		return false, nil, err
+	}
+	return ok, response, nil
+}
@@ -2,6 +2,9 @@ package app
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
 
 	"github.com/zryfish/kunnel/pkg/version"
 	v1 "k8s.io/api/apps/v1"
@@ -9,6 +12,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 var DeploymentTemplate = &v1.Deployment{
@@ -40,25 +44,144 @@ var DeploymentTemplate = &v1.Deployment{
 	},
 }
 
-func NewDeployment(namespace, service, localhost, server string, localport int, host, protocol string, headers []string) *v1.Deployment {
+func NewDeployment(options *KnOptions, localhost string) *v1.Deployment {
 	deployment := DeploymentTemplate.DeepCopy()
-	deployment.Name = fmt.Sprintf("kunnel-%s", service)
-	deployment.Namespace = namespace
+	deployment.Name = fmt.Sprintf("kunnel-%s", options.Service)
+	deployment.Namespace = options.Namespace
+	deployment.Spec.Replicas = &options.Replicas
 
 	command := []string{"client"}
-	command = append(command, "--server", server, "--local", fmt.Sprintf("%s:%d", localhost, localport))
-	if len(host) != 0 {
-		command = append(command, "--host", host)
+	command = append(command, "--server", options.Server, "--local", fmt.Sprintf("%s:%d", localhost, options.Port))
+	if len(options.Host) != 0 {
+		command = append(command, "--host", options.Host)
 	}
 
-	if len(protocol) != 0 {
-		command = append(command, "--protocol", protocol)
+	if len(options.Protocol) != 0 {
+		command = append(command, "--protocol", options.Protocol)
 	}
 
-	for _, header := range headers {
+	for _, header := range options.Headers {
 		command = append(command, "--header", header)
 	}
 
+	if len(options.Tunnel) != 0 {
+		command = append(command, "--tunnel", options.Tunnel)
+	}
+
+	if len(options.Domain) != 0 {
+		command = append(command, "--domain", options.Domain)
+	}
+
+	if len(options.Transports) != 0 {
+		command = append(command, "--transport", strings.Join(options.Transports, ","))
+	}
+
+	if len(options.Multiplexer) != 0 {
+		command = append(command, "--multiplexer", options.Multiplexer)
+	}
+
+	command = appendEach(command, "--hostname", options.Hostnames)
+
+	// token and proxy, which may carry credentials, are read from
+	// secret created by NewCredentialsSecret
+	for _, env := range []struct{ name, key, value string }{
+		{"KUNNEL_TOKEN", tokenKey, options.Token},
+		{"KUNNEL_PROXY", proxyKey, options.Proxy},
+	} {
+		if len(env.value) == 0 {
+			continue
+		}
+		deployment.Spec.Template.Spec.Containers[0].Env = append(deployment.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{
+			Name: env.name,
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: credentialsSecretName(options)},
+				Key:                  env.key,
+			}},
+		})
+	}
+
+	// certificates are mounted from secret created by NewTLSSecret
+	if hasTLSFiles(options) {
+		pod := &deployment.Spec.Template.Spec
+		pod.Volumes = append(pod.Volumes, corev1.Volume{
+			Name:         "tls",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: tlsSecretName(options)}},
+		})
+		pod.Containers[0].VolumeMounts = append(pod.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "tls", MountPath: tlsMountPath, ReadOnly: true})
+
+		if len(options.CertFile) != 0 {
+			command = append(command, "--cert", tlsMountPath+"/"+corev1.TLSCertKey, "--key", tlsMountPath+"/"+corev1.TLSPrivateKeyKey)
+		}
+		if len(options.CAFile) != 0 {
+			command = append(command, "--ca", tlsMountPath+"/"+corev1.ServiceAccountRootCAKey)
+		}
+		if len(options.UpstreamCA) != 0 {
+			command = append(command, "--upstream-ca", tlsMountPath+"/"+upstreamCAKey)
+		}
+		if len(options.UpstreamCert) != 0 {
+			command = append(command, "--upstream-cert", tlsMountPath+"/"+upstreamCertKey, "--upstream-key", tlsMountPath+"/"+upstreamKeyKey)
+		}
+	}
+
+	if options.UpstreamClusterCA {
+		command = append(command, "--upstream-cluster-ca")
+	}
+	if len(options.UpstreamSecret) != 0 {
+		command = append(command, "--upstream-secret", options.UpstreamSecret)
+	}
+	if len(options.UpstreamServerName) != 0 {
+		command = append(command, "--upstream-server-name", options.UpstreamServerName)
+	}
+	if options.UpstreamInsecure {
+		command = append(command, "--upstream-insecure")
+	}
+	if options.AgentUpstreamTLS {
+		command = append(command, "--agent-upstream-tls")
+	}
+
+	if len(options.ProxyProtocol) != 0 {
+		command = append(command, "--proxy-protocol", options.ProxyProtocol)
+	}
+
+	command = appendEach(command, "--set-header", options.SetHeaders)
+	command = appendEach(command, "--add-header", options.AddHeaders)
+	command = appendEach(command, "--remove-header", options.RemoveHeaders)
+	command = appendEach(command, "--set-response-header", options.SetResponseHeaders)
+	command = appendEach(command, "--add-response-header", options.AddResponseHeaders)
+	command = appendEach(command, "--remove-response-header", options.RemoveResponseHeaders)
+	command = appendEach(command, "--rewrite-path", options.PathRewrites)
+	command = appendEach(command, "--route", options.Routes)
+
+	if len(options.StripPrefix) != 0 {
+		command = append(command, "--strip-prefix", options.StripPrefix)
+	}
+
+	if len(options.AddPrefix) != 0 {
+		command = append(command, "--add-prefix", options.AddPrefix)
+	}
+
+	command = append(command, fmt.Sprintf("--rewrite-redirects=%t", options.RewriteRedirects))
+
+	// kubelet probes agent by its status endpoints at pod IP, so only
+	// port of status listen address is kept
+	port := defaultStatusPort
+	if len(options.StatusListen) != 0 {
+		if _, p, err := net.SplitHostPort(options.StatusListen); err == nil && len(p) != 0 {
+			port = p
+		}
+	}
+	command = append(command, "--status-listen", ":"+port)
+	container := &deployment.Spec.Template.Spec.Containers[0]
+	container.LivenessProbe = &corev1.Probe{
+		Handler:       corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.Parse(port)}},
+		PeriodSeconds: 10,
+	}
+	// agent disconnected keeps reconnecting, it's never restarted for that
+	container.ReadinessProbe = &corev1.Probe{
+		Handler:       corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Path: "/readyz", Port: intstr.Parse(port)}},
+		PeriodSeconds: 5,
+	}
+
 	deployment.Spec.Template.Spec.Containers[0].Command = command
 	imageTag := version.BuildVersion
 	if len(imageTag) == 0 {
@@ -68,3 +191,95 @@ func NewDeployment(namespace, service, localhost, server string, localport int,
 
 	return deployment
 }
+
+const (
+	defaultStatusPort = "8081"
+
+	tokenKey = "token"
+	proxyKey = "proxy"
+
+	tlsMountPath    = "/etc/kunnel/tls"
+	upstreamCAKey   = "upstream-ca.crt"
+	upstreamCertKey = "upstream-tls.crt"
+	upstreamKeyKey  = "upstream-tls.key"
+)
+
+func hasTLSFiles(options *KnOptions) bool {
+	return len(options.CertFile) != 0 || len(options.CAFile) != 0 || len(options.UpstreamCA) != 0 || len(options.UpstreamCert) != 0
+}
+
+func tlsSecretName(options *KnOptions) string {
+	return fmt.Sprintf("kunnel-%s-tls", options.Service)
+}
+
+// NewTLSSecret returns secret of certificate and CA files mounted into
+// deployment, nil if none is set.
+func NewTLSSecret(options *KnOptions) (*corev1.Secret, error) {
+	if !hasTLSFiles(options) {
+		return nil, nil
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tlsSecretName(options),
+			Namespace: options.Namespace,
+			Labels:    map[string]string{"app": "kunnel"},
+		},
+		Data: make(map[string][]byte),
+	}
+
+	files := map[string]string{
+		corev1.TLSCertKey:              options.CertFile,
+		corev1.TLSPrivateKeyKey:        options.KeyFile,
+		corev1.ServiceAccountRootCAKey: options.CAFile,
+		upstreamCAKey:                  options.UpstreamCA,
+		upstreamCertKey:                options.UpstreamCert,
+		upstreamKeyKey:                 options.UpstreamKey,
+	}
+	for key, file := range files {
+		if len(file) == 0 {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s, %v", file, err)
+		}
+		secret.Data[key] = data
+	}
+	return secret, nil
+}
+
+func credentialsSecretName(options *KnOptions) string {
+	return fmt.Sprintf("kunnel-%s-credentials", options.Service)
+}
+
+// NewCredentialsSecret returns secret of token and proxy passed to
+// deployment by environment, nil if neither is set.
+func NewCredentialsSecret(options *KnOptions) *corev1.Secret {
+	data := make(map[string][]byte)
+	if len(options.Token) != 0 {
+		data[tokenKey] = []byte(options.Token)
+	}
+	if len(options.Proxy) != 0 {
+		data[proxyKey] = []byte(options.Proxy)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      credentialsSecretName(options),
+			Namespace: options.Namespace,
+			Labels:    map[string]string{"app": "kunnel"},
+		},
+		Data: data,
+	}
+}
+
+func appendEach(command []string, flag string, values []string) []string {
+	for _, v := range values {
+		command = append(command, flag, v)
+	}
+	return command
+}
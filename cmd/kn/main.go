@@ -3,12 +3,17 @@ package main
 import (
 	"context"
 	"fmt"
-	"strings"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 
@@ -34,6 +39,10 @@ func main() {
 				knOptions.Namespace = "default"
 			}
 
+			if knOptions.Replicas > 1 && len(knOptions.Tunnel) == 0 {
+				klog.Warning("No tunnel specified, each replica will be assigned a different domain")
+			}
+
 			ctx := signals.SetupSignalHandler()
 
 			config, err := clientcmd.BuildConfigFromFlags("", knOptions.KubeConfig)
@@ -43,43 +52,70 @@ func main() {
 
 			kubeClient := kubernetes.NewForConfigOrDie(config)
 
-			service, err := kubeClient.CoreV1().Services(knOptions.Namespace).Get(ctx, knOptions.Service, metav1.GetOptions{})
+			clusterIP, port, err := resolveService(ctx, kubeClient, knOptions.Namespace, knOptions.Service, knOptions.Port)
 			if err != nil {
 				return err
 			}
+			knOptions.Port = port
 
-			if len(service.Spec.ClusterIP) == 0 {
-				return fmt.Errorf("headless service is not supported")
+			routes, err := resolveRoutes(ctx, kubeClient, knOptions)
+			if err != nil {
+				return err
 			}
 
-			if knOptions.Port == 0 {
-				for _, port := range service.Spec.Ports {
-					if port.Protocol == v1.ProtocolTCP {
-						knOptions.Port = int(port.Port)
-						klog.Warningf("No port specified, will use first port [%d] of service", knOptions.Port)
-						break
-					}
-				}
+			headers, err := knOptions.CustomHeaders()
+			if err != nil {
+				return err
+			}
 
-				if knOptions.Port == 0 {
-					return fmt.Errorf("no port sepecified")
-				}
+			rules, err := knOptions.Rules()
+			if err != nil {
+				return err
 			}
 
-			headers := make(map[string]string)
-			for _, header := range knOptions.Headers {
-				parts := strings.Split(header, "=")
-				if len(parts) != 2 {
-					continue
+			upstreamTLS, err := resolveUpstreamTLS(ctx, kubeClient, config, knOptions)
+			if err != nil {
+				return err
+			}
+
+			if len(knOptions.StatusListen) != 0 {
+				if _, _, err := net.SplitHostPort(knOptions.StatusListen); err != nil {
+					return fmt.Errorf("invalid status listen address %s, %v", knOptions.StatusListen, err)
 				}
-				headers[parts[0]] = parts[1]
 			}
 
 			if knOptions.Daemon {
-				return StartInCluster(kubeClient, ctx, knOptions.Namespace, knOptions.Service, knOptions.Server, service.Spec.ClusterIP, knOptions.Port, knOptions.Host, knOptions.Protocol, knOptions.Headers)
+				return StartInCluster(kubeClient, ctx, knOptions, clusterIP)
+			}
+
+			agentConfig := &agent.Config{
+				Name:             knOptions.Name,
+				Tunnel:           knOptions.Tunnel,
+				Domain:           knOptions.Domain,
+				Hostnames:        knOptions.Hostnames,
+				Token:            knOptions.Token,
+				CertFile:         knOptions.CertFile,
+				KeyFile:          knOptions.KeyFile,
+				CAFile:           knOptions.CAFile,
+				Proxy:            knOptions.Proxy,
+				Transports:       knOptions.Transports,
+				Multiplexer:      knOptions.Multiplexer,
+				LocalHost:        clusterIP,
+				LocalPort:        knOptions.Port,
+				Host:             knOptions.Host,
+				Hedaers:          headers,
+				Protocol:         knOptions.Protocol,
+				UpstreamTLS:      upstreamTLS,
+				AgentUpstreamTLS: knOptions.AgentUpstreamTLS,
+				ProxyProtocol:    knOptions.ProxyProtocol,
+				Rules:            rules,
+				Routes:           routes,
+			}
+			if err := agentConfig.Validate(); err != nil {
+				return err
 			}
 
-			return Start(ctx, service.Spec.ClusterIP, knOptions.Port, knOptions.Host, knOptions.Server, knOptions.Protocol, headers)
+			return Start(ctx, agentConfig, knOptions.Server, knOptions.StatusListen)
 		},
 	}
 
@@ -91,28 +127,175 @@ func main() {
 	}
 }
 
-func Start(ctx context.Context, localhost string, localport int, host, server, protocol string, headers map[string]string) error {
-	config := &agent.Config{
-		Name:      "dummy",
-		LocalHost: localhost,
-		LocalPort: localport,
-		Host:      host,
-		Hedaers:   headers,
-		Protocol:  protocol,
+// resolveService returns cluster ip and port of service, port defaults
+// to the first tcp port of service if not provided.
+func resolveService(ctx context.Context, kubeClient kubernetes.Interface, namespace, name string, port int) (string, int, error) {
+	service, err := kubeClient.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(service.Spec.ClusterIP) == 0 || service.Spec.ClusterIP == v1.ClusterIPNone {
+		return "", 0, fmt.Errorf("headless service is not supported")
+	}
+
+	if port == 0 {
+		for _, p := range service.Spec.Ports {
+			if p.Protocol == v1.ProtocolTCP {
+				port = int(p.Port)
+				klog.Warningf("No port specified, will use first port [%d] of service %s", port, name)
+				break
+			}
+		}
+
+		if port == 0 {
+			return "", 0, fmt.Errorf("no port sepecified")
+		}
+	}
+
+	return service.Spec.ClusterIP, port, nil
+}
+
+// resolveRoutes parses routes and resolves their target services to cluster ips,
+// targets being ip addresses are kept as they are.
+func resolveRoutes(ctx context.Context, kubeClient kubernetes.Interface, options *app.KnOptions) ([]agent.Route, error) {
+	var routes []agent.Route
+	for i, r := range options.Routes {
+		route, err := agent.ParseRoute(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(route.LocalHost) == nil {
+			route.ServerName = fmt.Sprintf("%s.%s.svc", route.LocalHost, options.Namespace)
+			route.LocalHost, route.LocalPort, err = resolveService(ctx, kubeClient, options.Namespace, route.LocalHost, route.LocalPort)
+			if err != nil {
+				return nil, fmt.Errorf("invalid route %s, %v", r, err)
+			}
+		}
+
+		if err := route.Validate(); err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, *route)
+		options.Routes[i] = route.String()
+	}
+	return routes, nil
+}
+
+// resolveUpstreamTLS reads CA and client certificate verifying https
+// services from files, secret and cluster CA.
+func resolveUpstreamTLS(ctx context.Context, kubeClient kubernetes.Interface, config *rest.Config, options *app.KnOptions) (*agent.UpstreamTLS, error) {
+	upstream := &agent.UpstreamTLS{ServerName: options.UpstreamServerName, Insecure: options.UpstreamInsecure}
+	if len(upstream.ServerName) == 0 {
+		upstream.ServerName = fmt.Sprintf("%s.%s.svc", options.Service, options.Namespace)
 	}
 
-	agent := agent.NewClient(config, time.Second*3, 20, time.Minute*5, server)
-	if err := agent.Run(); err != nil {
+	if options.UpstreamClusterCA {
+		ca := config.CAData
+		if len(ca) == 0 && len(config.CAFile) != 0 {
+			var err error
+			if ca, err = ioutil.ReadFile(config.CAFile); err != nil {
+				return nil, fmt.Errorf("unable to read cluster ca, %v", err)
+			}
+		}
+		if len(ca) == 0 {
+			return nil, fmt.Errorf("no cluster ca found in kubeconfig")
+		}
+		upstream.CA += string(ca)
+	}
+
+	if len(options.UpstreamSecret) != 0 {
+		secret, err := kubeClient.CoreV1().Secrets(options.Namespace).Get(ctx, options.UpstreamSecret, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get upstream secret, %v", err)
+		}
+		upstream.CA += string(secret.Data[v1.ServiceAccountRootCAKey])
+		upstream.Certificate, upstream.Key = string(secret.Data[v1.TLSCertKey]), string(secret.Data[v1.TLSPrivateKeyKey])
+	}
+
+	if len(options.UpstreamCA) != 0 {
+		ca, err := ioutil.ReadFile(options.UpstreamCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s, %v", options.UpstreamCA, err)
+		}
+		upstream.CA += string(ca)
+	}
+
+	// client certificate files take precedence over secret
+	files := []struct {
+		path string
+		dst  *string
+	}{
+		{options.UpstreamCert, &upstream.Certificate},
+		{options.UpstreamKey, &upstream.Key},
+	}
+	for _, f := range files {
+		if len(f.path) == 0 {
+			continue
+		}
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s, %v", f.path, err)
+		}
+		*f.dst = string(data)
+	}
+	return upstream, upstream.Validate()
+}
+
+func Start(ctx context.Context, config *agent.Config, server, statusListen string) error {
+	client, err := agent.New(&agent.Options{
+		Server:           server,
+		Config:           config,
+		KeepAlive:        3 * time.Second,
+		MaxRetryCount:    20,
+		MaxRetryInterval: 5 * time.Minute,
+		StatusListen:     statusListen,
+	})
+	if err != nil {
 		return err
 	}
 
-	return agent.Wait()
+	// SIGHUP reconnects now instead of backing off
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	go func() {
+		for range sig {
+			client.Reconnect()
+		}
+	}()
+
+	if _, err := client.Start(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	return client.Wait()
 }
 
-func StartInCluster(kubeClient kubernetes.Interface, ctx context.Context, namespace, service, server string, localhost string, localport int, host, protocol string, headers []string) error {
-	deployment := app.NewDeployment(namespace, service, localhost, server, localport, host, protocol, headers)
+func StartInCluster(kubeClient kubernetes.Interface, ctx context.Context, options *app.KnOptions, localhost string) error {
+	namespace := options.Namespace
+	deployment := app.NewDeployment(options, localhost)
+
+	secret, err := app.NewTLSSecret(options)
+	if err != nil {
+		return err
+	}
+	if secret != nil {
+		if err := applySecret(ctx, kubeClient, secret); err != nil {
+			return fmt.Errorf("unable to create tls secret, %v", err)
+		}
+	}
+	if secret := app.NewCredentialsSecret(options); secret != nil {
+		if err := applySecret(ctx, kubeClient, secret); err != nil {
+			return fmt.Errorf("unable to create credentials secret, %v", err)
+		}
+	}
 
-	_, err := kubeClient.AppsV1().Deployments(namespace).Get(ctx, deployment.Name, metav1.GetOptions{})
+	_, err = kubeClient.AppsV1().Deployments(namespace).Get(ctx, deployment.Name, metav1.GetOptions{})
 	if err != nil {
 		if errors.IsNotFound(err) { // no deployment existed, created
 			_, err = kubeClient.AppsV1().Deployments(namespace).Create(ctx, deployment, metav1.CreateOptions{})
@@ -125,3 +308,16 @@ func StartInCluster(kubeClient kubernetes.Interface, ctx context.Context, namesp
 	_, err = kubeClient.AppsV1().Deployments(namespace).Update(ctx, deployment, metav1.UpdateOptions{})
 	return err
 }
+
+func applySecret(ctx context.Context, kubeClient kubernetes.Interface, secret *v1.Secret) error {
+	_, err := kubeClient.CoreV1().Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			_, err = kubeClient.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+		}
+		return err
+	}
+
+	_, err = kubeClient.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// fileConfig is layout of server config file in YAML or JSON. Its fields
+// point to fields of KunnelOptions, so decoding a file overrides options
+// present in the file only.
+type fileConfig struct {
+	Domains  *[]string `json:"domains"`
+	Balancer *string   `json:"balancer"`
+
+	Listen struct {
+		Bind           *string   `json:"bind"`
+		Port           *int      `json:"port"`
+		ProxyProtocol  *bool     `json:"proxyProtocol"`
+		TrustedProxies *[]string `json:"trustedProxies"`
+		Agent          *string   `json:"agent"`
+		AgentClientCA  *string   `json:"agentClientCA"`
+		Redirect       *string   `json:"redirect"`
+		AgentTCP       *string   `json:"agentTCP"`
+		AgentQUIC      *string   `json:"agentQUIC"`
+		AgentKeepAlive duration  `json:"agentKeepAlive"`
+	} `json:"listen"`
+
+	TLS struct {
+		CertFile     *string      `json:"certFile"`
+		KeyFile      *string      `json:"keyFile"`
+		Certificates certificates `json:"certificates"`
+	} `json:"tls"`
+
+	Auth struct {
+		Tokens     *[]string  `json:"tokens"`
+		Identities identities `json:"identities"`
+	} `json:"auth"`
+
+	AccessLog struct {
+		Path       *string `json:"path"`
+		Format     *string `json:"format"`
+		MaxSize    *int    `json:"maxSize"`
+		MaxBackups *int    `json:"maxBackups"`
+	} `json:"accessLog"`
+
+	Limits struct {
+		MaxAgents          *int `json:"maxAgents"`
+		MaxAgentsPerTunnel *int `json:"maxAgentsPerTunnel"`
+	} `json:"limits"`
+
+	Access struct {
+		Allow *[]string `json:"allow"`
+		Deny  *[]string `json:"deny"`
+	} `json:"access"`
+
+	Cluster struct {
+		Listen        *string   `json:"listen"`
+		Address       *string   `json:"address"`
+		Token         *string   `json:"token"`
+		CertFile      *string   `json:"certFile"`
+		KeyFile       *string   `json:"keyFile"`
+		CAFile        *string   `json:"caFile"`
+		ID            *string   `json:"id"`
+		Store         *string   `json:"store"`
+		Peers         *[]string `json:"peers"`
+		RaftDir       *string   `json:"raftDir"`
+		Namespace     *string   `json:"namespace"`
+		LeaseDuration duration  `json:"leaseDuration"`
+		KubeConfig    *string   `json:"kubeconfig"`
+	} `json:"cluster"`
+
+	Admin struct {
+		Listen       *string  `json:"listen"`
+		DrainTimeout duration `json:"drainTimeout"`
+	} `json:"admin"`
+}
+
+// duration decodes strings like "30s" into the time.Duration it points to.
+type duration struct {
+	d *time.Duration
+}
+
+func (d duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like 30s")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d.d = v
+	return nil
+}
+
+// certificates decodes list of certFile and keyFile pairs into
+// certificates like crt-file:key-file.
+type certificates struct {
+	p *[]string
+}
+
+func (c certificates) UnmarshalJSON(b []byte) error {
+	var files []struct {
+		CertFile string `json:"certFile"`
+		KeyFile  string `json:"keyFile"`
+	}
+	if err := json.Unmarshal(b, &files); err != nil {
+		return err
+	}
+	*c.p = nil
+	for _, f := range files {
+		*c.p = append(*c.p, f.CertFile+":"+f.KeyFile)
+	}
+	return nil
+}
+
+// identities decodes list of name and tunnels pairs into identities
+// like name=tunnel-pattern,...
+type identities struct {
+	p *[]string
+}
+
+func (c identities) UnmarshalJSON(b []byte) error {
+	var ids []struct {
+		Name    string   `json:"name"`
+		Tunnels []string `json:"tunnels"`
+	}
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return err
+	}
+	*c.p = nil
+	for _, id := range ids {
+		identity := id.Name
+		if len(id.Tunnels) != 0 {
+			identity += "=" + strings.Join(id.Tunnels, ",")
+		}
+		*c.p = append(*c.p, identity)
+	}
+	return nil
+}
+
+func newFileConfig(k *KunnelOptions) *fileConfig {
+	c := &fileConfig{Domains: &k.Domains, Balancer: &k.Balancer}
+	c.Listen.Bind, c.Listen.Port, c.Listen.ProxyProtocol, c.Listen.TrustedProxies = &k.Bind, &k.Port, &k.ProxyProtocol, &k.TrustedProxies
+	c.Listen.Agent, c.Listen.AgentClientCA, c.Listen.Redirect = &k.AgentListen, &k.AgentClientCA, &k.RedirectListen
+	c.Listen.AgentTCP, c.Listen.AgentQUIC, c.Listen.AgentKeepAlive = &k.AgentTCPListen, &k.AgentQUICListen, duration{&k.AgentKeepAlive}
+	c.TLS.CertFile, c.TLS.KeyFile, c.TLS.Certificates = &k.TlsCrtFile, &k.TlsKeyFile, certificates{&k.TlsCertificates}
+	c.Auth.Tokens, c.Auth.Identities = &k.Tokens, identities{&k.AgentIdentities}
+	c.AccessLog.Path, c.AccessLog.Format, c.AccessLog.MaxSize, c.AccessLog.MaxBackups = &k.AccessLog, &k.AccessLogFormat, &k.AccessLogMaxSize, &k.AccessLogMaxBackups
+	c.Limits.MaxAgents, c.Limits.MaxAgentsPerTunnel = &k.MaxAgents, &k.MaxAgentsPerTunnel
+	c.Access.Allow, c.Access.Deny = &k.AllowClients, &k.DenyClients
+	c.Cluster.Listen, c.Cluster.Address, c.Cluster.Token, c.Cluster.ID = &k.ClusterListen, &k.ClusterAddress, &k.ClusterToken, &k.ClusterID
+	c.Cluster.CertFile, c.Cluster.KeyFile, c.Cluster.CAFile = &k.ClusterTlsCrtFile, &k.ClusterTlsKeyFile, &k.ClusterCA
+	c.Cluster.Store, c.Cluster.Peers, c.Cluster.RaftDir, c.Cluster.Namespace = &k.ClusterStore, &k.ClusterPeers, &k.ClusterRaftDir, &k.ClusterNamespace
+	c.Cluster.LeaseDuration, c.Cluster.KubeConfig = duration{&k.ClusterLeaseDuration}, &k.KubeConfig
+	c.Admin.Listen, c.Admin.DrainTimeout = &k.AdminListen, duration{&k.DrainTimeout}
+	return c
+}
+
+// Load reads options from config file, then overrides them with
+// flags set in command line, returns checksum of the file even if
+// it's invalid.
+func Load(path string, flags *pflag.FlagSet) (*KunnelOptions, [32]byte, error) {
+	k := NewKunnelOptions()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, [32]byte{}, fmt.Errorf("unable to read config file, %v", err)
+	}
+
+	sum := sha256.Sum256(data)
+	if err := yaml.UnmarshalStrict(data, newFileConfig(k)); err != nil {
+		return nil, sum, fmt.Errorf("invalid config file %s, %v", path, err)
+	}
+
+	k.Override(flags)
+	return k, sum, nil
+}
+
+// Override overrides options with flags set in command line.
+func (k *KunnelOptions) Override(flags *pflag.FlagSet) {
+	fs := k.Flags()
+	flags.Visit(func(f *pflag.Flag) {
+		target := fs.Lookup(f.Name)
+		if target == nil {
+			return
+		}
+		if s, ok := f.Value.(pflag.SliceValue); ok {
+			target.Value.(pflag.SliceValue).Replace(s.GetSlice())
+			return
+		}
+		target.Value.Set(f.Value.String())
+	})
+}
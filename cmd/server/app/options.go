@@ -1,54 +1,395 @@
 package app
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
+	"github.com/zryfish/kunnel/pkg/utils"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/klog"
 )
 
 type KunnelOptions struct {
-	Domain     string // top level domain
-	Bind       string // server address, default 127.0.0.1
-	Port       int    // server port
+	ConfigFile string // YAML or JSON config file, reloaded on SIGHUP or change
+
+	Domains    []string // top level domains, the first one is default
+	Bind       string   // server address, default 127.0.0.1
+	Port       int      // server port
 	TlsKeyFile string
 	TlsCrtFile string
+	// more certificates selected by SNI, each like crt-file:key-file
+	TlsCertificates []string
+
+	AccessLog           string // access log file, "-" for stdout
+	AccessLogFormat     string // json or combined
+	AccessLogMaxSize    int    // megabytes
+	AccessLogMaxBackups int
+
+	AgentListen     string // address agents connect to, public listener if empty
+	AgentClientCA   string // CA verifying agent client certificates, only agents with valid certificates accepted if set
+	RedirectListen  string // plain HTTP listener redirecting to HTTPS, disabled if empty
+	AgentTCPListen  string // raw TCP listener of agents, disabled if empty
+	AgentQUICListen string // UDP listener of agents connecting by QUIC, disabled if empty
+	// identities of agent certificates, each like name[=tunnel-pattern,...]
+	AgentIdentities []string
+	AgentKeepAlive  time.Duration // interval of pings to agents, disabled if 0
+
+	TrustedProxies []string // CIDRs of load balancers in front of server
+	ProxyProtocol  bool     // accept PROXY protocol on server listener
+
+	Tokens   []string // tokens agents authenticate with
+	Balancer string   // round-robin or least-connections
+
+	MaxAgents          int      // maximum number of agents, unlimited if 0
+	MaxAgentsPerTunnel int      // maximum number of agents joined a tunnel, unlimited if 0
+	AllowClients       []string // CIDRs of clients allowed to access tunnels, all if empty
+	DenyClients        []string // CIDRs of clients denied to access tunnels
+
+	ClusterListen        string   // listener of requests from other replicas, cluster disabled if empty
+	ClusterAddress       string   // url other replicas reach this one at
+	ClusterToken         string   // token replicas authenticate each other with
+	ClusterTlsCrtFile    string   // certificate replicas serve and present to each other
+	ClusterTlsKeyFile    string   // key of cluster certificate
+	ClusterCA            string   // CA verifying certificates of replicas
+	ClusterID            string   // replica identity, default hostname
+	ClusterStore         string   // peers, raft or kubernetes
+	ClusterPeers         []string // urls of all replicas, for peers and raft stores
+	ClusterRaftDir       string   // directory of raft log and snapshots, for raft store
+	ClusterNamespace     string   // namespace of leases, for kubernetes store
+	ClusterLeaseDuration time.Duration
+	KubeConfig           string
+
+	AdminListen  string        // admin API address, disabled if empty
+	DrainTimeout time.Duration // how long draining waits for requests in flight
 }
 
 func NewKunnelOptions() *KunnelOptions {
+	hostname, _ := os.Hostname()
 	return &KunnelOptions{
-		Bind: "127.0.0.1",
-		Port: 80,
+		Bind:                "127.0.0.1",
+		Port:                80,
+		AccessLogFormat:     "combined",
+		AccessLogMaxSize:    100,
+		AccessLogMaxBackups: 5,
+		Balancer:            "round-robin",
+
+		ClusterID:            hostname,
+		ClusterToken:         os.Getenv("KUNNEL_CLUSTER_TOKEN"),
+		ClusterStore:         "peers",
+		ClusterRaftDir:       "/var/lib/kunnel/raft",
+		ClusterNamespace:     "kunnel",
+		ClusterLeaseDuration: 30 * time.Second,
+
+		AgentKeepAlive: 30 * time.Second,
+		DrainTimeout:   30 * time.Second,
 	}
 }
 
 func (k *KunnelOptions) Flags() *pflag.FlagSet {
 	flags := pflag.NewFlagSet("kunnel", pflag.ContinueOnError)
-	flags.StringVar(&k.Domain, "domain", k.Domain, "Tunnel top level domain name. *.[domain] MUST resolve to server address.")
+	flags.StringVar(&k.ConfigFile, "config", k.ConfigFile, "YAML or JSON config file, reloaded on SIGHUP or when it changes. Flags set in command line override it.")
+	flags.StringSliceVar(&k.Domains, "domain", k.Domains, "Tunnel top level domain names, the first one is default. *.[domain] MUST resolve to server address.")
 	flags.StringVar(&k.Bind, "bind", k.Bind, "Server bind address, default 127.0.0.1")
 	flags.IntVar(&k.Port, "port", k.Port, "Server port, default 80.")
+	flags.StringVar(&k.AgentListen, "agent-listen", k.AgentListen, "Address agents connect to, like 0.0.0.0:7443. Public listener serves tunnel traffic only if set, otherwise agents connect to public listener.")
+	flags.StringVar(&k.AgentClientCA, "agent-client-ca", k.AgentClientCA, "CA file verifying client certificates of agents, only agents with valid certificates are accepted if set, instead of tokens.")
+	flags.StringArrayVar(&k.AgentIdentities, "agent-identity", k.AgentIdentities, "Identity of agent certificates like name[=tunnel-pattern,...], name matches common name or SANs of certificates, patterns like team-a-* limit tunnels identity could join. Could be repeated, any verified certificate is accepted if empty.")
+	flags.StringVar(&k.AgentTCPListen, "agent-tcp-listen", k.AgentTCPListen, "Address of raw TCP listener agents could connect to, like 0.0.0.0:7444, over TLS if server has certificates. Disabled if empty.")
+	flags.StringVar(&k.AgentQUICListen, "agent-quic-listen", k.AgentQUICListen, "Address of UDP listener agents could connect to by QUIC, like 0.0.0.0:443, requires tls certificate. Disabled if empty.")
+	flags.DurationVar(&k.AgentKeepAlive, "agent-keepalive", k.AgentKeepAlive, "Interval of pings to agents, agents not replying within 3 intervals are disconnected and leave their tunnels. Disabled if 0.")
+	flags.StringVar(&k.RedirectListen, "redirect-listen", k.RedirectListen, "Address of plain HTTP listener redirecting requests to HTTPS, like 0.0.0.0:80. Disabled if empty.")
 	flags.StringVar(&k.TlsCrtFile, "tls-crt-file", k.TlsCrtFile, "Tls certificate crt file")
 	flags.StringVar(&k.TlsKeyFile, "tls-key-file", k.TlsKeyFile, "Tls certificate key file")
+	flags.StringArrayVar(&k.TlsCertificates, "tls-certificate", k.TlsCertificates, "More tls certificates selected by SNI, like crt-file:key-file, could be repeated. Used for other domains and custom hostnames.")
+	flags.StringVar(&k.AccessLog, "access-log", k.AccessLog, "Access log file of tunneled requests, '-' for stdout. Disabled if empty.")
+	flags.StringVar(&k.AccessLogFormat, "access-log-format", k.AccessLogFormat, "Access log format, json or combined.")
+	flags.IntVar(&k.AccessLogMaxSize, "access-log-max-size", k.AccessLogMaxSize, "Maximum size in megabytes of access log file before it gets rotated.")
+	flags.IntVar(&k.AccessLogMaxBackups, "access-log-max-backups", k.AccessLogMaxBackups, "Maximum number of rotated access log files to retain.")
+	flags.StringSliceVar(&k.TrustedProxies, "trusted-proxies", k.TrustedProxies, "CIDRs of load balancers in front of server, whose X-Forwarded-* and PROXY protocol headers are trusted.")
+	flags.BoolVar(&k.ProxyProtocol, "proxy-protocol", k.ProxyProtocol, "Accept HAProxy PROXY protocol v1/v2 headers on server listener from --trusted-proxies.")
+	flags.StringSliceVar(&k.Tokens, "tokens", k.Tokens, "Tokens agents authenticate with, agents are not authenticated if empty. Named tunnels are only available for authenticated agents, and bound to token of agents joined first.")
+	flags.StringVar(&k.Balancer, "balancer", k.Balancer, "Strategy balancing requests across agents joined the same tunnel, round-robin or least-connections.")
+	flags.IntVar(&k.MaxAgents, "max-agents", k.MaxAgents, "Maximum number of agents connected, unlimited if 0.")
+	flags.IntVar(&k.MaxAgentsPerTunnel, "max-agents-per-tunnel", k.MaxAgentsPerTunnel, "Maximum number of agents joined the same tunnel, unlimited if 0.")
+	flags.StringSliceVar(&k.AllowClients, "allow-clients", k.AllowClients, "CIDRs of clients allowed to access tunnels, all clients are allowed if empty.")
+	flags.StringSliceVar(&k.DenyClients, "deny-clients", k.DenyClients, "CIDRs of clients denied to access tunnels, takes precedence over --allow-clients.")
+	flags.StringVar(&k.ClusterListen, "cluster-listen", k.ClusterListen, "Address of listener for requests from other server replicas, like :7946. Clustering is disabled if empty.")
+	flags.StringVar(&k.ClusterAddress, "cluster-address", k.ClusterAddress, "URL other replicas reach this replica at, like https://10.0.0.5:7946.")
+	flags.StringVar(&k.ClusterToken, "cluster-token", k.ClusterToken, "Token replicas authenticate each other with, default value of env KUNNEL_CLUSTER_TOKEN.")
+	flags.StringVar(&k.ClusterTlsCrtFile, "cluster-tls-crt-file", k.ClusterTlsCrtFile, "Certificate replicas serve cluster listener with and present to each other, valid for hosts of their cluster addresses.")
+	flags.StringVar(&k.ClusterTlsKeyFile, "cluster-tls-key-file", k.ClusterTlsKeyFile, "Key file of cluster certificate.")
+	flags.StringVar(&k.ClusterCA, "cluster-ca", k.ClusterCA, "CA verifying cluster certificates of replicas, both serving and presented to cluster listener.")
+	flags.StringVar(&k.ClusterID, "cluster-id", k.ClusterID, "Identity of this replica, default hostname.")
+	flags.StringVar(&k.ClusterStore, "cluster-store", k.ClusterStore, "Store of which replicas hold which tunnels, peers, raft or kubernetes.")
+	flags.StringSliceVar(&k.ClusterPeers, "cluster-peers", k.ClusterPeers, "URLs of all replicas, used by peers and raft stores. Replicas of raft store bootstrap cluster by them, and must agree on them.")
+	flags.StringVar(&k.ClusterRaftDir, "cluster-raft-dir", k.ClusterRaftDir, "Directory keeping raft log and snapshots, used by raft store.")
+	flags.StringVar(&k.ClusterNamespace, "cluster-namespace", k.ClusterNamespace, "Namespace of leases, used by kubernetes store.")
+	flags.DurationVar(&k.ClusterLeaseDuration, "cluster-lease-duration", k.ClusterLeaseDuration, "Duration of leases, used by kubernetes store. Tunnels of crashed replicas are routed to them until leases expire.")
+	flags.StringVar(&k.KubeConfig, "kubeconfig", k.KubeConfig, "Kubeconfig file used by kubernetes store, in-cluster config is used if empty.")
+	flags.StringVar(&k.AdminListen, "admin-listen", k.AdminListen, "Address of admin API, like 127.0.0.1:9090. POST /drain drains server. Disabled if empty.")
+	flags.DurationVar(&k.DrainTimeout, "drain-timeout", k.DrainTimeout, "How long draining on SIGTERM or admin API waits for requests in flight before server exits.")
 	return flags
 }
 
+// Validate checks options, errors are reported with their config file
+// keys followed by flags.
 func (k *KunnelOptions) Validate() error {
-	if err := net.ParseIP(k.Bind); err != nil {
-		return fmt.Errorf("invalid bind address %s, %v", k.Bind, err)
+	var errs field.ErrorList
+	invalid := func(path *field.Path, flag string, value interface{}, detail string) {
+		errs = append(errs, field.Invalid(path, value, fmt.Sprintf("%s (--%s)", detail, flag)))
 	}
 
+	for i, domain := range k.Domains {
+		for _, msg := range validation.IsDNS1123Subdomain(domain) {
+			invalid(field.NewPath("domains").Index(i), "domain", domain, msg)
+		}
+	}
+
+	listen := field.NewPath("listen")
+	if net.ParseIP(k.Bind) == nil {
+		invalid(listen.Child("bind"), "bind", k.Bind, "must be an IP address")
+	}
 	if k.Port <= 0 || k.Port > 65535 {
-		return fmt.Errorf("invalid port number %d, must be in the range [0, 65535]", k.Port)
+		invalid(listen.Child("port"), "port", k.Port, "must be in the range [1, 65535]")
+	}
+	validateCIDRs(listen.Child("trustedProxies"), "trusted-proxies", k.TrustedProxies, invalid)
+	if k.ProxyProtocol && len(k.TrustedProxies) == 0 {
+		// anyone could claim any address otherwise
+		invalid(listen.Child("proxyProtocol"), "proxy-protocol", k.ProxyProtocol, "requires trusted proxies")
+	}
+	validateAddress(listen.Child("agent"), "agent-listen", k.AgentListen, invalid)
+	validateAddress(listen.Child("redirect"), "redirect-listen", k.RedirectListen, invalid)
+	validateAddress(listen.Child("agentTCP"), "agent-tcp-listen", k.AgentTCPListen, invalid)
+	validateAddress(listen.Child("agentQUIC"), "agent-quic-listen", k.AgentQUICListen, invalid)
+	if k.AgentKeepAlive < 0 {
+		invalid(listen.Child("agentKeepAlive"), "agent-keepalive", k.AgentKeepAlive.String(), "must not be negative")
+	}
+	hasTLS := len(k.TlsCrtFile) != 0 || len(k.TlsCertificates) != 0
+	if len(k.AgentClientCA) != 0 {
+		if !hasTLS {
+			invalid(listen.Child("agentClientCA"), "agent-client-ca", k.AgentClientCA, "requires tls certificate")
+		} else if _, err := os.Stat(k.AgentClientCA); err != nil {
+			invalid(listen.Child("agentClientCA"), "agent-client-ca", k.AgentClientCA, err.Error())
+		}
+	}
+	if len(k.RedirectListen) != 0 && !hasTLS {
+		invalid(listen.Child("redirect"), "redirect-listen", k.RedirectListen, "requires tls certificate")
+	}
+	if len(k.AgentQUICListen) != 0 && !hasTLS {
+		invalid(listen.Child("agentQUIC"), "agent-quic-listen", k.AgentQUICListen, "requires tls certificate")
+	}
+
+	tlsPath := field.NewPath("tls")
+	switch {
+	case len(k.TlsCrtFile) == 0 && len(k.TlsKeyFile) == 0:
+	case len(k.TlsCrtFile) == 0:
+		invalid(tlsPath.Child("certFile"), "tls-crt-file", k.TlsCrtFile, "must be provided with key file")
+	case len(k.TlsKeyFile) == 0:
+		invalid(tlsPath.Child("keyFile"), "tls-key-file", k.TlsKeyFile, "must be provided with certificate file")
+	default:
+		if _, err := tls.LoadX509KeyPair(k.TlsCrtFile, k.TlsKeyFile); err != nil {
+			invalid(tlsPath.Child("certFile"), "tls-crt-file", k.TlsCrtFile, fmt.Sprintf("unable to load certificate and key, %v", err))
+		}
+	}
+	for i, certificate := range k.TlsCertificates {
+		crt, key, ok := ParseCertificate(certificate)
+		if !ok {
+			invalid(tlsPath.Child("certificates").Index(i), "tls-certificate", certificate, "must be like crt-file:key-file")
+			continue
+		}
+		if _, err := tls.LoadX509KeyPair(crt, key); err != nil {
+			invalid(tlsPath.Child("certificates").Index(i), "tls-certificate", certificate, fmt.Sprintf("unable to load certificate and key, %v", err))
+		}
 	}
 
-	return nil
+	for i, token := range k.Tokens {
+		if len(token) == 0 {
+			invalid(field.NewPath("auth", "tokens").Index(i), "tokens", token, "must not be empty")
+		}
+	}
+	for i, identity := range k.AgentIdentities {
+		name, tunnels := ParseIdentity(identity)
+		if len(name) == 0 {
+			invalid(field.NewPath("auth", "identities").Index(i), "agent-identity", identity, "name must not be empty")
+		}
+		for _, pattern := range tunnels {
+			if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+				invalid(field.NewPath("auth", "identities").Index(i), "agent-identity", identity, fmt.Sprintf("invalid tunnel pattern %q", pattern))
+			}
+		}
+	}
+	if len(k.AgentIdentities) != 0 && len(k.AgentClientCA) == 0 {
+		invalid(field.NewPath("auth", "identities"), "agent-identity", strings.Join(k.AgentIdentities, ","), "requires agent client CA")
+	}
+
+	if k.Balancer != "round-robin" && k.Balancer != "least-connections" {
+		errs = append(errs, field.NotSupported(field.NewPath("balancer"), k.Balancer, []string{"round-robin", "least-connections"}))
+	}
+
+	accessLog := field.NewPath("accessLog")
+	if k.AccessLogFormat != "json" && k.AccessLogFormat != "combined" {
+		errs = append(errs, field.NotSupported(accessLog.Child("format"), k.AccessLogFormat, []string{"json", "combined"}))
+	}
+	if k.AccessLogMaxSize <= 0 {
+		invalid(accessLog.Child("maxSize"), "access-log-max-size", k.AccessLogMaxSize, "must be greater than 0")
+	}
+	if k.AccessLogMaxBackups < 0 {
+		invalid(accessLog.Child("maxBackups"), "access-log-max-backups", k.AccessLogMaxBackups, "must not be negative")
+	}
+
+	limits := field.NewPath("limits")
+	if k.MaxAgents < 0 {
+		invalid(limits.Child("maxAgents"), "max-agents", k.MaxAgents, "must not be negative")
+	}
+	if k.MaxAgentsPerTunnel < 0 {
+		invalid(limits.Child("maxAgentsPerTunnel"), "max-agents-per-tunnel", k.MaxAgentsPerTunnel, "must not be negative")
+	}
+
+	validateCIDRs(field.NewPath("access", "allow"), "allow-clients", k.AllowClients, invalid)
+	validateCIDRs(field.NewPath("access", "deny"), "deny-clients", k.DenyClients, invalid)
+
+	cluster := field.NewPath("cluster")
+	if len(k.ClusterListen) != 0 {
+		validateAddress(cluster.Child("listen"), "cluster-listen", k.ClusterListen, invalid)
+		validateClusterURL(cluster.Child("address"), "cluster-address", k.ClusterAddress, invalid)
+		if len(k.ClusterToken) == 0 {
+			errs = append(errs, field.Required(cluster.Child("token"), "must be provided when cluster is enabled (--cluster-token)"))
+		}
+		// replicas talk to each other over mutual TLS
+		switch {
+		case len(k.ClusterTlsCrtFile) == 0:
+			errs = append(errs, field.Required(cluster.Child("certFile"), "must be provided when cluster is enabled (--cluster-tls-crt-file)"))
+		case len(k.ClusterTlsKeyFile) == 0:
+			errs = append(errs, field.Required(cluster.Child("keyFile"), "must be provided when cluster is enabled (--cluster-tls-key-file)"))
+		default:
+			if _, err := tls.LoadX509KeyPair(k.ClusterTlsCrtFile, k.ClusterTlsKeyFile); err != nil {
+				invalid(cluster.Child("certFile"), "cluster-tls-crt-file", k.ClusterTlsCrtFile, fmt.Sprintf("unable to load certificate and key, %v", err))
+			}
+		}
+		if len(k.ClusterCA) == 0 {
+			errs = append(errs, field.Required(cluster.Child("caFile"), "must be provided when cluster is enabled (--cluster-ca)"))
+		} else if _, err := os.Stat(k.ClusterCA); err != nil {
+			invalid(cluster.Child("caFile"), "cluster-ca", k.ClusterCA, err.Error())
+		}
+		switch k.ClusterStore {
+		case "peers":
+			for i, peer := range k.ClusterPeers {
+				validateClusterURL(cluster.Child("peers").Index(i), "cluster-peers", peer, invalid)
+			}
+		case "raft":
+			if len(k.ClusterPeers) == 0 {
+				errs = append(errs, field.Required(cluster.Child("peers"), "must be provided when cluster store is raft (--cluster-peers)"))
+			}
+			for i, peer := range k.ClusterPeers {
+				validateClusterURL(cluster.Child("peers").Index(i), "cluster-peers", peer, invalid)
+			}
+			if len(k.ClusterRaftDir) == 0 {
+				errs = append(errs, field.Required(cluster.Child("raftDir"), "must be provided when cluster store is raft (--cluster-raft-dir)"))
+			}
+		case "kubernetes":
+			for _, msg := range validation.IsDNS1123Label(k.ClusterNamespace) {
+				invalid(cluster.Child("namespace"), "cluster-namespace", k.ClusterNamespace, msg)
+			}
+			if k.ClusterLeaseDuration < 3*time.Second {
+				invalid(cluster.Child("leaseDuration"), "cluster-lease-duration", k.ClusterLeaseDuration.String(), "must be at least 3s")
+			}
+		default:
+			errs = append(errs, field.NotSupported(cluster.Child("store"), k.ClusterStore, []string{"peers", "raft", "kubernetes"}))
+		}
+	}
+
+	admin := field.NewPath("admin")
+	validateAddress(admin.Child("listen"), "admin-listen", k.AdminListen, invalid)
+	if k.DrainTimeout <= 0 {
+		invalid(admin.Child("drainTimeout"), "drain-timeout", k.DrainTimeout.String(), "must be greater than 0")
+	}
+
+	return errs.ToAggregate()
+}
+
+// ParseCertificate parses certificate like crt-file:key-file.
+func ParseCertificate(s string) (string, string, bool) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ParseIdentity parses identity like name[=tunnel-pattern,...].
+func ParseIdentity(s string) (string, []string) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return parts[0], strings.Split(parts[1], ",")
+}
+
+func validateCIDRs(path *field.Path, flag string, cidrs []string, invalid func(*field.Path, string, interface{}, string)) {
+	for i, cidr := range cidrs {
+		if _, err := utils.ParseCIDRs([]string{cidr}); err != nil {
+			invalid(path.Index(i), flag, cidr, "must be an IP address or CIDR")
+		}
+	}
+}
+
+func validateAddress(path *field.Path, flag string, address string, invalid func(*field.Path, string, interface{}, string)) {
+	if len(address) == 0 {
+		return
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		invalid(path, flag, address, err.Error())
+	}
+}
+
+func validateClusterURL(path *field.Path, flag string, s string, invalid func(*field.Path, string, interface{}, string)) {
+	if u, err := url.Parse(s); err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+		invalid(path, flag, s, "must be an https URL")
+	}
 }
 
 func (k *KunnelOptions) Print() {
-	klog.Infof("--domain=%s", k.Domain)
+	klog.Infof("--config=%s", k.ConfigFile)
+	klog.Infof("--domain=%s", strings.Join(k.Domains, ","))
 	klog.Infof("--bind=%s", k.Bind)
 	klog.Infof("--port=%d", k.Port)
 	klog.Infof("--tls-crt-file=%s", k.TlsCrtFile)
 	klog.Infof("--tls-key-file=%s", k.TlsKeyFile)
+	klog.Infof("--tls-certificate=%s", strings.Join(k.TlsCertificates, ","))
+	klog.Infof("--access-log=%s", k.AccessLog)
+	klog.Infof("--access-log-format=%s", k.AccessLogFormat)
+	klog.Infof("--agent-listen=%s", k.AgentListen)
+	klog.Infof("--agent-client-ca=%s", k.AgentClientCA)
+	klog.Infof("--agent-identity=%s", strings.Join(k.AgentIdentities, ";"))
+	klog.Infof("--redirect-listen=%s", k.RedirectListen)
+	klog.Infof("--agent-tcp-listen=%s", k.AgentTCPListen)
+	klog.Infof("--agent-quic-listen=%s", k.AgentQUICListen)
+	klog.Infof("--agent-keepalive=%s", k.AgentKeepAlive)
+	klog.Infof("--trusted-proxies=%s", strings.Join(k.TrustedProxies, ","))
+	klog.Infof("--proxy-protocol=%t", k.ProxyProtocol)
+	klog.Infof("--tokens=%d tokens", len(k.Tokens))
+	klog.Infof("--balancer=%s", k.Balancer)
+	klog.Infof("--max-agents=%d", k.MaxAgents)
+	klog.Infof("--max-agents-per-tunnel=%d", k.MaxAgentsPerTunnel)
+	klog.Infof("--allow-clients=%s", strings.Join(k.AllowClients, ","))
+	klog.Infof("--deny-clients=%s", strings.Join(k.DenyClients, ","))
+	klog.Infof("--cluster-listen=%s", k.ClusterListen)
+	klog.Infof("--cluster-address=%s", k.ClusterAddress)
+	klog.Infof("--cluster-tls-crt-file=%s", k.ClusterTlsCrtFile)
+	klog.Infof("--cluster-tls-key-file=%s", k.ClusterTlsKeyFile)
+	klog.Infof("--cluster-ca=%s", k.ClusterCA)
+	klog.Infof("--cluster-id=%s", k.ClusterID)
+	klog.Infof("--cluster-store=%s", k.ClusterStore)
+	klog.Infof("--cluster-peers=%s", strings.Join(k.ClusterPeers, ","))
+	klog.Infof("--cluster-raft-dir=%s", k.ClusterRaftDir)
+	klog.Infof("--admin-listen=%s", k.AdminListen)
+	klog.Infof("--drain-timeout=%s", k.DrainTimeout)
 }
@@ -5,8 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/zryfish/kunnel/cmd/server/app"
 	"github.com/zryfish/kunnel/pkg/proxy"
 	"k8s.io/klog"
@@ -20,16 +25,21 @@ func main() {
 		Use:  "kunnel",
 		Long: "A tool for tunnel Kubernetes service.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			var checksum [32]byte
+			if len(options.ConfigFile) != 0 {
+				var err error
+				options, checksum, err = app.Load(options.ConfigFile, cmd.Flags())
+				if err != nil {
+					return err
+				}
+			}
+
 			options.Print()
-			serverOption := &proxy.Options{
-				Host:       options.Bind,
-				Port:       options.Port,
-				Domain:     options.Domain,
-				TlsKeyFile: options.TlsKeyFile,
-				TlsCrtFile: options.TlsCrtFile,
+			if err := options.Validate(); err != nil {
+				return err
 			}
 
-			srv, err := proxy.NewServer(serverOption)
+			srv, err := proxy.NewServer(serverOptions(options))
 			if err != nil {
 				return err
 			}
@@ -40,6 +50,15 @@ func main() {
 
 			klog.Infof("Server started listening on %s", fmt.Sprintf("%s:%d", options.Bind, options.Port))
 
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGTERM)
+			go func() {
+				<-sig
+				srv.Drain()
+			}()
+
+			go reloadLoop(srv, options.ConfigFile, checksum, cmd.Flags())
+
 			return srv.Wait()
 		},
 	}
@@ -53,3 +72,115 @@ func main() {
 		log.Fatalln(err)
 	}
 }
+
+// reloadLoop reloads server on SIGHUP, or when config file changes.
+// Invalid configurations are logged and ignored.
+func reloadLoop(srv *proxy.Server, path string, checksum [32]byte, flags *pflag.FlagSet) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-sig:
+			force = true
+		case <-ticker.C:
+			if len(path) == 0 {
+				continue
+			}
+		}
+
+		options := app.NewKunnelOptions()
+		sum := checksum
+		var err error
+		if len(path) != 0 {
+			options, sum, err = app.Load(path, flags)
+		} else {
+			// flags are the only source, reloading certificates and access log
+			options.Override(flags)
+		}
+
+		if !force && sum == checksum {
+			continue
+		}
+		checksum = sum
+
+		if err != nil {
+			klog.Errorf("Failed to reload configuration, %v", err)
+			continue
+		}
+		if err := options.Validate(); err != nil {
+			klog.Errorf("Invalid configuration, keeping the running one, %v", err)
+			continue
+		}
+		if err := srv.Reload(serverOptions(options)); err != nil {
+			klog.Errorf("Failed to reload configuration, %v", err)
+		}
+	}
+}
+
+func serverOptions(options *app.KunnelOptions) *proxy.Options {
+	serverOption := &proxy.Options{
+		Host:       options.Bind,
+		Port:       options.Port,
+		Domains:    options.Domains,
+		TlsKeyFile: options.TlsKeyFile,
+		TlsCrtFile: options.TlsCrtFile,
+		AccessLog: &proxy.AccessLogOptions{
+			Path:       options.AccessLog,
+			Format:     options.AccessLogFormat,
+			MaxSize:    options.AccessLogMaxSize,
+			MaxBackups: options.AccessLogMaxBackups,
+		},
+		TrustedProxies: options.TrustedProxies,
+		ProxyProtocol:  options.ProxyProtocol,
+		Tokens:         options.Tokens,
+		Balancer:       options.Balancer,
+		Limits: proxy.Limits{
+			MaxAgents:          options.MaxAgents,
+			MaxAgentsPerTunnel: options.MaxAgentsPerTunnel,
+		},
+		AgentListen:     options.AgentListen,
+		AgentClientCA:   options.AgentClientCA,
+		RedirectListen:  options.RedirectListen,
+		AgentTCPListen:  options.AgentTCPListen,
+		AgentQUICListen: options.AgentQUICListen,
+		AgentKeepAlive:  options.AgentKeepAlive,
+		AllowClients:    options.AllowClients,
+		DenyClients:     options.DenyClients,
+		AdminListen:     options.AdminListen,
+		DrainTimeout:    options.DrainTimeout,
+	}
+
+	for _, identity := range options.AgentIdentities {
+		name, tunnels := app.ParseIdentity(identity)
+		serverOption.AgentIdentities = append(serverOption.AgentIdentities, proxy.AgentIdentity{Name: name, Tunnels: tunnels})
+	}
+
+	for _, certificate := range options.TlsCertificates {
+		crt, key, _ := app.ParseCertificate(certificate)
+		serverOption.Certificates = append(serverOption.Certificates, proxy.CertificateFiles{CrtFile: crt, KeyFile: key})
+	}
+
+	if len(options.ClusterListen) != 0 {
+		serverOption.Cluster = &proxy.ClusterOptions{
+			Listen:        options.ClusterListen,
+			Address:       options.ClusterAddress,
+			Token:         options.ClusterToken,
+			CertFile:      options.ClusterTlsCrtFile,
+			KeyFile:       options.ClusterTlsKeyFile,
+			CAFile:        options.ClusterCA,
+			Identity:      options.ClusterID,
+			Store:         options.ClusterStore,
+			Peers:         options.ClusterPeers,
+			RaftDir:       options.ClusterRaftDir,
+			Namespace:     options.ClusterNamespace,
+			KubeConfig:    options.KubeConfig,
+			LeaseDuration: options.ClusterLeaseDuration,
+		}
+	}
+
+	return serverOption
+}
@@ -1,216 +1,960 @@
 package agent
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
-	"os"
-	"os/signal"
+	"net/url"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/go-logr/logr"
 	"github.com/jpillora/backoff"
+	"github.com/zryfish/kunnel/pkg/control"
+	"github.com/zryfish/kunnel/pkg/mux"
+	"github.com/zryfish/kunnel/pkg/transport"
 	"github.com/zryfish/kunnel/pkg/utils"
 	"github.com/zryfish/kunnel/pkg/version"
-	"golang.org/x/crypto/ssh"
-	"k8s.io/klog"
+	"k8s.io/klog/v2/klogr"
 )
 
+// targetTimeout bounds dialing targets and TLS handshakes with them.
+const targetTimeout = 10 * time.Second
+
+// Options configures client, zero values are defaults.
+type Options struct {
+	// Server is url of server, like wss://kunnel.run
+	Server string
+	Config *Config
+
+	// KeepAlive is interval of pings to server, disabled if 0
+	KeepAlive time.Duration
+	// KeepAliveTimeout is how long a ping waits for reply before
+	// connection is closed as dead and client reconnects, 3 times
+	// KeepAlive if 0
+	KeepAliveTimeout time.Duration
+	// MaxRetryCount is attempts reconnecting before client gives up,
+	// unlimited if 0
+	MaxRetryCount int
+	// MaxRetryInterval bounds backoff between attempts
+	MaxRetryInterval time.Duration
+	// DrainTimeout is how long connection of a draining server keeps
+	// serving streams in flight once client reconnected, 30s if 0
+	DrainTimeout time.Duration
+
+	// OnEvent is called on events of client, in order from one
+	// goroutine at a time, it mustn't block
+	OnEvent func(Event)
+
+	// Listen hands streams of tunnel to program by Client.Listener,
+	// instead of client dialing LocalHost:LocalPort and routes, which
+	// only name targets to server then, 127.0.0.1:80 by default. Streams
+	// carry what server sends to targets, TLS for https targets unless
+	// agent negotiates it.
+	Listen bool
+
+	// StatusListen is address serving /healthz, /readyz, /status and
+	// /metrics of client, disabled if empty
+	StatusListen string
+
+	// Logger logs what client does, klog by default
+	Logger logr.Logger
+}
+
+// EventType is type of event of client.
+type EventType string
+
+const (
+	// Connected is client joining tunnel, at Endpoints of event
+	Connected EventType = "connected"
+	// Disconnected is client losing connection to server, by Err of
+	// event if any, or leaving it for Reason
+	Disconnected EventType = "disconnected"
+	// EndpointsChanged is tunnel becoming available at Endpoints of
+	// event, instead of those last connected at
+	EndpointsChanged EventType = "endpoints"
+)
+
+// ReasonDrain is reason of client leaving a draining server.
+const ReasonDrain = "drain"
+
+// Event is something happening to client.
+type Event struct {
+	Type      EventType
+	Endpoints []control.Endpoint
+	Err       error
+	Reason    string
+}
+
 type Client struct {
-	sshConfig        *ssh.ClientConfig
-	sshConn          ssh.Conn
-	running          bool
-	runningCh        chan error
+	muxConfig        *mux.ClientConfig
+	protocols        []string
 	config           *Config
 	keepAlive        time.Duration
+	keepAliveTimeout time.Duration
 	maxRetryCount    int
 	maxRetryInterval time.Duration
+	drainTimeout     time.Duration
 	server           string
+	onEvent          func(Event)
+	listener         *listener
+	statusListen     string
+	metrics          *metrics
+	log              logr.Logger
+
+	// ctx is cancelled by closing client, which closes connections and
+	// stops loops
+	ctx    context.Context
+	cancel context.CancelFunc
+	// retry wakes up connection loop waiting to reconnect
+	retry chan struct{}
+	// connected is closed once client joins tunnel the first time
+	connected chan struct{}
+	// done is closed with err set once client gives up or is closed,
+	// and goroutines serving streams are gone
+	done chan struct{}
+	err  error
+	// streams tracks goroutines serving streams
+	streams sync.WaitGroup
+
+	mu        sync.Mutex
+	sshConn   mux.Conn
+	endpoints []control.Endpoint
+	// transport is the one connected to server last time
+	transport  string
+	latency    time.Duration
+	reconnects int
+
+	// eventMu serializes events
+	eventMu sync.Mutex
 }
 
+// New returns client of options, which connects to server once started.
+func New(options *Options) (*Client, error) {
+	if options.Config == nil {
+		return nil, errors.New("no config")
+	}
+	if options.Listen && (len(options.Config.LocalHost) == 0 || options.Config.LocalPort == 0) {
+		config := *options.Config
+		if len(config.LocalHost) == 0 {
+			config.LocalHost = "127.0.0.1"
+		}
+		if config.LocalPort == 0 {
+			config.LocalPort = 80
+		}
+		o := *options
+		o.Config = &config
+		options = &o
+	}
+	if err := options.Config.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := url.Parse(options.Server); err != nil {
+		return nil, fmt.Errorf("invalid server %s, %v", options.Server, err)
+	}
+	return newClient(options), nil
+}
+
+// NewClient returns client of config validated.
+//
+// Deprecated: use New.
 func NewClient(config *Config, keepAlive time.Duration, maxRetryCount int, maxRetryInterval time.Duration, server string) *Client {
+	return newClient(&Options{
+		Server:           server,
+		Config:           config,
+		KeepAlive:        keepAlive,
+		MaxRetryCount:    maxRetryCount,
+		MaxRetryInterval: maxRetryInterval,
+	})
+}
+
+func newClient(options *Options) *Client {
+	config := options.Config
 	client := &Client{
-		running:          true,
-		runningCh:        make(chan error, 1),
 		config:           config,
-		keepAlive:        keepAlive,
-		maxRetryCount:    maxRetryCount,
-		maxRetryInterval: maxRetryInterval,
-		server:           server,
+		keepAlive:        options.KeepAlive,
+		keepAliveTimeout: options.KeepAliveTimeout,
+		maxRetryCount:    options.MaxRetryCount,
+		maxRetryInterval: options.MaxRetryInterval,
+		drainTimeout:     options.DrainTimeout,
+		server:           options.Server,
+		onEvent:          options.OnEvent,
+		statusListen:     options.StatusListen,
+		metrics:          newMetrics(),
+		log:              options.Logger,
+		retry:            make(chan struct{}, 1),
+		connected:        make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+
+	if client.log == nil {
+		client.log = klogr.New()
 	}
 
-	client.sshConfig = &ssh.ClientConfig{
-		User:            "",
-		Auth:            []ssh.AuthMethod{ssh.Password("")},
-		ClientVersion:   "SSH-" + version.ProtocolVersion + "-client",
-		HostKeyCallback: client.verifyServer,
-		Timeout:         30 * time.Second,
+	if client.keepAliveTimeout <= 0 {
+		client.keepAliveTimeout = 3 * client.keepAlive
+	}
+	if client.drainTimeout <= 0 {
+		client.drainTimeout = 30 * time.Second
+	}
+
+	if options.Listen {
+		client.listener = newListener(addr(config.Address()), client.log)
+	}
+
+	// validated with config
+	client.protocols, _ = mux.Protocols(config.Multiplexer)
+	client.muxConfig = &mux.ClientConfig{
+		User:    config.Name,
+		Token:   config.Token,
+		Timeout: 30 * time.Second,
 	}
 
 	return client
 }
 
 func (c *Client) Run() error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	if err := c.Start(ctx); err != nil {
+	if _, err := c.Start(context.Background()); err != nil {
 		return err
 	}
 
 	return c.Wait()
 }
 
-func (c *Client) Start(ctx context.Context) error {
-	if c.keepAlive > 0 {
-		go c.keepAliveLoop()
+// Start connects to server, returning endpoints of tunnel once joined.
+// Client keeps reconnecting until it gives up, is closed or ctx is done,
+// which fails Start if it never joined.
+func (c *Client) Start(ctx context.Context) ([]control.Endpoint, error) {
+	if server, err := url.Parse(c.server); err == nil {
+		if _, err := c.offered(server); err != nil {
+			c.err = err
+			c.cancel()
+			close(c.done)
+			return nil, c.err
+		}
+	}
+
+	if len(c.statusListen) != 0 {
+		if err := c.serveStatus(c.statusListen); err != nil {
+			c.err = fmt.Errorf("unable to serve status at %s, %v", c.statusListen, err)
+			c.cancel()
+			close(c.done)
+			return nil, c.err
+		}
 	}
 
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.done:
+		}
+	}()
+
 	go c.connectionLoop()
-	return nil
+
+	select {
+	case <-c.connected:
+		return c.Endpoints(), nil
+	case <-c.done:
+		if c.err != nil {
+			return nil, c.err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("client closed")
+	}
 }
 
+// Wait waits for client to give up or be closed, and streams being
+// served to be gone, returning error client gave up by.
 func (c *Client) Wait() error {
-	return <-c.runningCh
+	<-c.done
+	return c.err
 }
 
-func (c *Client) Close() error {
-	c.running = false
-	if c.sshConn == nil {
+// Listener returns listener of streams of tunnel, nil unless client
+// listens, see Options.Listen. Closing client closes it.
+func (c *Client) Listener() net.Listener {
+	if c.listener == nil {
 		return nil
 	}
-	return c.sshConn.Close()
+	return c.listener
+}
+
+// Close closes connections to server and stops reconnecting, Wait
+// returns once streams being served are gone.
+func (c *Client) Close() error {
+	c.cancel()
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	return nil
+}
+
+// Reconnect has client waiting to reconnect do so now, instead of
+// backing off.
+func (c *Client) Reconnect() {
+	select {
+	case c.retry <- struct{}{}:
+	default:
+	}
+}
+
+// Endpoints returns endpoints of tunnel last joined.
+func (c *Client) Endpoints() []control.Endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints
+}
+
+// setEndpoints updates endpoints of tunnel, emitting EndpointsChanged if
+// they changed since last joined.
+func (c *Client) setEndpoints(endpoints []control.Endpoint) {
+	c.mu.Lock()
+	previous := c.endpoints
+	c.endpoints = endpoints
+	c.mu.Unlock()
+
+	if sameEndpoints(previous, endpoints) {
+		return
+	}
+	for _, endpoint := range endpoints {
+		c.log.Info("Service available", "url", endpoint.URL)
+	}
+	if previous != nil {
+		c.emit(Event{Type: EndpointsChanged, Endpoints: endpoints})
+	}
+}
+
+func (c *Client) emit(event Event) {
+	if c.onEvent != nil {
+		c.eventMu.Lock()
+		defer c.eventMu.Unlock()
+		c.onEvent(event)
+	}
+}
+
+// conn returns connection to server, nil if disconnected.
+func (c *Client) conn() mux.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sshConn
 }
 
-func (c *Client) keepAliveLoop() {
-	for c.running {
-		time.Sleep(c.keepAlive)
-		if c.sshConn != nil {
-			c.sshConn.SendRequest("ping", true, nil)
+func (c *Client) setConn(conn mux.Conn) {
+	c.mu.Lock()
+	c.sshConn = conn
+	c.mu.Unlock()
+}
+
+func sameEndpoints(a, b []control.Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
+	return true
+}
+
+// heartbeat pings server until connection is gone, closing it once a
+// ping isn't replied in time, which reconnects.
+func (c *Client) heartbeat(conn mux.Conn, gone <-chan struct{}, dead chan<- error) {
+	err := mux.KeepAlive(conn, control.PingRequest, c.keepAlive, c.keepAliveTimeout, gone, func(rtt time.Duration) {
+		c.setLatency(rtt)
+		c.metrics.observeRTT(rtt)
+	})
+	if err != nil {
+		atomic.AddUint64(&c.metrics.keepAliveFailures, 1)
+		dead <- fmt.Errorf("server is not responding, %v", err)
+		conn.Close()
+	}
 }
 
 func (c *Client) connectionLoop() {
+	defer func() {
+		// client giving up closes too
+		c.Close()
+		c.streams.Wait()
+		close(c.done)
+	}()
+
 	var connectionErr error
+	joined, attempted := false, false
 	b := &backoff.Backoff{Max: c.maxRetryInterval}
-	for c.running {
+	for c.ctx.Err() == nil {
 		if connectionErr != nil {
+			atomic.AddUint64(&c.metrics.connectionErrors, 1)
 			attempt := int(b.Attempt())
 			maxAttempt := c.maxRetryCount
 			d := b.Duration()
 
-			msg := fmt.Sprintf("Connection error: %s", connectionErr)
+			keysAndValues := []interface{}{"err", connectionErr}
 			if attempt > 0 {
-				msg += fmt.Sprintf(" (Attempt: %d", attempt)
+				keysAndValues = append(keysAndValues, "attempt", attempt)
 				if maxAttempt > 0 {
-					msg += fmt.Sprintf("/%d", maxAttempt)
+					keysAndValues = append(keysAndValues, "maxAttempts", maxAttempt)
 				}
-				msg += ")"
 			}
-			klog.Warning(msg)
+			c.log.Info("Connection error", keysAndValues...)
 
 			if maxAttempt > 0 && attempt >= maxAttempt {
-				break
+				c.err = connectionErr
+				return
 			}
-			klog.Warningf("Retrying in %s...", d)
+			c.log.Info("Retrying", "after", d)
 			connectionErr = nil
 
-			sig := make(chan os.Signal, 1)
-			signal.Notify(sig, syscall.SIGHUP)
+			c.metrics.setBackoff(d)
+			timer := time.NewTimer(d)
 			select {
-			case <-time.After(d):
-			case <-sig:
+			case <-timer.C:
+			case <-c.retry:
+			case <-c.ctx.Done():
+			}
+			timer.Stop()
+			c.metrics.setBackoff(0)
+			if c.ctx.Err() != nil {
+				return
 			}
-			signal.Stop(sig)
 		}
 
-		dialer := websocket.Dialer{
-			ReadBufferSize:   1024,
-			WriteBufferSize:  1024,
-			HandshakeTimeout: 45 * time.Second,
-			Subprotocols:     []string{version.ProtocolVersion},
+		if attempted {
+			atomic.AddUint64(&c.metrics.reconnectAttempts, 1)
 		}
-
-		wsHeaders := http.Header{}
-
-		wsConn, _, err := dialer.Dial(c.server, wsHeaders)
+		attempted = true
+		conn, protocol, discovery, err := c.dial()
 		if err != nil {
 			connectionErr = err
 			continue
 		}
 
-		conn := utils.NewWebSocketConn(wsConn)
-		klog.V(4).Info("Handshaking...")
-		sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", c.sshConfig)
+		// connection is closed once client is, or once it's gone
+		gone := make(chan struct{})
+		c.streams.Add(1)
+		go func() {
+			defer c.streams.Done()
+			select {
+			case <-c.ctx.Done():
+				conn.Close()
+			case <-gone:
+			}
+		}()
+
+		c.log.V(4).Info("Handshaking", "protocol", protocol)
+		sshConn, streams, reqs, err := mux.NewClientConn(conn, protocol, c.muxConfig)
 		if err != nil {
-			if strings.Contains(err.Error(), "unable to authenticate") {
-				klog.Error("Authentication failed", err)
-			} else {
-				klog.Error(err)
+			close(gone)
+			conn.Close()
+			if c.ctx.Err() != nil {
+				return
 			}
-			break
+			if !strings.Contains(err.Error(), "unable to authenticate") {
+				connectionErr = fmt.Errorf("unable to connect, %v", err)
+				continue
+			}
+			err = fmt.Errorf("authentication failed, %v", err)
+			c.log.Error(err, "Unable to connect")
+			c.err = err
+			return
 		}
 
-		conf, _ := c.config.Marshal()
-		klog.V(4).Info("Sending config")
 		t0 := time.Now()
-		_, payload, err := sshConn.SendRequest("config", true, conf)
+		endpoints, err := c.handshake(sshConn, discovery.Control == 0)
+		if err != nil {
+			close(gone)
+			sshConn.Close()
+			if c.ctx.Err() != nil {
+				return
+			}
+			if !fatal(err) {
+				connectionErr = fmt.Errorf("unable to join tunnel, %v", err)
+				continue
+			}
+			c.log.Error(err, "Unable to join tunnel")
+			c.err = err
+			return
+		}
+
+		latency := time.Since(t0)
+		c.log.V(2).Info("Connected", "latency", latency)
+		b.Reset()
+		c.mu.Lock()
+		c.sshConn = sshConn
+		c.latency = latency
+		if joined {
+			c.reconnects++
+			atomic.AddUint64(&c.metrics.reconnects, 1)
+		}
+		c.mu.Unlock()
+		joined = true
+		c.setEndpoints(endpoints)
+		c.emit(Event{Type: Connected, Endpoints: endpoints})
+		select {
+		case <-c.connected:
+		default:
+			close(c.connected)
+		}
+
+		drain := make(chan struct{})
+		active := new(int64)
+		c.streams.Add(2)
+		go func() {
+			defer c.streams.Done()
+			c.handleRequests(reqs, drain)
+		}()
+		go func() {
+			defer c.streams.Done()
+			c.connectStreams(streams, sshConn.RemoteAddr(), active)
+		}()
+		dead := make(chan error, 1)
+		if c.keepAlive > 0 {
+			c.streams.Add(1)
+			go func() {
+				defer c.streams.Done()
+				c.heartbeat(sshConn, gone, dead)
+			}()
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- sshConn.Wait()
+			close(gone)
+		}()
+		select {
+		case err = <-done:
+		case <-drain:
+			// old connection keeps serving streams in flight until
+			// they are done, server closes it or drain timeout
+			c.log.Info("Server is draining, reconnecting")
+			c.setConn(nil)
+			c.emit(Event{Type: Disconnected, Reason: ReasonDrain})
+			c.streams.Add(1)
+			go func() {
+				defer c.streams.Done()
+				c.closeDrained(sshConn, active, gone)
+			}()
+			continue
+		}
+		c.setConn(nil)
+		if err == io.EOF || c.ctx.Err() != nil {
+			err = nil
+		}
+		select {
+		case err = <-dead:
+		default:
+		}
+		c.emit(Event{Type: Disconnected, Err: err})
+		if err != nil {
+			connectionErr = err
+			continue
+		}
+		c.log.V(2).Info("Disconnected")
+	}
+}
+
+// dial connects to server by the first transport working, in order of
+// agent's preference skipping those server doesn't support, returning
+// protocol version server picked and what's discovered. Transport
+// connected last time is tried first.
+func (c *Client) dial() (net.Conn, string, *transport.Discovery, error) {
+	server, err := url.Parse(c.server)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	// loaded on each dial, so that rotated certificates are picked up
+	tlsConfig, err := c.config.TLSConfig()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	protocols, err := c.offered(server)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	options := &transport.DialOptions{Protocols: protocols, TLSConfig: tlsConfig}
+
+	proxy, err := proxyFor(c.config.Proxy, c.server)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if proxy != nil {
+		c.log.V(4).Info("Connecting through proxy", "proxy", proxy.Redacted())
+		options.NetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialProxy(ctx, proxy, addr)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	discovery, err := transport.Discover(ctx, server, options)
+	cancel()
+	if err != nil {
+		var upgrade *transport.UpgradeRequiredError
+		if errors.As(err, &upgrade) {
+			return nil, "", nil, fmt.Errorf("agent speaks protocol versions %s, %v", strings.Join(protocols, ", "), err)
+		}
+		// servers without discovery speak websocket only
+		c.log.V(4).Info("Unable to discover transports", "err", err)
+		discovery = &transport.Discovery{Transports: []string{transport.WebSocket}}
+	}
+	if len(discovery.Protocol) == 0 {
+		// servers predating negotiation speak ssh only, unless they
+		// accepted the only version offered
+		discovery.Protocol = version.ProtocolSSH
+		if len(protocols) == 1 {
+			discovery.Protocol = protocols[0]
+		}
+	}
+	options.Protocol = discovery.Protocol
+	options.TCPPort = discovery.TCPPort
+	options.QUICPort = discovery.QUICPort
+
+	names := c.config.Transports
+	if len(names) == 0 {
+		names = transport.DefaultOrder
+	}
+	names = withFallback(names)
+	if len(c.transport) != 0 {
+		names = append([]string{c.transport}, names...)
+	}
+
+	var errs []string
+	tried := make(map[string]bool)
+	for _, name := range names {
+		if tried[name] || !discovery.Supports(name) {
+			continue
+		}
+		tried[name] = true
+
+		ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+		conn, protocol, err := transport.Get(name).Dial(ctx, server, options)
+		cancel()
 		if err != nil {
-			klog.Error("Config verification failed", err)
-			break
+			c.log.V(2).Info("Unable to connect", "transport", name, "err", err)
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+
+		if name != c.transport {
+			c.log.V(2).Info("Connected", "transport", name)
+		}
+		c.mu.Lock()
+		c.transport = name
+		c.mu.Unlock()
+		return conn, protocol, discovery, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, "", nil, fmt.Errorf("server supports none of transports %s", strings.Join(names, ", "))
+	}
+	return nil, "", nil, errors.New(strings.Join(errs, "; "))
+}
+
+// withFallback adds websocket after quic, so agents connect even if UDP
+// is blocked on their way.
+func withFallback(names []string) []string {
+	var quic bool
+	for _, name := range names {
+		if name == transport.WebSocket {
+			return names
 		}
+		quic = quic || name == transport.QUIC
+	}
+	if !quic {
+		return names
+	}
+	return append(append([]string(nil), names...), transport.WebSocket)
+}
+
+// offered returns protocol versions offered to server. Nothing but TLS
+// encrypts qmux, so plain servers are spoken to by ssh.
+func (c *Client) offered(server *url.URL) ([]string, error) {
+	if server.Scheme == "wss" || server.Scheme == "https" {
+		return c.protocols, nil
+	}
+	var protocols []string
+	for _, p := range c.protocols {
+		if p != version.ProtocolQmux {
+			protocols = append(protocols, p)
+		}
+	}
+	if len(protocols) == 0 {
+		return nil, fmt.Errorf("multiplexer %s requires tls, connect to a wss or https server", mux.Qmux)
+	}
+	return protocols, nil
+}
 
+// handshake joins tunnel, by config request with servers predating
+// control protocol, returning endpoints of tunnel.
+func (c *Client) handshake(conn mux.Conn, legacy bool) ([]control.Endpoint, error) {
+	conf, _ := c.config.Marshal()
+	if legacy {
+		c.log.V(4).Info("Sending config")
+		_, payload, err := conn.SendRequest(control.ConfigRequest, true, conf)
+		if err != nil {
+			return nil, fmt.Errorf("config verification failed, %v", err)
+		}
 		msg := &utils.Message{}
 		if err := msg.Unmarshal(payload); err != nil {
-			klog.Error("Invalid response from server", err)
-			break
+			return nil, fmt.Errorf("invalid response from server, %v", err)
 		}
-
 		if msg.Err != nil {
-			klog.Error(msg.Err.Error())
-			break
+			return nil, msg.Err
 		}
 
+		var endpoints []control.Endpoint
 		if len(msg.Domain) != 0 {
-			klog.Infof("Service available at https://%s", msg.Domain)
+			endpoints = append(endpoints, control.Endpoint{Hostname: msg.Domain, URL: "https://" + msg.Domain})
 		}
+		for _, hostname := range c.config.Hostnames {
+			endpoints = append(endpoints, control.Endpoint{Hostname: hostname, URL: "https://" + hostname, Custom: true})
+		}
+		return endpoints, nil
+	}
 
-		klog.V(2).Infof("Connected (Latency %s)", time.Since(t0))
-		b.Reset()
-		c.sshConn = sshConn
-		go ssh.DiscardRequests(reqs)
-		go c.connectStreams(chans)
+	c.log.V(4).Info("Sending handshake")
+	handshake := &control.Handshake{
+		Version:      control.Version,
+		Capabilities: []control.Capability{control.Events},
+		Config:       conf,
+	}
+	_, payload, err := conn.SendRequest(control.HandshakeRequest, true, control.Marshal(handshake))
+	if err != nil {
+		return nil, fmt.Errorf("handshake failed, %v", err)
+	}
+	response := &control.Response{}
+	if err := control.Unmarshal(payload, response); err != nil {
+		return nil, fmt.Errorf("invalid response from server, %v", err)
+	}
+	if err := response.Err(); err != nil {
+		return nil, err
+	}
+	for _, warning := range response.Warnings {
+		c.log.Info("Warning from server", "message", warning)
+	}
+	return response.Endpoints, nil
+}
 
-		err = sshConn.Wait()
-		c.sshConn = nil
-		if err != nil && err != io.EOF {
-			connectionErr = err
-			continue
+// fatal reports whether handshake failed by err won't succeed by
+// reconnecting, so client gives up instead.
+func fatal(err error) bool {
+	var e *control.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.Code {
+	case control.Unauthorized, control.InvalidConfig, control.Conflict:
+		return true
+	}
+	return false
+}
+
+// closeDrained closes connection of a draining server once its streams
+// in flight are done, or drain timeout expires.
+func (c *Client) closeDrained(conn mux.Conn, active *int64, gone <-chan struct{}) {
+	timeout := time.NewTimer(c.drainTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(active) > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			c.log.Info("Closing connection of draining server with streams in flight", "streams", atomic.LoadInt64(active))
+			conn.Close()
+			return
+		case <-gone:
+			return
+		}
+	}
+	conn.Close()
+}
+
+// handleRequests handles requests from server, closes drain when
+// server asks agent to reconnect.
+func (c *Client) handleRequests(reqs <-chan *mux.Request, drain chan struct{}) {
+	drained := false
+	for req := range reqs {
+		switch req.Type {
+		case control.PingRequest:
+			req.Reply(true, nil)
+		case control.DrainRequest, control.EventRequest:
+			event := &control.Event{Type: control.Drain}
+			if req.Type == control.EventRequest {
+				if err := control.Unmarshal(req.Payload, event); err != nil {
+					c.log.Info("Invalid event from server", "err", err)
+					continue
+				}
+			}
+
+			switch event.Type {
+			case control.Drain:
+				if !drained {
+					drained = true
+					close(drain)
+				}
+			case control.EndpointsChanged:
+				c.setEndpoints(event.Endpoints)
+			case control.Warning:
+				c.log.Info("Warning from server", "message", event.Message)
+			}
+		default:
+			req.Reply(false, nil)
 		}
-		klog.V(2).Info("Disconnected")
 	}
-	close(c.runningCh)
 }
 
-func (c *Client) connectStreams(chans <-chan ssh.NewChannel) {
-	for ch := range chans {
-		remote := string(ch.ExtraData())
-		stream, reqs, err := ch.Accept()
+// connectStreams dials targets of streams server opens, or hands them to
+// listener, counting streams in flight by active.
+func (c *Client) connectStreams(streams <-chan mux.NewStream, server net.Addr, active *int64) {
+	targets := make(map[string]bool)
+	for _, target := range c.config.Targets() {
+		targets[target] = true
+	}
+
+	for ch := range streams {
+		remote := ch.Target()
+		if !targets[remote] {
+			c.log.Info("Rejecting stream to unknown target", "target", remote)
+			ch.Reject("unknown target")
+			atomic.AddUint64(&c.metrics.streamsFailed, 1)
+			continue
+		}
+
+		stream, err := ch.Accept()
 		if err != nil {
-			klog.Error("Failed to accept stream", err)
+			c.log.Error(err, "Failed to accept stream", "target", remote)
+			atomic.AddUint64(&c.metrics.streamsFailed, 1)
 			continue
 		}
+		atomic.AddUint64(&c.metrics.streamsOpened, 1)
+		stream = c.metrics.count(stream, c.tunnelName())
 
-		go ssh.DiscardRequests(reqs)
-		go utils.HandleTCPStream(stream, remote)
+		atomic.AddInt64(active, 1)
+		c.streams.Add(1)
+		go func() {
+			defer c.streams.Done()
+			defer atomic.AddInt64(active, -1)
+			switch {
+			case c.listener != nil:
+				c.listener.serve(stream, remote, server, len(c.config.ProxyProtocol) != 0)
+			case c.config.AgentUpstreamTLS && c.config.TargetProtocol(remote) == "https":
+				c.handleTLSStream(stream, remote)
+			default:
+				c.handleTCPStream(stream, remote)
+			}
+		}()
 	}
 }
 
-func (agent *Client) verifyServer(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	return nil
+// handleTCPStream pipes stream to target.
+func (c *Client) handleTCPStream(stream net.Conn, remote string) {
+	src, conn, err := c.dialStream(stream, remote)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	utils.HandleStream(src, conn, remote)
+}
+
+// dialStream dials target of stream. With PROXY protocol configured, the
+// header server sends ahead of stream is read off it and written to target
+// by agent, one describing no client if server sent none, so targets
+// requiring headers always get a valid one. Stream is returned to read
+// what follows the header from.
+func (c *Client) dialStream(stream net.Conn, remote string) (net.Conn, net.Conn, error) {
+	if len(c.config.ProxyProtocol) == 0 {
+		conn, err := c.dialTarget(remote)
+		return stream, conn, err
+	}
+
+	src := &bufferedStream{Conn: stream, reader: bufio.NewReader(stream)}
+	from, to, err := utils.ReadProxyHeader(src.reader)
+	if err != nil {
+		c.log.Error(err, "Invalid proxy protocol header", "target", remote)
+		return nil, nil, err
+	}
+
+	conn, err := c.dialTarget(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := utils.WriteProxyHeader(conn, c.config.ProxyProtocol, from, to); err != nil {
+		c.log.Error(err, "Failed to send proxy protocol header", "target", remote)
+		conn.Close()
+		return nil, nil, err
+	}
+	return src, conn, nil
+}
+
+func (c *Client) dialTarget(remote string) (net.Conn, error) {
+	d := net.Dialer{Timeout: targetTimeout}
+	conn, err := d.DialContext(c.ctx, "tcp", remote)
+	if err != nil {
+		c.log.Error(err, "Failed to dial target", "target", remote)
+		c.metrics.dialFailed(remote)
+	}
+	return conn, err
+}
+
+// tunnelName returns name of tunnel joined, or its hostname for tunnels
+// without a name.
+func (c *Client) tunnelName() string {
+	if len(c.config.Tunnel) != 0 {
+		return c.config.Tunnel
+	}
+	for _, endpoint := range c.Endpoints() {
+		if !endpoint.Custom {
+			return endpoint.Hostname
+		}
+	}
+	return ""
+}
+
+// handleTLSStream negotiates TLS to target on behalf of server, which
+// sends plain HTTP through stream. PROXY protocol header is passed to
+// target before handshake.
+func (c *Client) handleTLSStream(stream net.Conn, remote string) {
+	src, conn, err := c.dialStream(stream, remote)
+	if err != nil {
+		stream.Close()
+		return
+	}
+
+	// validated with config
+	tlsConfig, _ := c.config.UpstreamTLS.TLSConfig()
+	tlsConfig.ServerName = c.config.ServerName(remote)
+	tlsConn := tls.Client(conn, tlsConfig)
+	ctx, cancel := context.WithTimeout(c.ctx, targetTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		c.log.Error(err, "TLS handshake with target failed", "target", remote)
+		conn.Close()
+		stream.Close()
+		return
+	}
+
+	utils.HandleStream(src, tlsConn, remote)
+}
+
+// bufferedStream reads stream through reader holding bytes peeked.
+type bufferedStream struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (s *bufferedStream) Read(b []byte) (int, error) {
+	return s.reader.Read(b)
 }
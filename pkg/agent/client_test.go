@@ -0,0 +1,368 @@
+package agent_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zryfish/kunnel/pkg/agent"
+	"github.com/zryfish/kunnel/pkg/proxy"
+)
+
+// startServer starts a server of options on a free loopback port,
+// returning its url.
+func startServer(t *testing.T, options *proxy.Options) (*proxy.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	if options == nil {
+		options = &proxy.Options{DrainTimeout: time.Second}
+	}
+	options.Host, options.Port, options.Domains = "127.0.0.1", port, []string{"kunnel.test"}
+	s, err := proxy.NewServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, fmt.Sprintf("ws://127.0.0.1:%d", port)
+}
+
+// startForwarder forwards connections to target until cut, which
+// closes them and stops listening. Connections are closed both ways
+// once either side closes them.
+func startForwarder(t *testing.T, target string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			mu.Lock()
+			conns = append(conns, conn, upstream)
+			mu.Unlock()
+			go func() {
+				defer conn.Close()
+				defer upstream.Close()
+				go func() {
+					defer conn.Close()
+					defer upstream.Close()
+					io.Copy(upstream, conn)
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	cut := func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	t.Cleanup(cut)
+	return l.Addr().String(), cut
+}
+
+func newClient(t *testing.T, server string) *agent.Client {
+	return newClientWith(t, &agent.Options{Server: server})
+}
+
+// newClientWith returns client of options, retrying fast, of a default
+// config unless given.
+func newClientWith(t *testing.T, options *agent.Options) *agent.Client {
+	if options.Config == nil {
+		options.Config = &agent.Config{Name: "test", LocalHost: "127.0.0.1", LocalPort: 80, Protocol: "http"}
+	}
+	options.MaxRetryInterval = 100 * time.Millisecond
+	client, err := agent.New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// expectReady waits for client to join tunnel or leave it.
+func expectReady(t *testing.T, client *agent.Client, ready bool) {
+	timeout := time.After(10 * time.Second)
+	for client.Status().Ready != ready {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("client not ready %v", ready)
+		}
+	}
+}
+
+// expectStopped expects client stopped without error.
+func expectStopped(t *testing.T, client *agent.Client) {
+	errs := make(chan error, 1)
+	go func() { errs <- client.Wait() }()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("client still running")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	_, server := startServer(t, nil)
+	client := newClient(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	endpoints, err := client.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) == 0 {
+		t.Fatal("no endpoints")
+	}
+	cancel()
+	expectStopped(t, client)
+}
+
+func TestClientClose(t *testing.T) {
+	_, server := startServer(t, nil)
+	client := newClient(t, server)
+
+	if _, err := client.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	expectStopped(t, client)
+	// closing again is harmless
+	client.Close()
+}
+
+func TestClientFallsBackFromQUIC(t *testing.T) {
+	// server without UDP listener is like one agents can't reach by UDP
+	_, server := startServer(t, nil)
+	client := newClientWith(t, &agent.Options{Server: server, Config: &agent.Config{
+		Name: "test", LocalHost: "127.0.0.1", LocalPort: 80, Protocol: "http", Transports: []string{"quic"},
+	}})
+
+	if _, err := client.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if transport := client.Status().Transport; transport != "websocket" {
+		t.Fatalf("expected falling back to websocket, connected by %s", transport)
+	}
+}
+
+func TestClientCancelBeforeJoined(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens there once closed
+	l.Close()
+	client := newClient(t, "ws://"+l.Addr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Start(ctx)
+		errs <- err
+	}()
+	// a few attempts back off meanwhile
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("expected start cancelled, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("start still waiting")
+	}
+	expectStopped(t, client)
+}
+
+func TestClientCancelReconnecting(t *testing.T) {
+	_, server := startServer(t, nil)
+	address, cut := startForwarder(t, strings.TrimPrefix(server, "ws://"))
+	client := newClient(t, "ws://"+address)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cut()
+	expectReady(t, client, false)
+	// a few attempts back off meanwhile
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	expectStopped(t, client)
+}
+
+func TestClientCancelDraining(t *testing.T) {
+	s, server := startServer(t, nil)
+	client := newClient(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- s.Drain() }()
+	// client leaves for another replica, there's none
+	expectReady(t, client, false)
+	cancel()
+	expectStopped(t, client)
+
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		t.Fatal("server still draining")
+	}
+}
+
+func TestClientGivesUpUnauthenticated(t *testing.T) {
+	_, server := startServer(t, &proxy.Options{Tokens: []string{"s3cr3t"}})
+	client := newClient(t, server)
+
+	if _, err := client.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("expected authentication failed, got %v", err)
+	}
+	if err := client.Wait(); err == nil {
+		t.Fatal("expected client stopped by error")
+	}
+}
+
+func TestClientRetriesRejected(t *testing.T) {
+	_, server := startServer(t, &proxy.Options{Limits: proxy.Limits{MaxAgents: 1}})
+	first := newClient(t, server)
+	if _, err := first.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// server is full, which may change
+	second := newClient(t, server)
+	started := make(chan error, 1)
+	go func() {
+		_, err := second.Start(context.Background())
+		started <- err
+	}()
+	select {
+	case err := <-started:
+		t.Fatalf("expected client retrying, got %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("client still retrying")
+	}
+}
+
+func TestClientDrainTimeout(t *testing.T) {
+	s, server := startServer(t, &proxy.Options{DrainTimeout: 10 * time.Second})
+	address, _ := startForwarder(t, strings.TrimPrefix(server, "ws://"))
+
+	// target accepts requests, never replying
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	var mu sync.Mutex
+	var events []agent.Event
+	client := newClientWith(t, &agent.Options{
+		Server:       "ws://" + address,
+		Config:       &agent.Config{Name: "test", LocalHost: "127.0.0.1", LocalPort: target.Addr().(*net.TCPAddr).Port, Protocol: "http"},
+		DrainTimeout: 500 * time.Millisecond,
+		OnEvent: func(e agent.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	endpoints, err := client.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a request in flight holds old connection
+	requested := make(chan struct{})
+	go func() {
+		defer close(requested)
+		req, _ := http.NewRequest(http.MethodGet, strings.Replace(server, "ws://", "http://", 1), nil)
+		req.Host = endpoints[0].Hostname
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	t0 := time.Now()
+	drained := make(chan error, 1)
+	go func() { drained <- s.Drain() }()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("old connection not closed by drain timeout of client")
+	}
+	if d := time.Since(t0); d < 400*time.Millisecond {
+		t.Fatalf("old connection closed after %s, before drain timeout of client", d)
+	}
+	<-requested
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range events {
+		if e.Type == agent.Disconnected && e.Reason == agent.ReasonDrain {
+			return
+		}
+	}
+	t.Fatalf("no disconnected event of drain in %+v", events)
+}
@@ -1,24 +1,219 @@
 package agent
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/zryfish/kunnel/pkg/mux"
+	"github.com/zryfish/kunnel/pkg/transport"
+	"github.com/zryfish/kunnel/pkg/utils"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 type Config struct {
 	Name string
 
+	// Tunnel is name of tunnel shared by agents, which becomes subdomain of
+	// the tunnel. Server assigns a random subdomain if empty.
+	Tunnel string
+
+	// Token authenticates agent to server, never sent as part of config
+	Token string `json:"-"`
+
+	// CertFile and KeyFile are client certificate presented to server,
+	// CAFile verifies server certificate instead of system roots.
+	// Never sent as part of config.
+	CertFile string `json:"-"`
+	KeyFile  string `json:"-"`
+	CAFile   string `json:"-"`
+
+	// Proxy is url of http, https or socks5 proxy connecting to server,
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY are respected if empty
+	Proxy string `json:"-"`
+
+	// Transports are tried in order connecting to server, like quic,
+	// tcp, websocket, h2 and poll, websocket is tried after quic if not
+	// listed. transport.DefaultOrder if empty
+	Transports []string `json:"-"`
+
+	// Multiplexer multiplexes streams over connection to server, qmux
+	// or ssh. Negotiated with server if empty
+	Multiplexer string `json:"-"`
+
 	LocalPort int
 
 	LocalHost string
 
+	// Domain is base domain of tunnel, one of those served by server.
+	// Server chooses its default one if empty.
 	Domain string
 
+	// Hostnames are custom hostnames of tunnel, delegated to tunnel domain
+	// by a TXT record of _kunnel.<hostname> containing it. Server verifies
+	// the TXT record only, CNAME records just route traffic
+	Hostnames []string
+
 	Host string
 
 	Protocol string
 
+	// UpstreamTLS configures TLS to https upstreams, certificates are
+	// verified by system roots if nil
+	UpstreamTLS *UpstreamTLS
+
+	// AgentUpstreamTLS has agent negotiate TLS to https upstreams, server
+	// sends plain HTTP through tunnel, and UpstreamTLS is never sent to it
+	AgentUpstreamTLS bool
+
 	Hedaers map[string]string
+
+	// ProxyProtocol is version of HAProxy PROXY protocol header, v1 or v2,
+	// sent to upstream ahead of each connection. Disabled if empty.
+	ProxyProtocol string
+
+	Rules *Rules
+
+	// Routes forward matching requests to other targets than LocalHost:LocalPort
+	Routes []Route
+}
+
+func (c *Config) Validate() error {
+	if len(c.Tunnel) != 0 {
+		if errs := validation.IsDNS1123Label(c.Tunnel); len(errs) != 0 {
+			return fmt.Errorf("invalid tunnel name %s, %s", c.Tunnel, strings.Join(errs, ", "))
+		}
+	}
+
+	if len(c.Domain) != 0 {
+		if errs := validation.IsDNS1123Subdomain(c.Domain); len(errs) != 0 {
+			return fmt.Errorf("invalid domain %s, %s", c.Domain, strings.Join(errs, ", "))
+		}
+	}
+
+	if len(c.Hostnames) != 0 && len(c.Tunnel) == 0 {
+		return fmt.Errorf("custom hostnames require a named tunnel")
+	}
+	for _, hostname := range c.Hostnames {
+		if errs := validation.IsDNS1123Subdomain(hostname); len(errs) != 0 {
+			return fmt.Errorf("invalid hostname %s, %s", hostname, strings.Join(errs, ", "))
+		}
+	}
+
+	switch c.ProxyProtocol {
+	case "", utils.ProxyProtocolV1, utils.ProxyProtocolV2:
+	default:
+		return fmt.Errorf("invalid proxy protocol version %s, must be v1 or v2", c.ProxyProtocol)
+	}
+	if err := c.Rules.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.UpstreamTLS.Validate(); err != nil {
+		return err
+	}
+
+	for i := range c.Routes {
+		if err := c.Routes[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.TLSConfig(); err != nil {
+		return err
+	}
+
+	if err := transport.Validate(c.Transports); err != nil {
+		return err
+	}
+
+	if _, err := mux.Protocols(c.Multiplexer); err != nil {
+		return err
+	}
+
+	if len(c.Proxy) != 0 {
+		if _, err := ParseProxy(c.Proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns tls config dialing server, nil if neither client
+// certificate nor CA is set.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if len(c.CertFile) == 0 && len(c.KeyFile) == 0 && len(c.CAFile) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if len(c.CertFile) != 0 || len(c.KeyFile) != 0 {
+		if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+			return nil, fmt.Errorf("client certificate and key must be provided together")
+		}
+		cer, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate %s, %v", c.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cer}
+	}
+
+	if len(c.CAFile) != 0 {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca file %s, %v", c.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (c *Config) Address() string {
+	return net.JoinHostPort(c.LocalHost, strconv.Itoa(c.LocalPort))
+}
+
+// Targets returns addresses which server could ask agent to dial.
+func (c *Config) Targets() []string {
+	targets := []string{c.Address()}
+	for i := range c.Routes {
+		targets = append(targets, c.Routes[i].Address())
+	}
+	return targets
+}
+
+// TargetProtocol returns protocol of target, route protocol defaults to
+// tunnel protocol.
+func (c *Config) TargetProtocol(addr string) string {
+	for i := range c.Routes {
+		if addr == c.Routes[i].Address() && len(c.Routes[i].Protocol) != 0 {
+			return c.Routes[i].Protocol
+		}
+	}
+	return c.Protocol
+}
+
+// ServerName returns name verifying certificate of target, defaults to
+// host of target.
+func (c *Config) ServerName(addr string) string {
+	if addr == c.Address() && c.UpstreamTLS != nil && len(c.UpstreamTLS.ServerName) != 0 {
+		return c.UpstreamTLS.ServerName
+	}
+	for i := range c.Routes {
+		if addr == c.Routes[i].Address() && len(c.Routes[i].ServerName) != 0 {
+			return c.Routes[i].ServerName
+		}
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return host
 }
 
 func (c *Config) Unmarshal(b []byte) error {
@@ -29,5 +224,10 @@ func (c *Config) Unmarshal(b []byte) error {
 }
 
 func (c *Config) Marshal() ([]byte, error) {
+	if c.AgentUpstreamTLS {
+		config := *c
+		config.UpstreamTLS = nil
+		return json.Marshal(&config)
+	}
 	return json.Marshal(c)
 }
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/zryfish/kunnel/pkg/utils"
+)
+
+// listener hands streams of tunnel to program embedding client, instead
+// of client dialing targets, see Options.Listen.
+type listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	addr  net.Addr
+	log   logr.Logger
+}
+
+func newListener(addr net.Addr, log logr.Logger) *listener {
+	return &listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+		addr:  addr,
+		log:   log,
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting streams, those accepted are kept.
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// serve waits for stream to be accepted, closing it if listener is
+// closed meanwhile. PROXY protocol header ahead of stream becomes its
+// remote address, which is server otherwise.
+func (l *listener) serve(stream net.Conn, remote string, server net.Addr, proxyProtocol bool) {
+	conn := &tunnelConn{Conn: stream, local: addr(remote), remote: server}
+	if proxyProtocol {
+		reader := bufio.NewReader(stream)
+		from, _, err := utils.ReadProxyHeader(reader)
+		if err != nil {
+			l.log.Error(err, "Invalid proxy protocol header", "target", remote)
+			stream.Close()
+			return
+		}
+		conn.Conn = &bufferedStream{Conn: stream, reader: reader}
+		if from != nil {
+			conn.remote = from
+		}
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		stream.Close()
+	}
+}
+
+// tunnelConn is a stream of tunnel, its local address is target server
+// opened it to.
+type tunnelConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return c.local }
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+// addr is address of target of stream.
+type addr string
+
+func (a addr) Network() string { return "tcp" }
+func (a addr) String() string  { return string(a) }
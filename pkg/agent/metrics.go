@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rttBuckets are upper bounds in seconds of keepalive round trips counted.
+var rttBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// metrics of client, written in Prometheus text format since client has
+// no dependency on Prometheus libraries. Counters are updated atomically,
+// 64-bit ones first for alignment.
+type metrics struct {
+	reconnectAttempts uint64
+	reconnects        uint64
+	connectionErrors  uint64
+	keepAliveFailures uint64
+	streamsOpened     uint64
+	streamsFailed     uint64
+	// backoff is nanoseconds waited before reconnecting, 0 if not waiting
+	backoff int64
+
+	mu         sync.Mutex
+	rttCounts  []uint64
+	rttSum     float64
+	rttCount   uint64
+	dialErrors map[string]uint64
+	traffic    map[string]*traffic
+}
+
+// traffic is bytes of streams of a tunnel, sent to and received from
+// server by agent.
+type traffic struct {
+	sent     uint64
+	received uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rttCounts:  make([]uint64, len(rttBuckets)),
+		dialErrors: make(map[string]uint64),
+		traffic:    make(map[string]*traffic),
+	}
+}
+
+func (m *metrics) observeRTT(rtt time.Duration) {
+	seconds := rtt.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range rttBuckets {
+		if seconds <= bound {
+			m.rttCounts[i]++
+		}
+	}
+	m.rttSum += seconds
+	m.rttCount++
+}
+
+func (m *metrics) setBackoff(d time.Duration) {
+	atomic.StoreInt64(&m.backoff, int64(d))
+}
+
+func (m *metrics) dialFailed(target string) {
+	atomic.AddUint64(&m.streamsFailed, 1)
+	m.mu.Lock()
+	m.dialErrors[target]++
+	m.mu.Unlock()
+}
+
+// count returns stream counting bytes it carries as traffic of tunnel.
+func (m *metrics) count(stream net.Conn, tunnel string) net.Conn {
+	m.mu.Lock()
+	t, ok := m.traffic[tunnel]
+	if !ok {
+		t = &traffic{}
+		m.traffic[tunnel] = t
+	}
+	m.mu.Unlock()
+	return &countedConn{Conn: stream, traffic: t}
+}
+
+// write writes metrics, with connected being state of connection.
+func (m *metrics) write(w io.Writer, connected bool) {
+	gauge := 0
+	if connected {
+		gauge = 1
+	}
+	writeHeader(w, "kunnel_agent_connected", "gauge", "Whether agent is connected to server with tunnel joined.")
+	fmt.Fprintf(w, "kunnel_agent_connected %d\n", gauge)
+	writeHeader(w, "kunnel_agent_reconnect_attempts_total", "counter", "Attempts connecting to server after the first one.")
+	fmt.Fprintf(w, "kunnel_agent_reconnect_attempts_total %d\n", atomic.LoadUint64(&m.reconnectAttempts))
+	writeHeader(w, "kunnel_agent_reconnects_total", "counter", "Times agent joined tunnel again after the first time.")
+	fmt.Fprintf(w, "kunnel_agent_reconnects_total %d\n", atomic.LoadUint64(&m.reconnects))
+	writeHeader(w, "kunnel_agent_connection_errors_total", "counter", "Attempts failing and connections lost by errors.")
+	fmt.Fprintf(w, "kunnel_agent_connection_errors_total %d\n", atomic.LoadUint64(&m.connectionErrors))
+	writeHeader(w, "kunnel_agent_backoff_seconds", "gauge", "Backoff agent waits for before reconnecting, 0 if not waiting.")
+	fmt.Fprintf(w, "kunnel_agent_backoff_seconds %g\n", time.Duration(atomic.LoadInt64(&m.backoff)).Seconds())
+	writeHeader(w, "kunnel_agent_keepalive_failures_total", "counter", "Keepalive pings to server failing.")
+	fmt.Fprintf(w, "kunnel_agent_keepalive_failures_total %d\n", atomic.LoadUint64(&m.keepAliveFailures))
+	writeHeader(w, "kunnel_agent_streams_opened_total", "counter", "Streams opened by server and accepted by agent.")
+	fmt.Fprintf(w, "kunnel_agent_streams_opened_total %d\n", atomic.LoadUint64(&m.streamsOpened))
+	writeHeader(w, "kunnel_agent_streams_failed_total", "counter", "Streams agent rejected or failed to connect to targets.")
+	fmt.Fprintf(w, "kunnel_agent_streams_failed_total %d\n", atomic.LoadUint64(&m.streamsFailed))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "kunnel_agent_keepalive_rtt_seconds", "histogram", "Round trips of keepalive pings to server.")
+	for i, bound := range rttBuckets {
+		fmt.Fprintf(w, "kunnel_agent_keepalive_rtt_seconds_bucket{le=\"%g\"} %d\n", bound, m.rttCounts[i])
+	}
+	fmt.Fprintf(w, "kunnel_agent_keepalive_rtt_seconds_bucket{le=\"+Inf\"} %d\n", m.rttCount)
+	fmt.Fprintf(w, "kunnel_agent_keepalive_rtt_seconds_sum %g\n", m.rttSum)
+	fmt.Fprintf(w, "kunnel_agent_keepalive_rtt_seconds_count %d\n", m.rttCount)
+
+	writeHeader(w, "kunnel_agent_dial_errors_total", "counter", "Errors dialing targets of streams.")
+	for _, target := range sortedKeys(m.dialErrors) {
+		fmt.Fprintf(w, "kunnel_agent_dial_errors_total{target=\"%s\"} %d\n", escape(target), m.dialErrors[target])
+	}
+
+	tunnels := make([]string, 0, len(m.traffic))
+	for tunnel := range m.traffic {
+		tunnels = append(tunnels, tunnel)
+	}
+	sort.Strings(tunnels)
+	writeHeader(w, "kunnel_agent_sent_bytes_total", "counter", "Bytes of streams sent to server, by tunnel.")
+	for _, tunnel := range tunnels {
+		fmt.Fprintf(w, "kunnel_agent_sent_bytes_total{tunnel=\"%s\"} %d\n", escape(tunnel), atomic.LoadUint64(&m.traffic[tunnel].sent))
+	}
+	writeHeader(w, "kunnel_agent_received_bytes_total", "counter", "Bytes of streams received from server, by tunnel.")
+	for _, tunnel := range tunnels {
+		fmt.Fprintf(w, "kunnel_agent_received_bytes_total{tunnel=\"%s\"} %d\n", escape(tunnel), atomic.LoadUint64(&m.traffic[tunnel].received))
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countedConn counts bytes read from and written to stream of server.
+type countedConn struct {
+	net.Conn
+	traffic *traffic
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.traffic.received, uint64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.traffic.sent, uint64(n))
+	return n, err
+}
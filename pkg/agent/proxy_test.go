@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startEcho starts a target echoing what it reads back.
+func startEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// pipe copies between a and b until either is closed.
+func pipe(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(a, b)
+	io.Copy(b, a)
+}
+
+// startConnectProxy starts an HTTP proxy tunneling CONNECT requests,
+// requiring basic auth of user if not nil.
+func startConnectProxy(t *testing.T, user *url.Userinfo) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if user != nil {
+			password, _ := user.Password()
+			auth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+			if u, p, ok := auth.BasicAuth(); !ok || u != user.Username() || p != password {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, target)
+	})}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+// startSocks5Proxy starts a SOCKS5 proxy, requiring username and
+// password of user if not nil.
+func startSocks5Proxy(t *testing.T, user *url.Userinfo) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(conn, user)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveSocks5(conn net.Conn, user *url.Userinfo) {
+	r := bufio.NewReader(conn)
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, b[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		conn.Close()
+		return
+	}
+
+	if user == nil {
+		conn.Write([]byte{0x05, 0x00})
+	} else {
+		conn.Write([]byte{0x05, 0x02})
+		var fields []string
+		if _, err := r.ReadByte(); err != nil {
+			conn.Close()
+			return
+		}
+		for i := 0; i < 2; i++ {
+			n, err := r.ReadByte()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			field := make([]byte, n)
+			if _, err := io.ReadFull(r, field); err != nil {
+				conn.Close()
+				return
+			}
+			fields = append(fields, string(field))
+		}
+		password, _ := user.Password()
+		if fields[0] != user.Username() || fields[1] != password {
+			conn.Write([]byte{0x01, 0x01})
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		conn.Close()
+		return
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make([]byte, map[byte]int{0x01: net.IPv4len, 0x04: net.IPv6len}[req[3]])
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(r, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		conn.Close()
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	pipe(&bufferedConn{Conn: conn, reader: r}, target)
+}
+
+func TestDialProxy(t *testing.T) {
+	target := startEcho(t)
+	user := url.UserPassword("agent", "s3cr3t")
+
+	tests := []struct {
+		name    string
+		scheme  string
+		start   func(*testing.T, *url.Userinfo) string
+		auth    *url.Userinfo // required by proxy
+		user    *url.Userinfo // given to agent
+		refused bool
+	}{
+		{name: "connect", scheme: "http", start: startConnectProxy},
+		{name: "connect with auth", scheme: "http", start: startConnectProxy, auth: user, user: user},
+		{name: "connect with wrong auth", scheme: "http", start: startConnectProxy, auth: user, user: url.UserPassword("agent", "wrong"), refused: true},
+		{name: "connect without auth", scheme: "http", start: startConnectProxy, auth: user, refused: true},
+		{name: "socks5", scheme: "socks5", start: startSocks5Proxy},
+		{name: "socks5 with auth", scheme: "socks5", start: startSocks5Proxy, auth: user, user: user},
+		{name: "socks5 with wrong auth", scheme: "socks5", start: startSocks5Proxy, auth: user, user: url.UserPassword("agent", "wrong"), refused: true},
+		{name: "socks5 without auth", scheme: "socks5", start: startSocks5Proxy, auth: user, refused: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := &url.URL{Scheme: test.scheme, Host: test.start(t, test.auth), User: test.user}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := dialProxy(ctx, proxy, target)
+			if test.refused {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected proxy to refuse connection")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "ping" {
+				t.Fatalf("expected ping echoed, got %q", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Route forwards requests matching path prefix and headers to
+// a target other than tunnel's local address.
+type Route struct {
+	PathPrefix string
+
+	// Headers request must carry, all of them must match
+	Headers map[string]string
+
+	LocalHost string
+	LocalPort int
+
+	// Protocol of target, defaults to tunnel protocol
+	Protocol string
+
+	// ServerName verifies certificate of https target, defaults to its host
+	ServerName string
+
+	// Rules override tunnel rules for requests matching route
+	Rules *Rules
+}
+
+func (r *Route) Validate() error {
+	if !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("invalid route path prefix '%s', must start with /", r.PathPrefix)
+	}
+	if len(r.LocalHost) == 0 {
+		return fmt.Errorf("route %s has no target host", r.PathPrefix)
+	}
+	if r.LocalPort <= 0 || r.LocalPort > 65535 {
+		return fmt.Errorf("route %s has invalid target port %d", r.PathPrefix, r.LocalPort)
+	}
+	switch r.Protocol {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("route %s has unsupported protocol %s", r.PathPrefix, r.Protocol)
+	}
+	return r.Rules.Validate()
+}
+
+func (r *Route) Address() string {
+	return net.JoinHostPort(r.LocalHost, strconv.Itoa(r.LocalPort))
+}
+
+// ParseRoute parses route of format PREFIX=[SCHEME://]HOST[:PORT][;HEADER=VALUE...],
+// port is left zero if not provided.
+func ParseRoute(s string) (*Route, error) {
+	prefix, rest, err := ParseKeyValue(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route '%s', expecting format PREFIX=[SCHEME://]HOST[:PORT][;HEADER=VALUE...]", s)
+	}
+
+	parts := strings.Split(rest, ";")
+	route := &Route{PathPrefix: prefix}
+
+	target := parts[0]
+	if i := strings.Index(target, "://"); i >= 0 {
+		route.Protocol, target = target[:i], target[i+3:]
+	}
+
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		route.LocalHost = host
+		if route.LocalPort, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid route '%s', bad port %s", s, port)
+		}
+	} else {
+		route.LocalHost = target
+	}
+
+	for _, header := range parts[1:] {
+		key, val, err := ParseKeyValue(header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route '%s', %v", s, err)
+		}
+		if route.Headers == nil {
+			route.Headers = make(map[string]string)
+		}
+		route.Headers[key] = val
+	}
+	return route, nil
+}
+
+// String formats route as ParseRoute accepts.
+func (r *Route) String() string {
+	target := r.Address()
+	if len(r.Protocol) != 0 {
+		target = r.Protocol + "://" + target
+	}
+
+	s := r.PathPrefix + "=" + target
+	for k, v := range r.Headers {
+		s += ";" + k + "=" + v
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Rules rewrite requests before proxied to upstream and
+// responses before returned to client.
+type Rules struct {
+	RequestHeaders  HeaderRules
+	ResponseHeaders HeaderRules
+
+	// StripPrefix is removed from request path, then AddPrefix is prepended
+	StripPrefix string
+	AddPrefix   string
+
+	// PathRewrites are applied in order after prefixes handled
+	PathRewrites []PathRewrite
+
+	// RewriteRedirects rewrites Location headers and cookie domains
+	// pointing at upstream back to tunnel host
+	RewriteRedirects bool
+}
+
+type HeaderRules struct {
+	// Set replaces values of header
+	Set map[string]string
+	// Add appends values to header
+	Add map[string][]string
+	// Remove deletes header
+	Remove []string
+}
+
+type PathRewrite struct {
+	// Regexp matched against request path
+	Regexp string
+	// Replacement supports $1 style references to submatches
+	Replacement string
+}
+
+func (r *Rules) Validate() error {
+	if r == nil {
+		return nil
+	}
+
+	for _, prefix := range []string{r.StripPrefix, r.AddPrefix} {
+		if len(prefix) != 0 && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid path prefix %s, must start with /", prefix)
+		}
+	}
+
+	for _, rewrite := range r.PathRewrites {
+		if _, err := regexp.Compile(rewrite.Regexp); err != nil {
+			return fmt.Errorf("invalid path rewrite %s, %v", rewrite.Regexp, err)
+		}
+	}
+
+	for _, h := range []HeaderRules{r.RequestHeaders, r.ResponseHeaders} {
+		if err := h.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h HeaderRules) validate() error {
+	var names []string
+	for k := range h.Set {
+		names = append(names, k)
+	}
+	for k := range h.Add {
+		names = append(names, k)
+	}
+	names = append(names, h.Remove...)
+
+	for _, name := range names {
+		if len(name) == 0 || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid header name '%s'", name)
+		}
+		if strings.EqualFold(textproto.CanonicalMIMEHeaderKey(name), "Host") {
+			return fmt.Errorf("header Host can't be rewritten, use host override instead")
+		}
+	}
+	return nil
+}
+
+// ParseKeyValue parses s of format key=val, val could contain '='.
+func ParseKeyValue(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", "", fmt.Errorf("invalid format '%s', expecting key=val", s)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,64 @@
+package agent
+
+import "testing"
+
+func TestRulesValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules *Rules
+		valid bool
+	}{
+		{name: "none", valid: true},
+		{name: "prefixes", rules: &Rules{StripPrefix: "/api", AddPrefix: "/"}, valid: true},
+		{name: "relative prefix", rules: &Rules{StripPrefix: "api"}},
+		{name: "path rewrite", rules: &Rules{PathRewrites: []PathRewrite{{Regexp: `^/(\w+)$`, Replacement: "/$1/"}}}, valid: true},
+		{name: "invalid path rewrite", rules: &Rules{PathRewrites: []PathRewrite{{Regexp: `^/(\w+$`}}}},
+		{name: "headers", rules: &Rules{RequestHeaders: HeaderRules{Set: map[string]string{"X-Env": "prod"}, Remove: []string{"Cookie"}}}, valid: true},
+		{name: "empty header name", rules: &Rules{RequestHeaders: HeaderRules{Remove: []string{""}}}},
+		{name: "header name with colon", rules: &Rules{ResponseHeaders: HeaderRules{Add: map[string][]string{"X-Env:": {"prod"}}}}},
+		{name: "host header", rules: &Rules{RequestHeaders: HeaderRules{Set: map[string]string{"host": "example.com"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rules.Validate()
+			if test.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected rules invalid")
+			}
+		})
+	}
+}
+
+func TestParseKeyValue(t *testing.T) {
+	tests := []struct {
+		s     string
+		key   string
+		value string
+		valid bool
+	}{
+		{s: "X-Env=prod", key: "X-Env", value: "prod", valid: true},
+		{s: "Authorization=Basic YWdlbnQ6czNjcjN0==", key: "Authorization", value: "Basic YWdlbnQ6czNjcjN0==", valid: true},
+		{s: "X-Empty=", key: "X-Empty", valid: true},
+		{s: "=value"},
+		{s: "X-Env"},
+	}
+
+	for _, test := range tests {
+		key, value, err := ParseKeyValue(test.s)
+		if !test.valid {
+			if err == nil {
+				t.Fatalf("expected %s invalid", test.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != test.key || value != test.value {
+			t.Fatalf("expected %s parsed as %q and %q, got %q and %q", test.s, test.key, test.value, key, value)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/zryfish/kunnel/pkg/control"
+)
+
+// Status is state of client connection to server.
+type Status struct {
+	// Ready is set once client joins tunnel, until it disconnects
+	Ready     bool               `json:"ready"`
+	Server    string             `json:"server"`
+	Transport string             `json:"transport,omitempty"`
+	Endpoints []control.Endpoint `json:"endpoints,omitempty"`
+	// Latency is round trip of the last ping, or of handshake if none
+	Latency    string `json:"latency,omitempty"`
+	Reconnects int    `json:"reconnects"`
+}
+
+// Status returns state of client connection to server.
+func (c *Client) Status() *Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := &Status{
+		Ready:      c.sshConn != nil,
+		Server:     c.server,
+		Transport:  c.transport,
+		Endpoints:  c.endpoints,
+		Reconnects: c.reconnects,
+	}
+	if c.latency > 0 {
+		status.Latency = c.latency.String()
+	}
+	return status
+}
+
+func (c *Client) setLatency(latency time.Duration) {
+	c.mu.Lock()
+	c.latency = latency
+	c.mu.Unlock()
+}
+
+// serveStatus serves status endpoints at address until client is closed.
+func (c *Client) serveStatus(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(c.handleStatus)}
+	go func() {
+		<-c.ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			c.log.Error(err, "Status server stopped")
+		}
+	}()
+	return nil
+}
+
+// handleStatus serves /healthz, ok while client runs, /readyz, ok while
+// it's joined tunnel, /status and /metrics.
+func (c *Client) handleStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/healthz":
+		select {
+		case <-c.done:
+			http.Error(w, "client stopped", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("ok"))
+		}
+	case "/readyz":
+		if !c.Status().Ready {
+			http.Error(w, "not connected", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.metrics.write(w, c.conn() != nil)
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
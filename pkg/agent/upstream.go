@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// UpstreamTLS configures TLS to https upstreams, their certificates are
+// verified unless Insecure is set.
+type UpstreamTLS struct {
+	// CA is PEM encoded certificates verifying upstreams, system roots if empty
+	CA string
+
+	// ServerName verifies certificate of tunnel's local address, defaults to its host
+	ServerName string
+
+	// Certificate and Key are PEM encoded client certificate presented to upstreams
+	Certificate string
+	Key         string
+
+	// Insecure skips verifying upstream certificates
+	Insecure bool
+}
+
+func (u *UpstreamTLS) Validate() error {
+	_, err := u.TLSConfig()
+	return err
+}
+
+// TLSConfig returns tls config dialing upstreams, server name is left
+// for each target.
+func (u *UpstreamTLS) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if u == nil {
+		return config, nil
+	}
+
+	config.InsecureSkipVerify = u.Insecure
+	if len(u.CA) != 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM([]byte(u.CA)) {
+			return nil, fmt.Errorf("no certificates found in upstream ca")
+		}
+	}
+
+	if len(u.Certificate) != 0 || len(u.Key) != 0 {
+		cer, err := tls.X509KeyPair([]byte(u.Certificate), []byte(u.Key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream client certificate, %v", err)
+		}
+		config.Certificates = []tls.Certificate{cer}
+	}
+	return config, nil
+}
@@ -0,0 +1,183 @@
+// Package control defines messages agents and server exchange by requests
+// over multiplexed connections, versioned apart from multiplexers.
+//
+// Agent starts with a handshake request carrying Handshake, which server
+// replies with Response. Server then pushes Event by event requests.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is version of control protocol.
+const Version = 1
+
+const (
+	// HandshakeRequest is the first request of agent
+	HandshakeRequest = "handshake"
+	// EventRequest pushes event from server to agent
+	EventRequest = "event"
+	// PingRequest keeps connection alive
+	PingRequest = "ping"
+
+	// ConfigRequest is the first request of agents predating control
+	// protocol, replied with utils.Message
+	ConfigRequest = "config"
+	// DrainRequest asks agents predating control protocol to reconnect
+	DrainRequest = "drain"
+)
+
+// Capability is a feature agent or server supports.
+type Capability string
+
+const (
+	// Events is supported by agents handling events
+	Events Capability = "events"
+	// NamedTunnels are tunnels joined by name, by authenticated agents
+	NamedTunnels Capability = "named-tunnels"
+	// Hostnames are custom hostnames aliasing tunnels
+	Hostnames Capability = "hostnames"
+	// UpstreamTLS is TLS from server to targets, through agent or not
+	UpstreamTLS Capability = "upstream-tls"
+	// ProxyProtocol is PROXY protocol header passed to targets
+	ProxyProtocol Capability = "proxy-protocol"
+)
+
+// Handshake is what agent asks to join a tunnel by.
+type Handshake struct {
+	Version      int          `json:"version"`
+	Capabilities []Capability `json:"capabilities,omitempty"`
+	// Config is agent.Config of tunnel
+	Config json.RawMessage `json:"config"`
+}
+
+// Response is reply to handshake.
+type Response struct {
+	// Version is version of control protocol server speaks
+	Version      int          `json:"version"`
+	Error        *Error       `json:"error,omitempty"`
+	Capabilities []Capability `json:"capabilities,omitempty"`
+	// Endpoints are where tunnel is available
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+	// Warnings are issues not failing handshake
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Supports reports whether server supports capability.
+func (r *Response) Supports(capability Capability) bool {
+	return contains(r.Capabilities, capability)
+}
+
+// Supports reports whether agent supports capability.
+func (h *Handshake) Supports(capability Capability) bool {
+	return contains(h.Capabilities, capability)
+}
+
+func contains(capabilities []Capability, capability Capability) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoint is a public address of tunnel.
+type Endpoint struct {
+	Hostname string `json:"hostname"`
+	URL      string `json:"url"`
+	// Custom is set for custom hostnames of agent
+	Custom bool `json:"custom,omitempty"`
+}
+
+// EventType is type of event pushed by server.
+type EventType string
+
+const (
+	// Drain asks agent to reconnect, its connection keeps serving
+	// streams in flight until closed
+	Drain EventType = "drain"
+	// EndpointsChanged tells agent tunnel is available at endpoints
+	// of event instead
+	EndpointsChanged EventType = "endpoints"
+	// Warning is an issue found after handshake
+	Warning EventType = "warning"
+)
+
+// Event is pushed by server to agent.
+type Event struct {
+	Type      EventType  `json:"type"`
+	Message   string     `json:"message,omitempty"`
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+}
+
+// Code classifies errors of handshake.
+type Code string
+
+const (
+	// InvalidRequest is a malformed or unexpected request
+	InvalidRequest Code = "invalid_request"
+	// UnsupportedVersion is a version of control protocol server doesn't
+	// speak, Version of response is the one it does
+	UnsupportedVersion Code = "unsupported_version"
+	// InvalidConfig is a config failing validation
+	InvalidConfig Code = "invalid_config"
+	// Unauthorized is an agent not allowed to join tunnel
+	Unauthorized Code = "unauthorized"
+	// Conflict is a domain or hostname used by another tunnel
+	Conflict Code = "conflict"
+	// LimitExceeded is a limit of agents reached
+	LimitExceeded Code = "limit_exceeded"
+	// Unavailable is a server not accepting agents for now
+	Unavailable Code = "unavailable"
+	// Internal is anything else
+	Internal Code = "internal"
+)
+
+// Error is an error of handshake.
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// Errorf returns error of code.
+func Errorf(code Code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// AsError returns err as Error, of code if it isn't one.
+func AsError(err error, code Code) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
+
+// Err returns error of response, nil if handshake succeeded.
+func (r *Response) Err() error {
+	if r.Error == nil {
+		return nil
+	}
+	return r.Error
+}
+
+// Marshal encodes message, which never fails for messages of package.
+func Marshal(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// Unmarshal decodes message.
+func Unmarshal(b []byte, v interface{}) error {
+	if err := json.Unmarshal(b, v); err != nil {
+		return Errorf(InvalidRequest, "invalid message, %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package mux
+
+import (
+	"fmt"
+	"time"
+)
+
+// KeepAlive sends request to peer every interval until done is closed,
+// returning error once a request isn't replied within timeout, which caller
+// closes conn by. Replies rejecting request count, peers only have to
+// answer. Round trips of requests replied are passed to observe if not nil.
+func KeepAlive(conn Conn, request string, interval, timeout time.Duration, done <-chan struct{}, observe func(time.Duration)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+
+		t0 := time.Now()
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest(request, true, nil)
+			replied <- err
+		}()
+
+		timer := time.NewTimer(timeout)
+		select {
+		case err := <-replied:
+			timer.Stop()
+			if err != nil {
+				// conn is closed, Wait tells why
+				return nil
+			}
+			if observe != nil {
+				observe(time.Since(t0))
+			}
+		case <-timer.C:
+			return fmt.Errorf("no reply to %s in %s", request, timeout)
+		case <-done:
+			timer.Stop()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Package mux multiplexes streams and requests between agents and server
+// over one connection, by SSH channels or by lighter qmux channels which
+// skip SSH crypto already provided by TLS of transports. Over connections
+// carrying streams natively, like of QUIC, qmux uses their streams instead
+// of its own channels.
+package mux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/zryfish/kunnel/pkg/version"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	SSH  = "ssh"
+	Qmux = "qmux"
+)
+
+// Protocols returns protocol versions multiplexing by name, newest first.
+// Agents offer them to server, which picks one. Every version is offered
+// if name is empty.
+func Protocols(name string) ([]string, error) {
+	switch name {
+	case SSH:
+		return []string{version.ProtocolSSH}, nil
+	case Qmux:
+		return []string{version.ProtocolQmux}, nil
+	case "":
+		return version.Protocols, nil
+	}
+	return nil, fmt.Errorf("unknown multiplexer %s, must be one of %s, %s", name, Qmux, SSH)
+}
+
+// Conn is a multiplexed connection between agent and server.
+type Conn interface {
+	// User is name agent connects with
+	User() string
+
+	// Authenticated reports whether agent presented valid token, always
+	// false on agents
+	Authenticated() bool
+
+	RemoteAddr() net.Addr
+
+	// SendRequest sends request to peer, reply is waited for if wantReply
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+
+	// OpenStream opens stream to target of peer
+	OpenStream(target string) (net.Conn, error)
+
+	Close() error
+
+	// Wait blocks until connection is closed
+	Wait() error
+}
+
+// Request is a request from peer.
+type Request struct {
+	Type      string
+	WantReply bool
+	Payload   []byte
+	reply     func(ok bool, payload []byte) error
+}
+
+// Reply replies request if peer wants reply.
+func (r *Request) Reply(ok bool, payload []byte) error {
+	if !r.WantReply {
+		return nil
+	}
+	return r.reply(ok, payload)
+}
+
+// StreamConn is a connection carrying streams natively, like of QUIC,
+// which qmux multiplexes streams by instead of its own channels. Reads
+// and writes of connection are its first stream, opened by agent, which
+// carries control channel.
+type StreamConn interface {
+	net.Conn
+
+	// OpenStream opens a stream to peer
+	OpenStream(ctx context.Context) (io.ReadWriteCloser, error)
+
+	// AcceptStream waits for a stream peer opens
+	AcceptStream(ctx context.Context) (io.ReadWriteCloser, error)
+
+	// Wait blocks until connection is closed, returning io.EOF if it's
+	// closed normally
+	Wait() error
+}
+
+// NewStream is a stream peer asks to open.
+type NewStream interface {
+	Target() string
+	Accept() (net.Conn, error)
+	Reject(reason string) error
+}
+
+// ServerConfig configures server side of connections.
+type ServerConfig struct {
+	// Authenticate checks token of agent, returning whether agent is
+	// authenticated, or error to reject agent
+	Authenticate func(user string, remote net.Addr, token []byte) (bool, error)
+
+	// HostKey identifies server on SSH connections
+	HostKey ssh.Signer
+
+	// Timeout bounds handshake
+	Timeout time.Duration
+}
+
+// ClientConfig configures agent side of connections.
+type ClientConfig struct {
+	User  string
+	Token string
+
+	// Timeout bounds handshake
+	Timeout time.Duration
+}
+
+// NewServerConn handshakes with agent on conn by multiplexer of protocol.
+func NewServerConn(conn net.Conn, protocol string, config *ServerConfig) (Conn, <-chan NewStream, <-chan *Request, error) {
+	if err := native(conn, protocol); err != nil {
+		return nil, nil, nil, err
+	}
+	switch protocol {
+	case version.ProtocolSSH:
+		return newSSHServerConn(conn, protocol, config)
+	case version.ProtocolQmux:
+		return newQmuxServerConn(conn, config)
+	}
+	return nil, nil, nil, fmt.Errorf("unsupported protocol %s", protocol)
+}
+
+// NewClientConn handshakes with server on conn by multiplexer of protocol.
+func NewClientConn(conn net.Conn, protocol string, config *ClientConfig) (Conn, <-chan NewStream, <-chan *Request, error) {
+	if err := native(conn, protocol); err != nil {
+		return nil, nil, nil, err
+	}
+	switch protocol {
+	case version.ProtocolSSH:
+		return newSSHClientConn(conn, protocol, config)
+	case version.ProtocolQmux:
+		return newQmuxClientConn(conn, config)
+	}
+	return nil, nil, nil, fmt.Errorf("unsupported protocol %s", protocol)
+}
+
+// native checks connections carrying streams natively speak qmux, SSH
+// channels can't be carried by them.
+func native(conn net.Conn, protocol string) error {
+	if _, ok := conn.(StreamConn); ok && protocol == version.ProtocolSSH {
+		conn.Close()
+		return fmt.Errorf("protocol %s can't be spoken over native streams", protocol)
+	}
+	return nil
+}
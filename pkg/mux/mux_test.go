@@ -0,0 +1,237 @@
+package mux
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sinkTarget = "sink"
+	echoTarget = "echo"
+)
+
+// connect connects an agent to a server by multiplexer over loopback TCP,
+// returning server side of connection. Agent serves sink and echo targets.
+func connect(b *testing.B, name string) Conn {
+	protocols, err := Protocols(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	protocol := protocols[0]
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		agent, streams, reqs, err := NewClientConn(conn, protocol, &ClientConfig{User: "bench", Timeout: 10 * time.Second})
+		if err != nil {
+			return
+		}
+		go discard(reqs)
+		for ch := range streams {
+			stream, err := ch.Accept()
+			if err != nil {
+				continue
+			}
+			go serve(ch.Target(), stream)
+		}
+		agent.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, _, reqs, err := NewServerConn(conn, protocol, &ServerConfig{
+		Authenticate: func(string, net.Addr, []byte) (bool, error) { return true, nil },
+		HostKey:      signer,
+		Timeout:      10 * time.Second,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	go discard(reqs)
+	b.Cleanup(func() { server.Close() })
+	return server
+}
+
+func discard(reqs <-chan *Request) {
+	for req := range reqs {
+		req.Reply(false, nil)
+	}
+}
+
+// serve serves stream of agent, sink discards what's read, echo writes
+// it back.
+func serve(target string, stream net.Conn) {
+	defer stream.Close()
+	switch target {
+	case sinkTarget:
+		io.Copy(ioutil.Discard, stream)
+	case echoTarget:
+		io.Copy(stream, stream)
+	}
+}
+
+// benchmark runs f against a connection of each multiplexer.
+func benchmark(b *testing.B, f func(*testing.B, Conn)) {
+	for _, name := range []string{SSH, Qmux} {
+		b.Run(name, func(b *testing.B) {
+			f(b, connect(b, name))
+		})
+	}
+}
+
+// BenchmarkThroughput writes to sinks through streams in parallel.
+func BenchmarkThroughput(b *testing.B) {
+	benchmark(b, func(b *testing.B, server Conn) {
+		buf := make([]byte, 32*1024)
+		b.SetBytes(int64(len(buf)))
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			stream, err := server.OpenStream(sinkTarget)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			defer stream.Close()
+			for pb.Next() {
+				if _, err := stream.Write(buf); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkRoundTrip sends a byte back and forth through one stream.
+func BenchmarkRoundTrip(b *testing.B) {
+	benchmark(b, func(b *testing.B, server Conn) {
+		stream, err := server.OpenStream(echoTarget)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer stream.Close()
+
+		buf := []byte{1}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := stream.Write(buf); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.ReadFull(stream, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkOpenStream opens a stream and sends a byte back and forth
+// through it, like proxying a short request.
+func BenchmarkOpenStream(b *testing.B) {
+	benchmark(b, func(b *testing.B, server Conn) {
+		buf := []byte{1}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			stream, err := server.OpenStream(echoTarget)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := stream.Write(buf); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.ReadFull(stream, buf); err != nil {
+				b.Fatal(err)
+			}
+			stream.Close()
+		}
+	})
+}
+
+// TestRequestsNotRead closes connection whose requests nobody reads, like
+// of rejected agents, expecting requests dropped instead of left blocked.
+func TestRequestsNotRead(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{SSH, Qmux} {
+		t.Run(name, func(t *testing.T) {
+			protocols, _ := Protocols(name)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			go func() {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					return
+				}
+				agent, _, reqs, err := NewClientConn(conn, protocols[0], &ClientConfig{User: "test", Timeout: 10 * time.Second})
+				if err != nil {
+					return
+				}
+				defer agent.Close()
+				go discard(reqs)
+				for i := 0; i < 3; i++ {
+					agent.SendRequest("test", false, nil)
+				}
+				agent.Wait()
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, _, reqs, err := NewServerConn(conn, protocols[0], &ServerConfig{
+				Authenticate: func(string, net.Addr, []byte) (bool, error) { return false, nil },
+				HostKey:      signer,
+				Timeout:      10 * time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// requests sent meanwhile are waiting
+			time.Sleep(100 * time.Millisecond)
+			server.Close()
+			server.Wait()
+			time.Sleep(100 * time.Millisecond)
+
+			if _, ok := <-reqs; ok {
+				t.Fatal("request still waiting after connection closed")
+			}
+		})
+	}
+}
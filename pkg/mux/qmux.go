@@ -0,0 +1,447 @@
+package mux
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/progrium/qmux/golang/session"
+)
+
+// maxFrameSize bounds frames of control channel
+const maxFrameSize = 1 << 20
+
+// qmuxConn multiplexes by qmux channels, or by native streams of
+// connections carrying them. The first channel, opened by agent, carries
+// hello and requests in frames of JSON, every other channel is a stream
+// starting with its target.
+type qmuxConn struct {
+	conn          net.Conn
+	session       channels
+	control       io.ReadWriteCloser
+	user          string
+	authenticated bool
+	requests      chan *Request
+	streams       chan NewStream
+
+	// writeMu serializes frames written to control channel
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan *frame
+	closed  bool
+	done    chan struct{}
+	// gone is closed once session is closed, requests and streams nobody
+	// reads meanwhile are dropped
+	gone chan struct{}
+}
+
+// frame is a request, or a reply to request of same id.
+type frame struct {
+	ID        uint32 `json:"id,omitempty"`
+	Type      string `json:"type,omitempty"`
+	WantReply bool   `json:"wantReply,omitempty"`
+	Reply     bool   `json:"reply,omitempty"`
+	OK        bool   `json:"ok,omitempty"`
+	Payload   []byte `json:"payload,omitempty"`
+}
+
+// hello is the first request of agent, replied before anything else.
+type hello struct {
+	User  string `json:"user"`
+	Token string `json:"token"`
+}
+
+// channels are what qmuxConn multiplexes by, a qmux session or native
+// streams.
+type channels interface {
+	Open(ctx context.Context) (io.ReadWriteCloser, error)
+	Accept() (io.ReadWriteCloser, error)
+	Close() error
+	Wait() error
+}
+
+type qmuxSession struct {
+	*session.Session
+}
+
+func (s qmuxSession) Open(ctx context.Context) (io.ReadWriteCloser, error) {
+	return s.Session.Open(ctx)
+}
+
+func (s qmuxSession) Accept() (io.ReadWriteCloser, error) {
+	return s.Session.Accept()
+}
+
+// nativeStreams are streams of a connection carrying them, whose control
+// channel is connection itself.
+type nativeStreams struct {
+	StreamConn
+}
+
+func (s nativeStreams) Open(ctx context.Context) (io.ReadWriteCloser, error) {
+	return s.OpenStream(ctx)
+}
+
+func (s nativeStreams) Accept() (io.ReadWriteCloser, error) {
+	return s.AcceptStream(context.Background())
+}
+
+// newChannels returns native streams of conn carrying them, or a qmux
+// session over conn.
+func newChannels(conn net.Conn) channels {
+	if native, ok := conn.(StreamConn); ok {
+		return nativeStreams{native}
+	}
+	return qmuxSession{session.New(newFullConn(conn))}
+}
+
+func newQmuxConn(conn net.Conn, s channels, control io.ReadWriteCloser) *qmuxConn {
+	return &qmuxConn{
+		conn:     conn,
+		session:  s,
+		control:  control,
+		requests: make(chan *Request),
+		streams:  make(chan NewStream),
+		pending:  make(map[uint32]chan *frame),
+		done:     make(chan struct{}),
+		gone:     make(chan struct{}),
+	}
+}
+
+func newQmuxServerConn(conn net.Conn, config *ServerConfig) (Conn, <-chan NewStream, <-chan *Request, error) {
+	s := newChannels(conn)
+	if config.Timeout > 0 {
+		timer := time.AfterFunc(config.Timeout, func() { s.Close() })
+		defer timer.Stop()
+	}
+
+	var control io.ReadWriteCloser = conn
+	if _, ok := s.(qmuxSession); ok {
+		var err error
+		control, err = s.Accept()
+		if err != nil {
+			s.Close()
+			return nil, nil, nil, fmt.Errorf("qmux: no control channel, %v", err)
+		}
+	}
+
+	f, err := readFrame(control)
+	if err != nil || f.Type != "hello" {
+		s.Close()
+		return nil, nil, nil, fmt.Errorf("qmux: expecting hello, %v", err)
+	}
+	h := &hello{}
+	if err := json.Unmarshal(f.Payload, h); err != nil {
+		s.Close()
+		return nil, nil, nil, fmt.Errorf("qmux: invalid hello, %v", err)
+	}
+
+	c := newQmuxConn(conn, s, control)
+	c.user = h.User
+	c.authenticated, err = config.Authenticate(h.User, conn.RemoteAddr(), []byte(h.Token))
+	if err != nil {
+		c.writeFrame(&frame{ID: f.ID, Reply: true, Payload: []byte(err.Error())})
+		s.Close()
+		return nil, nil, nil, err
+	}
+	if err := c.writeFrame(&frame{ID: f.ID, Reply: true, OK: true}); err != nil {
+		s.Close()
+		return nil, nil, nil, err
+	}
+
+	c.start()
+	return c, c.streams, c.requests, nil
+}
+
+func newQmuxClientConn(conn net.Conn, config *ClientConfig) (Conn, <-chan NewStream, <-chan *Request, error) {
+	s := newChannels(conn)
+	ctx := context.Background()
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+		timer := time.AfterFunc(config.Timeout, func() { s.Close() })
+		defer timer.Stop()
+	}
+
+	var control io.ReadWriteCloser = conn
+	if _, ok := s.(qmuxSession); ok {
+		var err error
+		control, err = s.Open(ctx)
+		if err != nil {
+			s.Close()
+			return nil, nil, nil, err
+		}
+	}
+
+	c := newQmuxConn(conn, s, control)
+	c.user = config.User
+	payload, _ := json.Marshal(&hello{User: config.User, Token: config.Token})
+	if err := c.writeFrame(&frame{Type: "hello", WantReply: true, Payload: payload}); err != nil {
+		s.Close()
+		return nil, nil, nil, err
+	}
+
+	f, err := readFrame(control)
+	if err != nil {
+		s.Close()
+		return nil, nil, nil, err
+	}
+	if !f.OK {
+		s.Close()
+		return nil, nil, nil, fmt.Errorf("qmux: unable to authenticate, %s", f.Payload)
+	}
+
+	c.start()
+	return c, c.streams, c.requests, nil
+}
+
+func (c *qmuxConn) start() {
+	go func() {
+		c.session.Wait()
+		close(c.gone)
+	}()
+	go c.readRequests()
+	go c.acceptStreams()
+}
+
+func (c *qmuxConn) User() string {
+	return c.user
+}
+
+func (c *qmuxConn) Authenticated() bool {
+	return c.authenticated
+}
+
+func (c *qmuxConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *qmuxConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	if !wantReply {
+		return false, nil, c.writeFrame(&frame{Type: name, Payload: payload})
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false, nil, io.EOF
+	}
+	c.nextID++
+	id := c.nextID
+	reply := make(chan *frame, 1)
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	if err := c.writeFrame(&frame{ID: id, Type: name, WantReply: true, Payload: payload}); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return false, nil, err
+	}
+
+	select {
+	case f := <-reply:
+		return f.OK, f.Payload, nil
+	case <-c.done:
+		return false, nil, io.EOF
+	}
+}
+
+func (c *qmuxConn) OpenStream(target string) (net.Conn, error) {
+	ch, err := c.session.Open(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 2+len(target))
+	binary.BigEndian.PutUint16(header, uint16(len(target)))
+	copy(header[2:], target)
+	if _, err := ch.Write(header); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return newStream(ch, target), nil
+}
+
+func (c *qmuxConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.session.Close()
+}
+
+func (c *qmuxConn) Wait() error {
+	err := c.session.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// readRequests serves control channel until it's closed, which closes
+// connection.
+func (c *qmuxConn) readRequests() {
+	defer func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		close(c.done)
+		close(c.requests)
+		c.session.Close()
+	}()
+
+	for {
+		f, err := readFrame(c.control)
+		if err != nil {
+			return
+		}
+
+		if f.Reply {
+			c.mu.Lock()
+			reply, ok := c.pending[f.ID]
+			delete(c.pending, f.ID)
+			c.mu.Unlock()
+			if ok {
+				reply <- f
+			}
+			continue
+		}
+
+		id := f.ID
+		req := &Request{
+			Type:      f.Type,
+			WantReply: f.WantReply,
+			Payload:   f.Payload,
+			reply: func(ok bool, payload []byte) error {
+				return c.writeFrame(&frame{ID: id, Reply: true, OK: ok, Payload: payload})
+			},
+		}
+		select {
+		case c.requests <- req:
+		case <-c.gone:
+			return
+		}
+	}
+}
+
+// acceptStreams reads targets of streams peer opens, each in its own
+// goroutine so a slow peer doesn't hold others.
+func (c *qmuxConn) acceptStreams() {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		close(c.streams)
+	}()
+
+	for {
+		ch, err := c.session.Accept()
+		if err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var length [2]byte
+			if _, err := io.ReadFull(ch, length[:]); err != nil {
+				ch.Close()
+				return
+			}
+			target := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(ch, target); err != nil {
+				ch.Close()
+				return
+			}
+			select {
+			case c.streams <- &qmuxNewStream{ch: ch, target: string(target)}:
+			case <-c.gone:
+				ch.Close()
+			}
+		}()
+	}
+}
+
+func (c *qmuxConn) writeFrame(f *frame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxFrameSize {
+		return errors.New("qmux: frame too large")
+	}
+
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.control.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxFrameSize {
+		return nil, errors.New("qmux: frame too large")
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	f := &frame{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("qmux: invalid frame, %v", err)
+	}
+	return f, nil
+}
+
+// fullConn fills buffers on every read, which qmux decoder expects
+// though only transports of messages, like WebSocket, do so.
+type fullConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newFullConn(conn net.Conn) *fullConn {
+	return &fullConn{Conn: conn, reader: bufio.NewReaderSize(conn, 64*1024)}
+}
+
+func (c *fullConn) Read(b []byte) (int, error) {
+	return io.ReadFull(c.reader, b)
+}
+
+type qmuxNewStream struct {
+	ch     io.ReadWriteCloser
+	target string
+}
+
+func (s *qmuxNewStream) Target() string {
+	return s.target
+}
+
+func (s *qmuxNewStream) Accept() (net.Conn, error) {
+	return newStream(s.ch, s.target), nil
+}
+
+// Reject closes stream, which peer sees as closed without data.
+func (s *qmuxNewStream) Reject(reason string) error {
+	return s.ch.Close()
+}
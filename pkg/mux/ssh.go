@@ -0,0 +1,139 @@
+package mux
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConn multiplexes by SSH channels, targets of streams are passed as
+// extra data of channels.
+type sshConn struct {
+	ssh.Conn
+	authenticated bool
+}
+
+func newSSHServerConn(conn net.Conn, protocol string, config *ServerConfig) (Conn, <-chan NewStream, <-chan *Request, error) {
+	sshConfig := &ssh.ServerConfig{
+		ServerVersion: "SSH-" + protocol + "-server",
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			authenticated, err := config.Authenticate(c.User(), c.RemoteAddr(), password)
+			if err != nil || !authenticated {
+				return nil, err
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"authenticated": "true"}}, nil
+		},
+	}
+	sshConfig.AddHostKey(config.HostKey)
+
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	authenticated := c.Permissions != nil && c.Permissions.Extensions["authenticated"] == "true"
+	done := sshDone(c)
+	return &sshConn{Conn: c, authenticated: authenticated}, sshStreams(chans, done), sshRequests(reqs, done), nil
+}
+
+func newSSHClientConn(conn net.Conn, protocol string, config *ClientConfig) (Conn, <-chan NewStream, <-chan *Request, error) {
+	sshConfig := &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            []ssh.AuthMethod{ssh.Password(config.Token)},
+		ClientVersion:   "SSH-" + protocol + "-client",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         config.Timeout,
+	}
+
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, "", sshConfig)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	done := sshDone(c)
+	return &sshConn{Conn: c}, sshStreams(chans, done), sshRequests(reqs, done), nil
+}
+
+func (c *sshConn) Authenticated() bool {
+	return c.authenticated
+}
+
+func (c *sshConn) OpenStream(target string) (net.Conn, error) {
+	ch, reqs, err := c.OpenChannel("kunnel", []byte(target))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return newStream(ch, target), nil
+}
+
+// sshDone returns channel closed once c is closed.
+func sshDone(c ssh.Conn) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// sshRequests forwards requests until connection is done, those nobody
+// reads meanwhile are dropped, so rejected agents don't leave it blocked.
+func sshRequests(in <-chan *ssh.Request, done <-chan struct{}) <-chan *Request {
+	out := make(chan *Request)
+	go func() {
+		defer close(out)
+		for req := range in {
+			select {
+			case out <- &Request{Type: req.Type, WantReply: req.WantReply, Payload: req.Payload, reply: req.Reply}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func sshStreams(in <-chan ssh.NewChannel, done <-chan struct{}) <-chan NewStream {
+	out := make(chan NewStream)
+	go func() {
+		defer close(out)
+		for ch := range in {
+			select {
+			case out <- &sshNewStream{ch}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+type sshNewStream struct {
+	ch ssh.NewChannel
+}
+
+func (s *sshNewStream) Target() string {
+	return string(s.ch.ExtraData())
+}
+
+func (s *sshNewStream) Accept() (net.Conn, error) {
+	ch, reqs, err := s.ch.Accept()
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return newStream(ch, s.Target()), nil
+}
+
+func (s *sshNewStream) Reject(reason string) error {
+	return s.ch.Reject(ssh.Prohibited, reason)
+}
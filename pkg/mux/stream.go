@@ -0,0 +1,231 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readSize is size of chunks read from channels ahead of Read.
+const readSize = 32 * 1024
+
+// stream is a multiplexed stream to target. Channels of multiplexers have
+// no deadlines, so once read deadline is set, stream reads them ahead by a
+// goroutine of its own, which Read waits for until deadline. Writes are
+// done by goroutines while write deadline is set, closing stream once it's
+// exceeded since what's written can't be taken back.
+type stream struct {
+	ch     io.ReadWriteCloser
+	target string
+
+	// readAhead is set once read deadline is set, accessed atomically
+	readAhead int32
+	readOnce  sync.Once
+	reads     chan chunk
+	// readMu guards what's read but not returned yet
+	readMu  sync.Mutex
+	pending []byte
+	readErr error
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// chunk is what's read from channel.
+type chunk struct {
+	b   []byte
+	err error
+}
+
+func newStream(ch io.ReadWriteCloser, target string) *stream {
+	return &stream{
+		ch:            ch,
+		target:        target,
+		reads:         make(chan chunk),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	if len(s.pending) == 0 && s.readErr == nil {
+		if atomic.LoadInt32(&s.readAhead) == 0 {
+			// streams never given deadlines are read directly
+			return s.ch.Read(b)
+		}
+		s.readOnce.Do(func() { go s.readLoop() })
+		select {
+		case c := <-s.reads:
+			s.pending, s.readErr = c.b, c.err
+		case <-s.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-s.closed:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	if len(s.pending) == 0 && s.readErr != nil {
+		return n, s.readErr
+	}
+	return n, nil
+}
+
+// readLoop reads channel ahead of Read, until it fails or stream is
+// closed.
+func (s *stream) readLoop() {
+	for {
+		b := make([]byte, readSize)
+		n, err := s.ch.Read(b)
+		select {
+		case s.reads <- chunk{b[:n], err}:
+		case <-s.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	select {
+	case <-s.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	if !s.writeDeadline.isSet() {
+		return s.ch.Write(b)
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	// b is copied, it's still written once write times out
+	b = append([]byte(nil), b...)
+	written := make(chan result, 1)
+	go func() {
+		n, err := s.ch.Write(b)
+		written <- result{n, err}
+	}()
+	select {
+	case r := <-written:
+		return r.n, r.err
+	case <-s.writeDeadline.wait():
+		s.Close()
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *stream) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.ch.Close()
+}
+
+func (s *stream) LocalAddr() net.Addr  { return addr("") }
+func (s *stream) RemoteAddr() net.Addr { return addr(s.target) }
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets deadline of reads, a read in progress before any
+// deadline is set isn't affected.
+func (s *stream) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt32(&s.readAhead, 1)
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets deadline of writes, a write in progress without
+// deadline isn't affected.
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is closed once exceeded, like those of net.Pipe.
+type deadline struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	deadline time.Time
+	// exceeded is closed once deadline is exceeded
+	exceeded chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{exceeded: make(chan struct{})}
+}
+
+// set sets deadline, zero time clears it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// timer fired, wait for it to close channel
+		<-d.exceeded
+	}
+	d.timer = nil
+	d.deadline = t
+
+	closed := isClosed(d.exceeded)
+	if t.IsZero() {
+		if closed {
+			d.exceeded = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.exceeded = make(chan struct{})
+		}
+		exceeded := d.exceeded
+		d.timer = time.AfterFunc(dur, func() { close(exceeded) })
+		return
+	}
+
+	if !closed {
+		close(d.exceeded)
+	}
+}
+
+func (d *deadline) isSet() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.deadline.IsZero()
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.exceeded
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+type addr string
+
+func (a addr) Network() string { return "tcp" }
+func (a addr) String() string  { return string(a) }
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zryfish/kunnel/pkg/utils"
+	"k8s.io/klog"
+)
+
+const (
+	AccessLogFormatJSON     = "json"
+	AccessLogFormatCombined = "combined"
+)
+
+type AccessLogOptions struct {
+	// Path of access log file, "-" or "stdout" writes to stdout,
+	// empty disables access log.
+	Path       string
+	Format     string
+	MaxSize    int // megabytes
+	MaxBackups int
+}
+
+type AccessLogEntry struct {
+	Time            time.Time     `json:"time"`
+	Domain          string        `json:"domain"`
+	Agent           string        `json:"agent,omitempty"`
+	ClientIP        string        `json:"client_ip"`
+	Method          string        `json:"method"`
+	Path            string        `json:"path"`
+	Protocol        string        `json:"protocol"`
+	Status          int           `json:"status"`
+	Bytes           int64         `json:"bytes"`
+	Duration        time.Duration `json:"-"`
+	UpstreamLatency time.Duration `json:"-"`
+	Referer         string        `json:"referer,omitempty"`
+	UserAgent       string        `json:"user_agent,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+type AccessLogger struct {
+	format string
+	out    io.Writer
+	mu     sync.Mutex
+
+	// requests still logging, out is closed after the last one
+	// if logger closed before they finished
+	refs    int
+	closing bool
+}
+
+type accessLogKey struct{}
+
+func NewAccessLogger(options *AccessLogOptions) (*AccessLogger, error) {
+	if options == nil || len(options.Path) == 0 {
+		return nil, nil
+	}
+
+	logger := &AccessLogger{format: options.Format}
+	switch logger.format {
+	case "":
+		logger.format = AccessLogFormatCombined
+	case AccessLogFormatJSON, AccessLogFormatCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format %s", options.Format)
+	}
+
+	if options.Path == "-" || options.Path == "stdout" {
+		logger.out = os.Stdout
+		return logger, nil
+	}
+
+	file, err := utils.NewRotatingFile(options.Path, int64(options.MaxSize)*1024*1024, options.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("error opening access log file %s, %v", options.Path, err)
+	}
+	logger.out = file
+	return logger, nil
+}
+
+func (l *AccessLogger) Log(e *AccessLogEntry) {
+	var line []byte
+	if l.format == AccessLogFormatJSON {
+		b, err := json.Marshal(struct {
+			*AccessLogEntry
+			Duration        float64 `json:"duration"`
+			UpstreamLatency float64 `json:"upstream_latency"`
+		}{e, e.Duration.Seconds(), e.UpstreamLatency.Seconds()})
+		if err != nil {
+			klog.Errorf("Failed to marshal access log entry, %v", err)
+			return
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(combinedLogLine(e))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		klog.Errorf("Failed to write access log, %v", err)
+	}
+}
+
+// acquire keeps logger open until release is called, returns false
+// if logger is already closed.
+func (l *AccessLogger) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return false
+	}
+	l.refs++
+	return true
+}
+
+func (l *AccessLogger) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refs--
+	if l.closing && l.refs == 0 {
+		l.closeOut()
+	}
+}
+
+// Close closes logger after requests acquired it are logged.
+func (l *AccessLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return nil
+	}
+	l.closing = true
+	if l.refs > 0 {
+		return nil
+	}
+	return l.closeOut()
+}
+
+func (l *AccessLogger) closeOut() error {
+	if c, ok := l.out.(io.Closer); ok && l.out != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// combinedLogLine formats entry in Combined Log Format, followed by
+// tunnel domain, agent, upstream latency in seconds and upstream error.
+func combinedLogLine(e *AccessLogEntry) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = fmt.Sprintf("%d", e.Bytes)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" \"%s\" \"%s\" %.3f \"%s\"\n",
+		e.ClientIP,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, escapeQuotes(e.Path), e.Protocol,
+		e.Status, bytes,
+		orDash(escapeQuotes(e.Referer)), orDash(escapeQuotes(e.UserAgent)),
+		e.Domain, orDash(e.Agent), e.UpstreamLatency.Seconds(), orDash(escapeQuotes(e.Error)))
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func escapeQuotes(s string) string {
+	return strings.ReplaceAll(s, "\"", "\\\"")
+}
+
+func newAccessLogEntry(req *http.Request) *AccessLogEntry {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	return &AccessLogEntry{
+		Time:      time.Now(),
+		Domain:    req.Host,
+		ClientIP:  clientIP,
+		Method:    req.Method,
+		Path:      req.URL.RequestURI(),
+		Protocol:  req.Proto,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+}
+
+func withAccessLogEntry(req *http.Request, e *AccessLogEntry) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), accessLogKey{}, e))
+}
+
+func accessLogEntryFrom(ctx context.Context) *AccessLogEntry {
+	e, _ := ctx.Value(accessLogKey{}).(*AccessLogEntry)
+	return e
+}
+
+// responseRecorder records status code and bytes written to
+// a response, including those written to hijacked connections, which
+// copying goroutines may still write to once handler returns.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	// bytes is accessed atomically
+	bytes int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	atomic.AddInt64(&r.bytes, int64(n))
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer %T does not support hijacking", r.ResponseWriter)
+	}
+
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return &countingConn{Conn: conn, written: &r.bytes}, rw, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
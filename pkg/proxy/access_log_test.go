@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestEntry() *AccessLogEntry {
+	return &AccessLogEntry{
+		Time:            time.Date(2021, time.August, 1, 10, 20, 30, 0, time.UTC),
+		Domain:          "web.kunnel.test",
+		Agent:           "web",
+		ClientIP:        "203.0.113.7",
+		Method:          "GET",
+		Path:            `/search?q="kunnel"`,
+		Protocol:        "HTTP/1.1",
+		Status:          200,
+		Bytes:           512,
+		Duration:        250 * time.Millisecond,
+		UpstreamLatency: 200 * time.Millisecond,
+		UserAgent:       "curl/7.68.0",
+	}
+}
+
+// logEntries logs entries by logger of options, returning what's written.
+func logEntries(t *testing.T, options *AccessLogOptions, entries ...*AccessLogEntry) string {
+	options.Path = filepath.Join(t.TempDir(), "access.log")
+	logger, err := NewAccessLogger(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		logger.Log(e)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(options.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	line := logEntries(t, &AccessLogOptions{Format: AccessLogFormatCombined}, newTestEntry())
+	expected := `203.0.113.7 - - [01/Aug/2021:10:20:30 +0000] "GET /search?q=\"kunnel\" HTTP/1.1" 200 512 "-" "curl/7.68.0" "web.kunnel.test" "web" 0.200 "-"` + "\n"
+	if line != expected {
+		t.Fatalf("expected %s, got %s", expected, line)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	e := newTestEntry()
+	e.Status = 502
+	e.Error = "agent gone"
+	line := logEntries(t, &AccessLogOptions{Format: AccessLogFormatJSON}, e)
+
+	logged := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &logged); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]interface{}{
+		"time":             "2021-08-01T10:20:30Z",
+		"domain":           "web.kunnel.test",
+		"agent":            "web",
+		"client_ip":        "203.0.113.7",
+		"method":           "GET",
+		"path":             `/search?q="kunnel"`,
+		"status":           float64(502),
+		"bytes":            float64(512),
+		"duration":         0.25,
+		"upstream_latency": 0.2,
+		"error":            "agent gone",
+	} {
+		if logged[key] != expected {
+			t.Fatalf("expected %s %v, got %v", key, expected, logged[key])
+		}
+	}
+	if _, ok := logged["referer"]; ok {
+		t.Fatal("expected empty referer omitted")
+	}
+}
+
+func TestAccessLogRotates(t *testing.T) {
+	e := newTestEntry()
+	e.Path = "/" + strings.Repeat("a", 300*1024)
+	options := &AccessLogOptions{Format: AccessLogFormatCombined, MaxSize: 1, MaxBackups: 1}
+	logEntries(t, options, e, e, e, e, e)
+
+	// 3 entries fit in 1 megabyte
+	for path, entries := range map[string]int{options.Path: 2, options.Path + ".1": 3} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(b), "\n"); n != entries {
+			t.Fatalf("expected %d entries in %s, got %d", entries, path, n)
+		}
+	}
+	if _, err := os.Stat(options.Path + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("expected 1 backup kept, %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+)
+
+const (
+	clusterTokenHeader     = "X-Kunnel-Cluster-Token"
+	clusterForwardedHeader = "X-Kunnel-Forwarded-By"
+	clusterSessionsPath    = "/sessions/"
+
+	// ownersTTL is how long owners of domains looked up are cached,
+	// misses included
+	ownersTTL = 5 * time.Second
+	// maxLookups bounds lookups in flight, requests for other domains
+	// aren't forwarded meanwhile, so unknown hosts can't flood peers
+	maxLookups = 16
+	// maxCachedOwners bounds domains cached
+	maxCachedOwners = 10000
+)
+
+var errTooManyLookups = errors.New("too many lookups in flight")
+
+type ClusterOptions struct {
+	// Listen is address of listener peers connect to
+	Listen string
+	// Address is url peers reach this replica at, like https://10.0.0.5:7946
+	Address string
+	// Token authenticates replicas to each other
+	Token string
+	// CertFile and KeyFile are certificate replicas serve cluster listener
+	// with and present to each other, verified by CAFile
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// Identity of replica, defaults to hostname
+	Identity string
+
+	// Store is type of session store, peers, raft or kubernetes
+	Store string
+	// Peers are addresses of all replicas when store is peers or raft
+	Peers []string
+	// RaftDir keeps raft log and snapshots when store is raft
+	RaftDir string
+
+	// Namespace of leases when store is kubernetes
+	Namespace     string
+	KubeConfig    string
+	LeaseDuration time.Duration
+}
+
+// Cluster forwards requests for tunnels whose agents are connected
+// to other replicas.
+type Cluster struct {
+	options    *ClusterOptions
+	store      SessionStore
+	httpServer *HttpServer
+	tlsConfig  *tls.Config
+	proxy      *httputil.ReverseProxy
+
+	mu      sync.Mutex
+	owners  map[string]cachedOwners
+	lookups map[string]*lookupCall
+}
+
+type cachedOwners struct {
+	owners  []string
+	expires time.Time
+}
+
+// lookupCall is a lookup of owners in flight, shared by requests for the
+// same domain.
+type lookupCall struct {
+	done   chan struct{}
+	owners []string
+	err    error
+}
+
+type clusterOwnerKey struct{}
+
+// clusterPollKey marks requests of poll sessions forwarded to replicas
+// opened them, served by peers as agent requests instead of tunnels.
+type clusterPollKey struct{}
+
+func NewCluster(options *ClusterOptions) (*Cluster, error) {
+	if len(options.Address) == 0 {
+		return nil, errors.New("cluster address must be provided")
+	}
+	if len(options.Token) == 0 {
+		return nil, errors.New("cluster token must be provided")
+	}
+
+	serverTLS, clientTLS, err := clusterTLS(options)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = clientTLS
+
+	c := &Cluster{
+		options:    options,
+		httpServer: NewHttpServer(),
+		tlsConfig:  serverTLS,
+		owners:     make(map[string]cachedOwners),
+		lookups:    make(map[string]*lookupCall),
+	}
+
+	switch options.Store {
+	case StorePeers, "":
+		var peers []string
+		for _, peer := range options.Peers {
+			if strings.TrimSuffix(peer, "/") != strings.TrimSuffix(options.Address, "/") {
+				peers = append(peers, peer)
+			}
+		}
+		c.store = NewPeersStore(peers, options.Token, &http.Client{Transport: transport, Timeout: 3 * time.Second})
+	case StoreRaft:
+		c.store, err = NewRaftStore(options.Address, options.RaftDir, options.Peers, options.Token,
+			&http.Client{Transport: transport, Timeout: raftApplyTimeout}, clientTLS, c.invalidate)
+		if err != nil {
+			return nil, err
+		}
+	case StoreKubernetes:
+		config, err := kubeConfig(options.KubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load kubernetes config, %v", err)
+		}
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		c.store = NewLease(client, options.Namespace, options.Identity, options.Address, options.LeaseDuration)
+	default:
+		return nil, fmt.Errorf("unknown session store %s", options.Store)
+	}
+
+	c.proxy = &httputil.ReverseProxy{
+		Transport: transport,
+		Director: func(req *http.Request) {
+			owner, _ := url.Parse(req.Context().Value(clusterOwnerKey{}).(string))
+			req.URL.Scheme = owner.Scheme
+			req.URL.Host = owner.Host
+			req.Header.Set(clusterTokenHeader, options.Token)
+			if poll, _ := req.Context().Value(clusterPollKey{}).(bool); !poll {
+				req.Header.Set(clusterForwardedHeader, options.Identity)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			klog.Errorf("Failed to forward %s to replica %s, %v", req.Host, req.Context().Value(clusterOwnerKey{}), err)
+			c.invalidate(canonical(req.Host))
+			if e := accessLogEntryFrom(req.Context()); e != nil {
+				e.Error = err.Error()
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return c, nil
+}
+
+// clusterTLS returns TLS config of cluster listener and of requests to
+// peers, replicas verify each other by certificates signed by CA.
+func clusterTLS(options *ClusterOptions) (*tls.Config, *tls.Config, error) {
+	if len(options.CertFile) == 0 || len(options.KeyFile) == 0 || len(options.CAFile) == 0 {
+		return nil, nil, errors.New("cluster certificate, key and CA must be provided")
+	}
+	cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load cluster certificate, %v", err)
+	}
+	pem, err := ioutil.ReadFile(options.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read cluster CA, %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("no certificate found in cluster CA %s", options.CAFile)
+	}
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	client := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}
+	return server, client, nil
+}
+
+func kubeConfig(path string) (*rest.Config, error) {
+	if len(path) == 0 {
+		return rest.InClusterConfig()
+	}
+	return clientcmd.BuildConfigFromFlags("", path)
+}
+
+// Start serves cluster listener with handler, which serves requests
+// forwarded by peers and session queries.
+func (c *Cluster) Start(handler http.Handler) error {
+	return c.httpServer.GoListenAndServeTls(c.options.Listen, handler, c.tlsConfig)
+}
+
+// Run runs session store maintenance until ctx is done.
+func (c *Cluster) Run(ctx context.Context) {
+	if runner, ok := c.store.(interface{ Run(context.Context) }); ok {
+		runner.Run(ctx)
+	}
+}
+
+func (c *Cluster) Close() error {
+	err := c.httpServer.Close()
+	if closer, ok := c.store.(io.Closer); ok {
+		closer.Close()
+	}
+	return err
+}
+
+// ServeStore serves requests of peers to session store, returns false if
+// store doesn't serve request.
+func (c *Cluster) ServeStore(w http.ResponseWriter, req *http.Request) bool {
+	if handler, ok := c.store.(http.Handler); ok && strings.HasPrefix(req.URL.Path, raftPath) {
+		handler.ServeHTTP(w, req)
+		return true
+	}
+	return false
+}
+
+// Authorized reports whether request is sent by a peer.
+func (c *Cluster) Authorized(req *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get(clusterTokenHeader)), []byte(c.options.Token)) == 1
+}
+
+func (c *Cluster) Acquire(domain string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.store.Acquire(ctx, domain); err != nil {
+		klog.Errorf("Failed to acquire %s in session store, %v", domain, err)
+	}
+}
+
+func (c *Cluster) Release(domain string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.store.Release(ctx, domain); err != nil {
+		klog.Errorf("Failed to release %s in session store, %v", domain, err)
+	}
+}
+
+// Forward forwards request to a replica holding agents of the requested domain,
+// returns false if there is none.
+func (c *Cluster) Forward(w http.ResponseWriter, req *http.Request) bool {
+	owners, err := c.lookup(req.Context(), canonical(req.Host))
+	if err == errTooManyLookups {
+		klog.V(2).Infof("Not forwarding request for %s, %v", req.Host, err)
+		return false
+	} else if err != nil {
+		klog.Errorf("Failed to lookup owners of %s, %v", req.Host, err)
+		return false
+	}
+
+	if len(owners) == 0 {
+		return false
+	}
+
+	owner := owners[rand.Intn(len(owners))]
+	klog.V(4).Infof("Forwarding request for %s to replica %s", req.Host, owner)
+	c.proxy.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clusterOwnerKey{}, owner)))
+	return true
+}
+
+// PollOwner returns tag of replica in ids of poll sessions opened here,
+// its address signed by cluster token, so agents can't have requests
+// forwarded to addresses of their choice.
+func (c *Cluster) PollOwner() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.options.Address)) + "~" + c.sign(c.options.Address)
+}
+
+// ForwardPoll forwards request of poll session to replica tagged by owner,
+// returns false if session is opened here or owner is not a valid tag.
+func (c *Cluster) ForwardPoll(w http.ResponseWriter, req *http.Request, owner string) bool {
+	i := strings.Index(owner, "~")
+	if i < 0 {
+		return false
+	}
+	address, err := base64.RawURLEncoding.DecodeString(owner[:i])
+	if err != nil || !hmac.Equal([]byte(owner[i+1:]), []byte(c.sign(string(address)))) || string(address) == c.options.Address {
+		return false
+	}
+
+	klog.V(4).Infof("Forwarding poll request to replica %s", address)
+	ctx := context.WithValue(req.Context(), clusterOwnerKey{}, string(address))
+	c.proxy.ServeHTTP(w, req.WithContext(context.WithValue(ctx, clusterPollKey{}, true)))
+	return true
+}
+
+func (c *Cluster) sign(s string) string {
+	mac := hmac.New(sha256.New, []byte(c.options.Token))
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// lookup returns peers holding agents of domain. Concurrent lookups of a
+// domain share one query of store, and at most maxLookups domains are
+// queried at once.
+func (c *Cluster) lookup(ctx context.Context, domain string) ([]string, error) {
+	c.mu.Lock()
+	if cached, ok := c.owners[domain]; ok && time.Now().Before(cached.expires) {
+		c.mu.Unlock()
+		return cached.owners, nil
+	}
+	call, ok := c.lookups[domain]
+	if !ok {
+		if len(c.lookups) >= maxLookups {
+			c.mu.Unlock()
+			return nil, errTooManyLookups
+		}
+		call = &lookupCall{done: make(chan struct{})}
+		c.lookups[domain] = call
+		go c.query(domain, call)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.owners, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// query queries store for owners of domain, caching peers found or none.
+func (c *Cluster) query(domain string, call *lookupCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	owners, err := c.store.Owners(ctx, domain)
+	for _, owner := range owners {
+		if owner != c.options.Address {
+			call.owners = append(call.owners, owner)
+		}
+	}
+	call.err = err
+
+	c.mu.Lock()
+	delete(c.lookups, domain)
+	if err == nil {
+		if len(c.owners) >= maxCachedOwners {
+			c.evict()
+		}
+		c.owners[domain] = cachedOwners{owners: call.owners, expires: time.Now().Add(ownersTTL)}
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// evict drops expired owners from cache, or all if none expired. Caller
+// holds mu.
+func (c *Cluster) evict() {
+	now := time.Now()
+	for domain, cached := range c.owners {
+		if now.After(cached.expires) {
+			delete(c.owners, domain)
+		}
+	}
+	if len(c.owners) >= maxCachedOwners {
+		c.owners = make(map[string]cachedOwners)
+	}
+}
+
+// invalidate drops owners of domain cached, once forwarding to them fails
+// or a peer tells it holds or releases domain.
+func (c *Cluster) invalidate(domain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.owners, domain)
+}
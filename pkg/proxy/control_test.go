@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zryfish/kunnel/pkg/agent"
+	"github.com/zryfish/kunnel/pkg/control"
+	"github.com/zryfish/kunnel/pkg/mux"
+	"github.com/zryfish/kunnel/pkg/transport"
+	"github.com/zryfish/kunnel/pkg/utils"
+	"github.com/zryfish/kunnel/pkg/version"
+)
+
+const testToken = "s3cr3t"
+
+// startServer starts a server on loopback, authenticating agents by
+// token if not empty.
+func startServer(t *testing.T, token string) *url.URL {
+	options := &Options{Host: "127.0.0.1", Domains: []string{"kunnel.test"}}
+	if len(token) != 0 {
+		options.Tokens = []string{token}
+	}
+	s, err := NewServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(options.Host, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return &url.URL{Scheme: "ws", Host: s.httpServer.listener.Addr().String()}
+}
+
+// connect connects to server as an agent by protocol version it picks.
+func connect(t *testing.T, server *url.URL, token string) mux.Conn {
+	return connectBy(t, server, token, transport.WebSocket, nil)
+}
+
+// connectBy connects to server as an agent by transport of name.
+func connectBy(t *testing.T, server *url.URL, token, name string, tlsConfig *tls.Config) mux.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := &transport.DialOptions{Protocols: version.Protocols, TLSConfig: tlsConfig}
+	discovery, err := transport.Discover(ctx, server, options)
+	if err != nil {
+		t.Fatalf("unable to discover server, %v", err)
+	}
+	if discovery.Control != control.Version {
+		t.Fatalf("server speaks control protocol version %d, expecting %d", discovery.Control, control.Version)
+	}
+	if !discovery.Supports(name) {
+		t.Fatalf("server doesn't support transport %s", name)
+	}
+	options.Protocol, options.QUICPort = discovery.Protocol, discovery.QUICPort
+
+	conn, protocol, err := transport.Get(name).Dial(ctx, server, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentConn, _, reqs, err := mux.NewClientConn(conn, protocol, &mux.ClientConfig{User: "test", Token: token, Timeout: 10 * time.Second})
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agentConn.Close() })
+	go func() {
+		for req := range reqs {
+			req.Reply(false, nil)
+		}
+	}()
+	return agentConn
+}
+
+func newConfig() *agent.Config {
+	return &agent.Config{Name: "test", LocalHost: "127.0.0.1", LocalPort: 80, Protocol: "http"}
+}
+
+func newHandshake(config *agent.Config) *control.Handshake {
+	conf, _ := config.Marshal()
+	return &control.Handshake{Version: control.Version, Capabilities: []control.Capability{control.Events}, Config: conf}
+}
+
+func send(t *testing.T, conn mux.Conn, name string, payload []byte) (bool, *control.Response) {
+	ok, reply, err := conn.SendRequest(name, true, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &control.Response{}
+	if err := control.Unmarshal(reply, response); err != nil {
+		t.Fatal(err)
+	}
+	return ok, response
+}
+
+func handshake(t *testing.T, conn mux.Conn) {
+	ok, response := send(t, conn, control.HandshakeRequest, control.Marshal(newHandshake(newConfig())))
+	if err := response.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("reply is not ok without error")
+	}
+	if response.Version != control.Version {
+		t.Fatalf("response version is %d, expecting %d", response.Version, control.Version)
+	}
+	if len(response.Endpoints) == 0 {
+		t.Fatal("no endpoints assigned")
+	}
+	for _, endpoint := range response.Endpoints {
+		if len(endpoint.Hostname) == 0 || len(endpoint.URL) == 0 {
+			t.Fatalf("incomplete endpoint %+v", endpoint)
+		}
+	}
+}
+
+// expectReply sends request expecting it rejected by error of code.
+func expectReply(t *testing.T, conn mux.Conn, name string, payload []byte, code control.Code) {
+	ok, response := send(t, conn, name, payload)
+	if ok {
+		t.Fatalf("reply is ok, expecting error %s", code)
+	}
+	if response.Error == nil {
+		t.Fatalf("no error in response, expecting %s", code)
+	}
+	if response.Error.Code != code {
+		t.Fatalf("error is %v, expecting %s", response.Error, code)
+	}
+	if response.Version != control.Version {
+		t.Fatalf("response version is %d, expecting %d", response.Version, control.Version)
+	}
+}
+
+// expectError sends handshake expecting it rejected by error of code.
+func expectError(t *testing.T, conn mux.Conn, h *control.Handshake, code control.Code) {
+	expectReply(t, conn, control.HandshakeRequest, control.Marshal(h), code)
+}
+
+func TestControl(t *testing.T) {
+	checks := []struct {
+		name string
+		run  func(*testing.T, mux.Conn)
+	}{
+		{"handshake", handshake},
+		{"legacy config", func(t *testing.T, conn mux.Conn) {
+			conf, _ := newConfig().Marshal()
+			ok, payload, err := conn.SendRequest(control.ConfigRequest, true, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := &utils.Message{}
+			if err := msg.Unmarshal(payload); err != nil {
+				t.Fatal(err)
+			}
+			if !ok || msg.Err != nil {
+				t.Fatalf("config rejected, %s", msg.Err)
+			}
+			if len(msg.Domain) == 0 {
+				t.Fatal("no domain assigned")
+			}
+		}},
+		{"ping", func(t *testing.T, conn mux.Conn) {
+			handshake(t, conn)
+			ok, _, err := conn.SendRequest(control.PingRequest, true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatal("ping is not replied ok")
+			}
+		}},
+		{"invalid config", func(t *testing.T, conn mux.Conn) {
+			config := newConfig()
+			config.ProxyProtocol = "v9"
+			expectError(t, conn, newHandshake(config), control.InvalidConfig)
+		}},
+		{"unsupported version", func(t *testing.T, conn mux.Conn) {
+			h := newHandshake(newConfig())
+			h.Version = control.Version + 1
+			expectError(t, conn, h, control.UnsupportedVersion)
+		}},
+		{"malformed handshake", func(t *testing.T, conn mux.Conn) {
+			expectReply(t, conn, control.HandshakeRequest, []byte("{"), control.InvalidRequest)
+		}},
+		{"unexpected request", func(t *testing.T, conn mux.Conn) {
+			expectReply(t, conn, control.PingRequest, nil, control.InvalidRequest)
+		}},
+	}
+
+	for _, token := range []string{"", testToken} {
+		name := "anonymous"
+		if len(token) != 0 {
+			name = "token"
+		}
+		t.Run(name, func(t *testing.T) {
+			server := startServer(t, token)
+			for _, c := range checks {
+				t.Run(c.name, func(t *testing.T) {
+					c.run(t, connect(t, server, token))
+				})
+			}
+		})
+	}
+}
+
+func TestControlUnauthenticatedTunnel(t *testing.T) {
+	config := newConfig()
+	config.Tunnel = "test"
+	expectError(t, connect(t, startServer(t, ""), ""), newHandshake(config), control.Unauthorized)
+}
+
+func TestControlWithoutDomain(t *testing.T) {
+	s, err := NewServer(&Options{Host: "127.0.0.1", Tokens: []string{testToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	server := &url.URL{Scheme: "ws", Host: s.httpServer.listener.Addr().String()}
+
+	for _, name := range []string{"", "test"} {
+		config := newConfig()
+		config.Tunnel = name
+		ok, response := send(t, connect(t, server, testToken), control.HandshakeRequest, control.Marshal(newHandshake(config)))
+		if err := response.Err(); err != nil || !ok {
+			t.Fatalf("handshake failed, %v", err)
+		}
+		// tunnels are served by hostnames they are assigned
+		hostname := response.Endpoints[0].Hostname
+		if _, ok := s.tunnel(hostname); !ok || strings.HasSuffix(hostname, ".") {
+			t.Fatalf("tunnel %q not found", hostname)
+		}
+	}
+}
+
+func TestControlOverQUIC(t *testing.T) {
+	caFile, certFile, keyFile := writeClusterCerts(t, t.TempDir())
+	s, err := NewServer(&Options{Host: "127.0.0.1", Domains: []string{"kunnel.test"}, Tokens: []string{testToken},
+		TlsCrtFile: certFile, TlsKeyFile: keyFile, AgentQUICListen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server := &url.URL{Scheme: "wss", Host: s.httpServer.listener.Addr().String()}
+
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	conn := connectBy(t, server, testToken, transport.QUIC, &tls.Config{RootCAs: pool})
+	handshake(t, conn)
+}
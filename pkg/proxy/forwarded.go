@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/zryfish/kunnel/pkg/utils"
+)
+
+type clientAddrKey struct{}
+
+// forwardedFor resolves the original client address of request. Forwarding
+// headers are only honored when request comes from a trusted proxy.
+func forwardedFor(req *http.Request, trusted []*net.IPNet) *net.TCPAddr {
+	remote := remoteTCPAddr(req.RemoteAddr)
+	if remote == nil || !utils.ContainsIP(trusted, remote.IP) {
+		return remote
+	}
+
+	hops := forwardedForHops(req)
+	// walk back until first address not belonging to trusted proxies
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		remote = &net.TCPAddr{IP: ip}
+		if !utils.ContainsIP(trusted, ip) {
+			break
+		}
+	}
+	return remote
+}
+
+func forwardedForHops(req *http.Request) []string {
+	var hops []string
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); len(hop) != 0 {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// setForwardedHeaders sets X-Forwarded-* and RFC 7239 Forwarded headers
+// of request before proxied to upstream. Headers coming from untrusted
+// clients are discarded. X-Forwarded-For is completed by reverse proxy,
+// which appends immediate client address to it.
+func setForwardedHeaders(req *http.Request, trusted []*net.IPNet) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	host := req.Host
+
+	remote := remoteTCPAddr(req.RemoteAddr)
+	if remote != nil && utils.ContainsIP(trusted, remote.IP) {
+		if p := req.Header.Get("X-Forwarded-Proto"); len(p) != 0 {
+			proto = p
+		}
+		if h := req.Header.Get("X-Forwarded-Host"); len(h) != 0 {
+			host = h
+		}
+	} else {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("Forwarded")
+	}
+
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", host)
+
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(req.RemoteAddr), quoteForwarded(host), proto)
+	if prior := req.Header.Values("Forwarded"); len(prior) != 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	req.Header.Set("Forwarded", forwarded)
+}
+
+// forwardedNode formats address as node of RFC 7239 Forwarded header.
+func forwardedNode(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "unknown"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return fmt.Sprintf("\"[%s]:%s\"", host, port)
+	}
+	return quoteForwarded(net.JoinHostPort(host, port))
+}
+
+func quoteForwarded(s string) string {
+	if strings.ContainsAny(s, ":[]\",; ") {
+		return "\"" + strings.ReplaceAll(s, "\"", "\\\"") + "\""
+	}
+	return s
+}
+
+func remoteTCPAddr(addr string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+func withClientAddr(req *http.Request, addr net.Addr) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), clientAddrKey{}, addr))
+}
+
+// clientAddrFrom returns original client and server address of
+// the request which upstream connection dialed for.
+func clientAddrFrom(ctx context.Context) (net.Addr, net.Addr) {
+	client, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	local, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+	return client, local
+}
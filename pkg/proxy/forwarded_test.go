@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zryfish/kunnel/pkg/utils"
+)
+
+func TestForwardedFor(t *testing.T) {
+	trusted, _ := utils.ParseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+
+	tests := []struct {
+		name   string
+		remote string
+		header []string
+		client string
+	}{
+		{name: "direct", remote: "203.0.113.7:1234", client: "203.0.113.7"},
+		{name: "untrusted peer", remote: "203.0.113.7:1234", header: []string{"198.51.100.1"}, client: "203.0.113.7"},
+		{name: "trusted peer", remote: "10.0.0.1:1234", header: []string{"198.51.100.1"}, client: "198.51.100.1"},
+		{name: "trusted peer ipv6", remote: "[2001:db8::1]:1234", header: []string{"2001:db9::1"}, client: "2001:db9::1"},
+		{name: "trusted peer without header", remote: "10.0.0.1:1234", client: "10.0.0.1"},
+		{name: "chain of trusted proxies", remote: "10.0.0.1:1234", header: []string{"198.51.100.1, 10.0.0.3", "10.0.0.2"}, client: "198.51.100.1"},
+		{name: "spoofed by client", remote: "10.0.0.1:1234", header: []string{"1.2.3.4, 198.51.100.1"}, client: "198.51.100.1"},
+		{name: "garbage hop", remote: "10.0.0.1:1234", header: []string{"198.51.100.1, unknown"}, client: "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://web.kunnel.test/", nil)
+			req.RemoteAddr = test.remote
+			for _, v := range test.header {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if client := forwardedFor(req, trusted); client == nil || client.IP.String() != test.client {
+				t.Fatalf("expected client %s, got %v", test.client, client)
+			}
+		})
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	trusted, _ := utils.ParseCIDRs([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		name      string
+		remote    string
+		tls       bool
+		header    http.Header
+		proto     string
+		host      string
+		forwarded string
+		xff       string
+	}{
+		{
+			name:      "direct",
+			remote:    "203.0.113.7:1234",
+			proto:     "http",
+			host:      "web.kunnel.test",
+			forwarded: `for="203.0.113.7:1234";host=web.kunnel.test;proto=http`,
+		},
+		{
+			name:      "direct over tls",
+			remote:    "203.0.113.7:1234",
+			tls:       true,
+			proto:     "https",
+			host:      "web.kunnel.test",
+			forwarded: `for="203.0.113.7:1234";host=web.kunnel.test;proto=https`,
+		},
+		{
+			name:      "direct ipv6",
+			remote:    "[2001:db8::7]:1234",
+			proto:     "http",
+			host:      "web.kunnel.test",
+			forwarded: `for="[2001:db8::7]:1234";host=web.kunnel.test;proto=http`,
+		},
+		{
+			name:   "untrusted peer",
+			remote: "203.0.113.7:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.test"},
+				"Forwarded":         {"for=1.2.3.4"},
+			},
+			proto:     "http",
+			host:      "web.kunnel.test",
+			forwarded: `for="203.0.113.7:1234";host=web.kunnel.test;proto=http`,
+		},
+		{
+			name:   "trusted peer",
+			remote: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"www.example.com"},
+				"Forwarded":         {"for=198.51.100.1;proto=https"},
+			},
+			proto:     "https",
+			host:      "www.example.com",
+			forwarded: `for=198.51.100.1;proto=https, for="10.0.0.1:1234";host=www.example.com;proto=https`,
+			xff:       "198.51.100.1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://web.kunnel.test/", nil)
+			req.RemoteAddr = test.remote
+			if test.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+
+			setForwardedHeaders(req, trusted)
+			for k, expected := range map[string]string{
+				"X-Forwarded-Proto": test.proto,
+				"X-Forwarded-Host":  test.host,
+				"Forwarded":         test.forwarded,
+				"X-Forwarded-For":   test.xff,
+			} {
+				if v := req.Header.Get(k); v != expected {
+					t.Fatalf("expected %s %q, got %q", k, expected, v)
+				}
+			}
+		})
+	}
+}
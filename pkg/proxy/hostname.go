@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostnameChallengePrefix is prefixed to custom hostnames for TXT records
+// proving ownership, like _kunnel.app.example.com.
+const hostnameChallengePrefix = "_kunnel."
+
+// verifyHostname checks owner of hostname delegates it to tunnel domain
+// by a TXT record of _kunnel.<hostname> containing domain. CNAME records
+// don't prove it, as resolvers return the end of CNAME chains, which
+// tunnel domains behind a shared alias, like of a load balancer, have
+// in common.
+func verifyHostname(ctx context.Context, resolver *net.Resolver, hostname, domain string) error {
+	records, err := resolver.LookupTXT(ctx, hostnameChallengePrefix+hostname)
+	if err == nil {
+		for _, record := range records {
+			if canonical(record) == canonical(domain) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("unable to verify hostname %s, add a TXT record %s%s with value %s",
+		hostname, hostnameChallengePrefix, hostname, domain)
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// underDomain reports whether hostname is domain or its subdomain.
+func underDomain(hostname, domain string) bool {
+	hostname, domain = canonical(hostname), canonical(domain)
+	return hostname == domain || strings.HasSuffix(hostname, "."+domain)
+}
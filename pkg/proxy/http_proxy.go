@@ -3,46 +3,163 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	client "github.com/zryfish/kunnel/pkg/agent"
+	"github.com/zryfish/kunnel/pkg/control"
+	"github.com/zryfish/kunnel/pkg/mux"
 	"k8s.io/klog"
 
 	k8sproxy "k8s.io/apimachinery/pkg/util/proxy"
 )
 
 type HttpProxy struct {
-	name       string
-	port       int
+	// active requests being proxied, accessed atomically
+	active int64
+
+	name      string
+	server    *http.Server
+	proxyHost string
+	headers   map[string]string
+	agent     string
+	conn      mux.Conn
+	// events is set for agents handling events of control protocol
+	events bool
+	// hostnames are custom hostnames agent brought to its tunnel
+	hostnames []string
+
+	// routes sorted by path prefix length, longest first, then
+	// by number of headers to match
+	routes   []*upstream
+	fallback *upstream
+}
+
+// upstream is a target address requests proxied to.
+type upstream struct {
+	pathPrefix string
+	headers    map[string]string
 	host       string
+	port       int
 	protocol   string
-	server     *http.Server
-	httpClient *http.Client
-	proxyHost  string
-	headers    map[string]string
+	rewriter   *rewriter
+	transport  http.RoundTripper
 }
 
-func NewHttpProxy(name, host, protocol string, port int, proxyHost string, headers map[string]string, transport *http.Transport) *HttpProxy {
+func NewHttpProxy(config *client.Config, transport *http.Transport) (*HttpProxy, error) {
 	server := &http.Server{
-		Addr: fmt.Sprintf(":%d", port),
+		Addr: fmt.Sprintf(":%d", config.LocalPort),
 	}
 
-	return &HttpProxy{
-		name:      name,
-		host:      host,
-		port:      port,
-		protocol:  protocol,
-		headers:   headers,
+	s := &HttpProxy{
+		name:      config.Name,
+		headers:   config.Hedaers,
 		server:    server,
-		proxyHost: proxyHost,
-		httpClient: &http.Client{
-			Transport: transport,
-		},
+		proxyHost: config.Host,
+	}
+
+	scheme := func(protocol string) string {
+		// agent negotiates TLS, plain HTTP is sent through tunnel
+		if config.AgentUpstreamTLS {
+			return "http"
+		}
+		return protocol
+	}
+
+	var err error
+	s.fallback, err = newUpstream(config.LocalHost, config.LocalPort, scheme(config.Protocol), config.Host, config.Rules, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, route := range config.Routes {
+		protocol, rules := route.Protocol, route.Rules
+		if len(protocol) == 0 {
+			protocol = config.Protocol
+		}
+		if rules == nil {
+			rules = config.Rules
+		}
+
+		up, err := newUpstream(route.LocalHost, route.LocalPort, scheme(protocol), config.Host, rules, transport)
+		if err != nil {
+			return nil, err
+		}
+		up.pathPrefix = route.PathPrefix
+		up.headers = route.Headers
+		s.routes = append(s.routes, up)
+	}
+
+	sort.SliceStable(s.routes, func(i, j int) bool {
+		if len(s.routes[i].pathPrefix) != len(s.routes[j].pathPrefix) {
+			return len(s.routes[i].pathPrefix) > len(s.routes[j].pathPrefix)
+		}
+		return len(s.routes[i].headers) > len(s.routes[j].headers)
+	})
+
+	return s, nil
+}
+
+func newUpstream(host string, port int, protocol, proxyHost string, rules *client.Rules, transport *http.Transport) (*upstream, error) {
+	rewriter, err := newRewriter(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	up := &upstream{
+		host:     host,
+		port:     port,
+		protocol: protocol,
+		rewriter: rewriter,
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if rewriter != nil {
+		upstreams := []string{host, up.address()}
+		if len(proxyHost) != 0 {
+			upstreams = append(upstreams, proxyHost)
+		}
+		roundTripper = &rewriteTransport{RoundTripper: transport, rewriter: rewriter, upstreams: upstreams}
+	}
+	up.transport = &upstreamTransport{RoundTripper: roundTripper}
+
+	return up, nil
+}
+
+func (u *upstream) address() string {
+	return net.JoinHostPort(u.host, strconv.Itoa(u.port))
+}
+
+func (u *upstream) match(req *http.Request) bool {
+	if !hasPathPrefix(req.URL.Path, u.pathPrefix) {
+		return false
 	}
+	for k, v := range u.headers {
+		if req.Header.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns upstream which request should be proxied to.
+func (s *HttpProxy) route(req *http.Request) *upstream {
+	for _, up := range s.routes {
+		if up.match(req) {
+			return up
+		}
+	}
+	return s.fallback
 }
 
 func (s *HttpProxy) Start(ctx context.Context) error {
-	klog.V(0).Infof("Proxy server %s: starting http proxy on %s, proxy address %s", s.name, s.server.Addr, s.host)
+	klog.V(0).Infof("Proxy server %s: starting http proxy on %s, proxy address %s", s.name, s.server.Addr, s.fallback.host)
 	s.server.Handler = s
 
 	done := make(chan chan struct{})
@@ -69,11 +186,26 @@ func (s *HttpProxy) Start(ctx context.Context) error {
 }
 
 func (s *HttpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&s.active, 1)
+	defer atomic.AddInt64(&s.active, -1)
+
+	if e := accessLogEntryFrom(req.Context()); e != nil {
+		e.Agent = s.agent
+		e.Error = ""
+	}
+
+	up := s.route(req)
+
+	if up.rewriter != nil {
+		req = withPublicURL(req, publicURL(req))
+		up.rewriter.rewriteRequest(req)
+	}
+
 	u := *req.URL
-	u.Host = fmt.Sprintf("%s:%d", s.host, s.port)
-	u.Scheme = s.protocol
+	u.Host = up.address()
+	u.Scheme = up.protocol
 
-	httpProxy := k8sproxy.NewUpgradeAwareHandler(&u, s.httpClient.Transport, false, false, s)
+	httpProxy := k8sproxy.NewUpgradeAwareHandler(&u, up.transport, false, false, s)
 
 	if len(s.proxyHost) != 0 {
 		req.Host = s.proxyHost
@@ -89,6 +221,65 @@ func (s *HttpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	httpProxy.ServeHTTP(w, req)
 }
 
-func (s *HttpProxy) Error(_ http.ResponseWriter, req *http.Request, err error) {
+// drain asks agent to reconnect, its connection keeps serving requests
+// in flight until closed.
+func (s *HttpProxy) drain() {
+	if s.conn == nil {
+		return
+	}
+	name, payload := control.DrainRequest, []byte(nil)
+	if s.events {
+		name, payload = control.EventRequest, control.Marshal(&control.Event{Type: control.Drain})
+	}
+	if _, _, err := s.conn.SendRequest(name, false, payload); err != nil {
+		klog.Errorf("Failed to send drain notice to agent %s, %v", s.agent, err)
+	}
+}
+
+// publicURL returns scheme and host which client requested.
+func publicURL(req *http.Request) *url.URL {
+	u := &url.URL{Scheme: req.Header.Get("X-Forwarded-Proto"), Host: req.Header.Get("X-Forwarded-Host")}
+	if len(u.Scheme) == 0 {
+		u.Scheme = "http"
+		if req.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	if len(u.Host) == 0 {
+		u.Host = req.Host
+	}
+	return u
+}
+
+func (s *HttpProxy) Error(w http.ResponseWriter, req *http.Request, err error) {
 	klog.Errorf("Proxy server %s: proxy %s encountered error %v", s.name, req.URL, err)
+	if e := accessLogEntryFrom(req.Context()); e != nil {
+		e.Error = err.Error()
+	}
+	if failAttempt(req.Context()) {
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// upstreamTransport records upstream latency and errors of
+// proxied requests into their access log entries.
+type upstreamTransport struct {
+	http.RoundTripper
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t0 := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if e := accessLogEntryFrom(req.Context()); e != nil {
+		e.UpstreamLatency = time.Since(t0)
+		if err != nil {
+			e.Error = err.Error()
+		}
+	}
+	return resp, err
+}
+
+func (t *upstreamTransport) WrappedRoundTripper() http.RoundTripper {
+	return t.RoundTripper
 }
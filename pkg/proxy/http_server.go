@@ -6,6 +6,8 @@ import (
 	"net"
 	"net/http"
 	"sync"
+
+	"github.com/zryfish/kunnel/pkg/utils"
 )
 
 // HttpServer extends net/http with
@@ -16,6 +18,11 @@ type HttpServer struct {
 	running   chan error
 	isRunning bool
 	closer    sync.Once
+
+	// accept PROXY protocol headers from trustedProxies only
+	proxyProtocol  bool
+	trustedProxies []*net.IPNet
+	proxyListener  *utils.ProxyProtocolListener
 }
 
 func NewHttpServer() *HttpServer {
@@ -29,34 +36,47 @@ func NewHttpServer() *HttpServer {
 }
 
 func (h *HttpServer) GoListenAndServeTls(addr string, handler http.Handler, tlsConfig *tls.Config) error {
-	var l net.Listener
-	var err error
-	if tlsConfig != nil {
-		l, err = tls.Listen("tcp", addr, tlsConfig)
-	} else {
-		l, err = net.Listen("tcp", addr)
-	}
-
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
+	if h.proxyProtocol {
+		h.proxyListener = utils.NewProxyProtocolListener(l, h.trustedProxies)
+		l = h.proxyListener
+	}
+
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
 	h.isRunning = true
 	h.Handler = handler
 	h.listener = l
 	go func() {
-		h.CloseWith(h.Serve(l))
+		err := h.Serve(l)
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		h.CloseWith(err)
 	}()
 	return nil
 
 }
 
-func (h *HttpServer) CloseWith(err error) {
-	if !h.isRunning {
-		return
+// SetTrustedProxies replaces proxies whose PROXY protocol headers
+// are accepted, for connections accepted afterwards.
+func (h *HttpServer) SetTrustedProxies(trusted []*net.IPNet) {
+	h.trustedProxies = trusted
+	if h.proxyListener != nil {
+		h.proxyListener.SetTrusted(trusted)
 	}
-	h.isRunning = false
-	h.running <- err
+}
+
+func (h *HttpServer) CloseWith(err error) {
+	h.closer.Do(func() {
+		h.running <- err
+	})
 }
 
 func (h *HttpServer) Close() error {
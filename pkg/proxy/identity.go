@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path"
+)
+
+// AgentIdentity maps client certificates of agents to an identity,
+// and tunnels agents of the identity could join.
+type AgentIdentity struct {
+	// Name of identity, matched against common name and SANs of certificates
+	Name string
+	// Tunnels are patterns of tunnel names identity could join, like team-a-*,
+	// any tunnel including random ones if empty
+	Tunnels []string
+}
+
+// allows reports whether identity could join tunnel, empty for random ones.
+func (id *AgentIdentity) allows(tunnel string) bool {
+	if len(id.Tunnels) == 0 {
+		return true
+	}
+	for _, pattern := range id.Tunnels {
+		if ok, _ := path.Match(pattern, tunnel); ok && len(tunnel) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateIdentity returns identity of verified client certificate of
+// connection. Any verified certificate is an identity named by its common
+// name if no identities configured.
+func (st *settings) certificateIdentity(state *tls.ConnectionState) (*AgentIdentity, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, errors.New("client certificate required")
+	}
+
+	cert := state.VerifiedChains[0][0]
+	names := certificateNames(cert)
+	if len(st.identities) == 0 {
+		if len(names) == 0 {
+			return nil, errors.New("client certificate has no subject name")
+		}
+		return &AgentIdentity{Name: names[0]}, nil
+	}
+
+	for i := range st.identities {
+		for _, name := range names {
+			if name == st.identities[i].Name {
+				return &st.identities[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("client certificate %s is not mapped to any identity", cert.Subject)
+}
+
+// certificateNames returns common name and SANs of certificate.
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if len(cert.Subject.CommonName) != 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
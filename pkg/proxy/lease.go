@@ -1,4 +1,175 @@
 package proxy
 
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	leaseDomainLabel       = "kunnel.run/domain"
+	leaseDomainAnnotation  = "kunnel.run/domain"
+	leaseAddressAnnotation = "kunnel.run/address"
+)
+
+// Lease is a SessionStore backed by Kubernetes Leases, one lease for
+// each domain held by each replica. Leases are renewed periodically,
+// so those of crashed replicas expire.
 type Lease struct {
+	client    kubernetes.Interface
+	namespace string
+	identity  string
+	address   string
+	duration  time.Duration
+
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func NewLease(client kubernetes.Interface, namespace, identity, address string, duration time.Duration) *Lease {
+	return &Lease{
+		client:    client,
+		namespace: namespace,
+		identity:  identity,
+		address:   address,
+		duration:  duration,
+		held:      make(map[string]bool),
+	}
+}
+
+// Run renews leases held until ctx is done.
+func (l *Lease) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		var domains []string
+		for domain := range l.held {
+			domains = append(domains, domain)
+		}
+		l.mu.Unlock()
+
+		for _, domain := range domains {
+			if err := l.renew(ctx, domain); err != nil {
+				klog.Errorf("Failed to renew lease of %s, %v", domain, err)
+			}
+		}
+	}
+}
+
+func (l *Lease) Acquire(ctx context.Context, domain string) error {
+	l.mu.Lock()
+	l.held[domain] = true
+	l.mu.Unlock()
+	return l.renew(ctx, domain)
+}
+
+func (l *Lease) Release(ctx context.Context, domain string) error {
+	l.mu.Lock()
+	delete(l.held, domain)
+	l.mu.Unlock()
+
+	err := l.client.CoordinationV1().Leases(l.namespace).Delete(ctx, l.leaseName(domain), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *Lease) Owners(ctx context.Context, domain string) ([]string, error) {
+	selector := labels.SelectorFromSet(labels.Set{leaseDomainLabel: domainHash(domain)})
+	leases, err := l.client.CoordinationV1().Leases(l.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	var owners []string
+	for _, lease := range leases.Items {
+		if lease.Annotations[leaseDomainAnnotation] != domain || expired(&lease) {
+			continue
+		}
+		if address := lease.Annotations[leaseAddressAnnotation]; len(address) != 0 {
+			owners = append(owners, address)
+		}
+	}
+	return owners, nil
+}
+
+func (l *Lease) renew(ctx context.Context, domain string) error {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(l.duration.Seconds())
+
+	lease, err := leases.Get(ctx, l.leaseName(domain), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      l.leaseName(domain),
+				Namespace: l.namespace,
+				Labels:    map[string]string{leaseDomainLabel: domainHash(domain)},
+				Annotations: map[string]string{
+					leaseDomainAnnotation:  domain,
+					leaseAddressAnnotation: l.address,
+				},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string)
+	}
+	lease.Annotations[leaseAddressAnnotation] = l.address
+	lease.Spec.HolderIdentity = &l.identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+func (l *Lease) leaseName(domain string) string {
+	name := fmt.Sprintf("kunnel-%s-%s", domainHash(domain), strings.ToLower(l.identity))
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return strings.TrimRight(name, "-.")
+}
+
+func expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).Before(time.Now())
+}
+
+func domainHash(domain string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(domain)))
+	return hex.EncodeToString(sum[:])[:32]
 }
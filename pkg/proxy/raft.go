@@ -0,0 +1,569 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"k8s.io/klog"
+)
+
+const (
+	StoreRaft = "raft"
+
+	// raftPath is upgraded to raft connections between replicas, over
+	// cluster listener
+	raftPath = "/raft"
+	// raftApplyPath takes commands followers apply by leader
+	raftApplyPath = "/raft/apply"
+	raftUpgrade   = "kunnel-raft"
+
+	// raftSyncInterval is how often replicas record domains they hold,
+	// which keeps them alive in store and repairs commands lost
+	raftSyncInterval = 10 * time.Second
+	// raftOwnerTTL is how long owners not synced are still routed to
+	raftOwnerTTL = 3 * raftSyncInterval
+	// raftForgetAfter is how long owners not synced are kept in store
+	raftForgetAfter = 10 * raftOwnerTTL
+
+	raftApplyTimeout = 5 * time.Second
+)
+
+const (
+	raftAcquire = "acquire"
+	raftRelease = "release"
+	raftSync    = "sync"
+)
+
+// raftCommand changes domains held by owner, sync replaces all of them.
+// Time is when owner sent it, so replicas agree on which owners are gone.
+type raftCommand struct {
+	Op      string    `json:"op"`
+	Owner   string    `json:"owner"`
+	Domains []string  `json:"domains"`
+	Time    time.Time `json:"time"`
+}
+
+// RaftStore is a SessionStore replicated by Raft among replicas, with
+// log and snapshots persisted in bolt under a directory of each. Replicas
+// are raft servers at their cluster addresses, talking to each other
+// over cluster listener. Replicas read owners from their own copy, which
+// is behind leader by replication lag, and owners which stop syncing
+// domains they hold, crashed or partitioned away, expire.
+type RaftStore struct {
+	address string
+	token   string
+	client  *http.Client
+	layer   *raftLayer
+	raft    *raft.Raft
+	fsm     *ownersFSM
+	bolt    *raftboltdb.BoltStore
+
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+// NewRaftStore starts raft server of replica at address, keeping data in
+// dir. Peers are addresses of all replicas, which bootstrap cluster
+// unless dir has it already. Client reaches peers and tlsConfig dials
+// them, presenting cluster certificate. Changed is called with domains
+// whose owners changed.
+func NewRaftStore(address, dir string, peers []string, token string, client *http.Client, tlsConfig *tls.Config, changed func(string)) (*RaftStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn, Output: os.Stderr})
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(address)
+	config.Logger = logger
+
+	bolt, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open raft store, %v", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, ioutil.Discard)
+	if err != nil {
+		bolt.Close()
+		return nil, fmt.Errorf("unable to open raft snapshots, %v", err)
+	}
+
+	s := &RaftStore{
+		address: address,
+		token:   token,
+		client:  client,
+		layer:   newRaftLayer(address, token, tlsConfig),
+		fsm:     newOwnersFSM(changed),
+		bolt:    bolt,
+		held:    make(map[string]bool),
+	}
+	transport := raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream:  s.layer,
+		MaxPool: 3,
+		Timeout: 10 * time.Second,
+		Logger:  logger,
+	})
+
+	exists, err := raft.HasExistingState(bolt, bolt, snapshots)
+	if err != nil {
+		bolt.Close()
+		return nil, err
+	}
+	if !exists {
+		configuration := raft.Configuration{}
+		seen := make(map[string]bool)
+		for _, peer := range append([]string{address}, peers...) {
+			if seen[strings.TrimSuffix(peer, "/")] {
+				continue
+			}
+			seen[strings.TrimSuffix(peer, "/")] = true
+			configuration.Servers = append(configuration.Servers, raft.Server{ID: raft.ServerID(peer), Address: raft.ServerAddress(peer)})
+		}
+		// every replica bootstraps by the same configuration
+		if err := raft.BootstrapCluster(config, bolt, bolt, snapshots, transport, configuration); err != nil {
+			bolt.Close()
+			return nil, fmt.Errorf("unable to bootstrap raft cluster, %v", err)
+		}
+	}
+
+	s.raft, err = raft.NewRaft(config, s.fsm, bolt, bolt, snapshots, transport)
+	if err != nil {
+		bolt.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RaftStore) Acquire(ctx context.Context, domain string) error {
+	s.mu.Lock()
+	s.held[domain] = true
+	s.mu.Unlock()
+	return s.apply(ctx, &raftCommand{Op: raftAcquire, Domains: []string{domain}})
+}
+
+func (s *RaftStore) Release(ctx context.Context, domain string) error {
+	s.mu.Lock()
+	delete(s.held, domain)
+	s.mu.Unlock()
+	return s.apply(ctx, &raftCommand{Op: raftRelease, Domains: []string{domain}})
+}
+
+func (s *RaftStore) Owners(ctx context.Context, domain string) ([]string, error) {
+	return s.fsm.owners(domain, time.Now()), nil
+}
+
+// Run syncs domains held until ctx is done, the first time at once, which
+// drops those held before replica restarted.
+func (s *RaftStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(raftSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		domains := make([]string, 0, len(s.held))
+		for domain := range s.held {
+			domains = append(domains, domain)
+		}
+		s.mu.Unlock()
+
+		syncCtx, cancel := context.WithTimeout(ctx, raftApplyTimeout)
+		if err := s.apply(syncCtx, &raftCommand{Op: raftSync, Domains: domains}); err != nil {
+			klog.V(2).Infof("Failed to sync domains held to raft store, %v", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *RaftStore) Close() error {
+	err := s.raft.Shutdown().Error()
+	s.layer.Close()
+	s.bolt.Close()
+	return err
+}
+
+// apply applies command of this replica by leader, sending it to leader
+// if that's another replica.
+func (s *RaftStore) apply(ctx context.Context, command *raftCommand) error {
+	command.Owner, command.Time = s.address, time.Now()
+	b, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	if s.raft.State() == raft.Leader {
+		return s.raft.Apply(b, raftApplyTimeout).Error()
+	}
+
+	_, leader := s.raft.LeaderWithID()
+	if len(leader) == 0 {
+		return errors.New("no raft leader")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(string(leader), "/")+raftApplyPath, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(clusterTokenHeader, s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("leader %s failed applying, %s %s", leader, resp.Status, msg)
+	}
+	return nil
+}
+
+// ServeHTTP serves raft connections and commands of peers, which are
+// authorized by cluster.
+func (s *RaftStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case raftPath:
+		s.layer.handle(w, req)
+	case raftApplyPath:
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, 10*1024*1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(b, &raftCommand{}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.raft.Apply(b, raftApplyTimeout).Error(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// ownersFSM is state replicated by raft, domains held by each owner and
+// when owners synced them last.
+type ownersFSM struct {
+	changed func(string)
+
+	mu     sync.RWMutex
+	state  ownersState
+	latest time.Time
+}
+
+type ownersState struct {
+	// Domains are owners holding each domain
+	Domains map[string]map[string]bool `json:"domains"`
+	// Synced is when owners synced domains they hold last
+	Synced map[string]time.Time `json:"synced"`
+}
+
+func newOwnersFSM(changed func(string)) *ownersFSM {
+	return &ownersFSM{changed: changed, state: newOwnersState()}
+}
+
+func newOwnersState() ownersState {
+	return ownersState{Domains: make(map[string]map[string]bool), Synced: make(map[string]time.Time)}
+}
+
+// owners returns owners holding domain, synced within TTL of now.
+func (f *ownersFSM) owners(domain string, now time.Time) []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var owners []string
+	for owner := range f.state.Domains[domain] {
+		if now.Sub(f.state.Synced[owner]) < raftOwnerTTL {
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+func (f *ownersFSM) Apply(log *raft.Log) interface{} {
+	command := &raftCommand{}
+	if err := json.Unmarshal(log.Data, command); err != nil {
+		return err
+	}
+
+	var changed []string
+	f.mu.Lock()
+	state := f.state
+	switch command.Op {
+	case raftAcquire:
+		for _, domain := range command.Domains {
+			if state.add(domain, command.Owner) {
+				changed = append(changed, domain)
+			}
+		}
+	case raftRelease:
+		for _, domain := range command.Domains {
+			if state.remove(domain, command.Owner) {
+				changed = append(changed, domain)
+			}
+		}
+	case raftSync:
+		held := make(map[string]bool, len(command.Domains))
+		for _, domain := range command.Domains {
+			held[domain] = true
+			if state.add(domain, command.Owner) {
+				changed = append(changed, domain)
+			}
+		}
+		for domain, owners := range state.Domains {
+			if owners[command.Owner] && !held[domain] && state.remove(domain, command.Owner) {
+				changed = append(changed, domain)
+			}
+		}
+	}
+	if command.Time.After(state.Synced[command.Owner]) {
+		state.Synced[command.Owner] = command.Time
+	}
+	if command.Time.After(f.latest) {
+		f.latest = command.Time
+	}
+	// owners gone long ago are forgotten, by time of commands so
+	// replicas forget them alike
+	for owner, synced := range state.Synced {
+		if f.latest.Sub(synced) > raftForgetAfter {
+			for domain := range state.Domains {
+				if state.remove(domain, owner) {
+					changed = append(changed, domain)
+				}
+			}
+			delete(state.Synced, owner)
+		}
+	}
+	f.mu.Unlock()
+
+	if f.changed != nil {
+		for _, domain := range changed {
+			f.changed(domain)
+		}
+	}
+	return nil
+}
+
+// add records owner holds domain, reporting whether it didn't.
+func (s ownersState) add(domain, owner string) bool {
+	owners, ok := s.Domains[domain]
+	if !ok {
+		owners = make(map[string]bool)
+		s.Domains[domain] = owners
+	}
+	if owners[owner] {
+		return false
+	}
+	owners[owner] = true
+	return true
+}
+
+// remove records owner no longer holds domain, reporting whether it did.
+func (s ownersState) remove(domain, owner string) bool {
+	owners := s.Domains[domain]
+	if !owners[owner] {
+		return false
+	}
+	delete(owners, owner)
+	if len(owners) == 0 {
+		delete(s.Domains, domain)
+	}
+	return true
+}
+
+func (f *ownersFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	b, err := json.Marshal(f.state)
+	if err != nil {
+		return nil, err
+	}
+	return ownersSnapshot(b), nil
+}
+
+func (f *ownersFSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	state := newOwnersState()
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	old := f.state
+	f.state = state
+	f.latest = time.Time{}
+	for _, synced := range state.Synced {
+		if synced.After(f.latest) {
+			f.latest = synced
+		}
+	}
+	f.mu.Unlock()
+
+	if f.changed != nil {
+		for domain := range old.Domains {
+			f.changed(domain)
+		}
+		for domain := range state.Domains {
+			f.changed(domain)
+		}
+	}
+	return nil
+}
+
+type ownersSnapshot []byte
+
+func (s ownersSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s ownersSnapshot) Release() {}
+
+// raftLayer carries raft connections over cluster listener, upgrading
+// requests of peers, which dial them by their cluster addresses.
+type raftLayer struct {
+	addr      raftAddr
+	token     string
+	tlsConfig *tls.Config
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// raftAddr is cluster address of replica.
+type raftAddr string
+
+func (a raftAddr) Network() string { return "tcp" }
+func (a raftAddr) String() string  { return string(a) }
+
+func newRaftLayer(address, token string, tlsConfig *tls.Config) *raftLayer {
+	return &raftLayer{
+		addr:      raftAddr(address),
+		token:     token,
+		tlsConfig: tlsConfig,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+}
+
+func (l *raftLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *raftLayer) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *raftLayer) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial connects to peer at cluster address, upgrading request to raft
+// connection.
+func (l *raftLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(string(address))
+	if err != nil {
+		return nil, err
+	}
+	config := l.tlsConfig.Clone()
+	config.ServerName = u.Hostname()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", u.Host, config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	req, _ := http.NewRequest(http.MethodGet, strings.TrimSuffix(string(address), "/")+raftPath, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", raftUpgrade)
+	req.Header.Set(clusterTokenHeader, l.token)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s refused raft connection, %s", address, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &raftConn{Conn: conn, reader: reader}, nil
+}
+
+// handle upgrades request of peer to raft connection.
+func (l *raftLayer) handle(w http.ResponseWriter, req *http.Request) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), raftUpgrade) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + raftUpgrade + "\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- &raftConn{Conn: conn, reader: rw.Reader}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// raftConn reads what's buffered while upgrading first.
+type raftConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *raftConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// writeClusterCerts writes CA and certificate of replicas on loopback,
+// returning their files.
+func writeClusterCerts(t *testing.T, dir string) (string, string, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kunnel-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kunnel"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []struct {
+		name, kind string
+		der        []byte
+	}{
+		{"ca.crt", "CERTIFICATE", caDER},
+		{"tls.crt", "CERTIFICATE", certDER},
+		{"tls.key", "EC PRIVATE KEY", keyDER},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), pem.EncodeToMemory(&pem.Block{Type: f.kind, Bytes: f.der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "ca.crt"), filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+}
+
+// startRaftCluster starts n replicas of raft store, serving store
+// requests of peers only.
+func startRaftCluster(t *testing.T, n int) []*Cluster {
+	dir := t.TempDir()
+	caFile, certFile, keyFile := writeClusterCerts(t, dir)
+
+	var listens, peers []string
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listens = append(listens, l.Addr().String())
+		peers = append(peers, "https://"+l.Addr().String())
+		l.Close()
+	}
+
+	var clusters []*Cluster
+	for i := 0; i < n; i++ {
+		c, err := NewCluster(&ClusterOptions{
+			Listen:   listens[i],
+			Address:  peers[i],
+			Token:    testToken,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			CAFile:   caFile,
+			Identity: fmt.Sprintf("replica-%d", i),
+			Store:    StoreRaft,
+			Peers:    peers,
+			RaftDir:  filepath.Join(dir, fmt.Sprintf("raft-%d", i)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !c.Authorized(req) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if !c.ServeStore(w, req) {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		})
+		if err := c.Start(handler); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		clusters = append(clusters, c)
+	}
+	return clusters
+}
+
+// eventually retries f until it succeeds or times out.
+func eventually(t *testing.T, f func() error) {
+	timeout := time.After(20 * time.Second)
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectOwners(t *testing.T, clusters []*Cluster, domain string, owners []string) {
+	for _, c := range clusters {
+		eventually(t, func() error {
+			found, err := c.store.Owners(context.Background(), domain)
+			if err != nil {
+				return err
+			}
+			if len(found) == 0 && len(owners) == 0 || reflect.DeepEqual(found, owners) {
+				return nil
+			}
+			return fmt.Errorf("%s found owners %v of %s, expecting %v", c.options.Address, found, domain, owners)
+		})
+	}
+}
+
+func TestRaftStore(t *testing.T) {
+	clusters := startRaftCluster(t, 3)
+	ctx := context.Background()
+	domain := "test.kunnel.test"
+
+	// every replica acquires through leader, once elected
+	for _, c := range clusters {
+		eventually(t, func() error { return c.store.Acquire(ctx, domain) })
+		expectOwners(t, clusters, domain, []string{c.options.Address})
+		if err := c.store.Release(ctx, domain); err != nil {
+			t.Fatal(err)
+		}
+		expectOwners(t, clusters, domain, nil)
+	}
+
+	// store survives leader gone
+	var leader int
+	for i, c := range clusters {
+		if c.store.(*RaftStore).raft.State() == raft.Leader {
+			leader = i
+		}
+	}
+	clusters[leader].Close()
+	left := append(append([]*Cluster{}, clusters[:leader]...), clusters[leader+1:]...)
+	eventually(t, func() error { return left[0].store.Acquire(ctx, domain) })
+	expectOwners(t, left, domain, []string{left[0].options.Address})
+}
+
+func TestOwnersFSMExpires(t *testing.T) {
+	var changed []string
+	fsm := newOwnersFSM(func(domain string) { changed = append(changed, domain) })
+	apply := func(command string) {
+		if err := fsm.Apply(&raft.Log{Data: []byte(command)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	at := func(d time.Duration) string {
+		b, _ := now.Add(d).MarshalJSON()
+		return string(b)
+	}
+
+	apply(`{"op":"acquire","owner":"a","domains":["x","y"],"time":` + at(0) + `}`)
+	apply(`{"op":"acquire","owner":"b","domains":["x"],"time":` + at(0) + `}`)
+	if owners := fsm.owners("x", now); len(owners) != 2 {
+		t.Fatalf("expecting 2 owners of x, found %v", owners)
+	}
+
+	// sync replaces domains held
+	apply(`{"op":"sync","owner":"a","domains":["y"],"time":` + at(time.Second) + `}`)
+	if owners := fsm.owners("x", now); !reflect.DeepEqual(owners, []string{"b"}) {
+		t.Fatalf("expecting b owns x, found %v", owners)
+	}
+
+	// owners not synced within TTL are not routed to
+	if owners := fsm.owners("x", now.Add(raftOwnerTTL)); len(owners) != 0 {
+		t.Fatalf("expecting b expired, found %v", owners)
+	}
+
+	// and are forgotten eventually
+	changed = nil
+	apply(`{"op":"sync","owner":"a","domains":["y"],"time":` + at(2*raftForgetAfter) + `}`)
+	if !reflect.DeepEqual(changed, []string{"x"}) {
+		t.Fatalf("expecting x changed, found %v", changed)
+	}
+	if _, ok := fsm.state.Synced["b"]; ok {
+		t.Fatal("expecting b forgotten")
+	}
+}
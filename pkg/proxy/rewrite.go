@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	client "github.com/zryfish/kunnel/pkg/agent"
+)
+
+type publicURLKey struct{}
+
+// rewriter applies tunnel rewrite rules to requests and responses.
+type rewriter struct {
+	rules        *client.Rules
+	pathRewrites []*regexp.Regexp
+}
+
+func newRewriter(rules *client.Rules) (*rewriter, error) {
+	if rules == nil {
+		return nil, nil
+	}
+
+	r := &rewriter{rules: rules}
+	for _, rewrite := range rules.PathRewrites {
+		re, err := regexp.Compile(rewrite.Regexp)
+		if err != nil {
+			return nil, err
+		}
+		r.pathRewrites = append(r.pathRewrites, re)
+	}
+	return r, nil
+}
+
+func (r *rewriter) rewriteRequest(req *http.Request) {
+	rewriteHeaders(req.Header, r.rules.RequestHeaders)
+
+	p := req.URL.Path
+	if len(r.rules.StripPrefix) != 0 && hasPathPrefix(p, r.rules.StripPrefix) {
+		p = "/" + strings.TrimPrefix(p[len(r.rules.StripPrefix):], "/")
+	}
+	if len(r.rules.AddPrefix) != 0 {
+		p = joinPath(r.rules.AddPrefix, p)
+	}
+	for i, re := range r.pathRewrites {
+		p = re.ReplaceAllString(p, r.rules.PathRewrites[i].Replacement)
+	}
+
+	if p != req.URL.Path {
+		req.URL.Path = p
+		req.URL.RawPath = ""
+	}
+}
+
+// rewriteResponse applies response header rules, and rewrites redirects and cookies
+// for any of upstream hosts to public url which client requested.
+func (r *rewriter) rewriteResponse(resp *http.Response, public *url.URL, upstreams []string) {
+	rewriteHeaders(resp.Header, r.rules.ResponseHeaders)
+
+	if !r.rules.RewriteRedirects || public == nil {
+		return
+	}
+
+	if location := resp.Header.Get("Location"); len(location) != 0 {
+		if u, err := url.Parse(location); err == nil {
+			if u.IsAbs() && matchHost(u.Host, upstreams) {
+				u.Scheme, u.Host = public.Scheme, public.Host
+			}
+			if !u.IsAbs() || u.Host == public.Host {
+				u.Path = r.reversePath(u.Path)
+				u.RawPath = ""
+			}
+			resp.Header.Set("Location", u.String())
+		}
+	}
+
+	cookies := resp.Header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = rewriteCookieDomain(cookie, public.Hostname(), upstreams)
+	}
+}
+
+// reversePath maps upstream path back to the one client sees.
+func (r *rewriter) reversePath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	if len(r.rules.AddPrefix) != 0 && hasPathPrefix(p, r.rules.AddPrefix) {
+		p = "/" + strings.TrimPrefix(p[len(r.rules.AddPrefix):], "/")
+	}
+	if len(r.rules.StripPrefix) != 0 {
+		p = joinPath(r.rules.StripPrefix, p)
+	}
+	return p
+}
+
+func rewriteHeaders(header http.Header, rules client.HeaderRules) {
+	for _, k := range rules.Remove {
+		header.Del(k)
+	}
+	for k, v := range rules.Set {
+		header.Set(k, v)
+	}
+	for k, values := range rules.Add {
+		for _, v := range values {
+			header.Add(k, v)
+		}
+	}
+}
+
+func rewriteCookieDomain(cookie, public string, upstreams []string) string {
+	attrs := strings.Split(cookie, ";")
+	// the first part is cookie itself, which may be named domain
+	for i := 1; i < len(attrs); i++ {
+		kv := strings.SplitN(strings.TrimSpace(attrs[i]), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "domain") {
+			continue
+		}
+		if matchHost(strings.TrimPrefix(kv[1], "."), upstreams) {
+			attrs[i] = " Domain=" + public
+		}
+	}
+	return strings.Join(attrs, ";")
+}
+
+func matchHost(host string, upstreams []string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, upstream := range upstreams {
+		if strings.EqualFold(host, upstream) || strings.EqualFold(hostname, upstream) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports whether p starts with prefix at path segment boundary.
+func hasPathPrefix(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+func joinPath(prefix, p string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(p, "/")
+}
+
+func withPublicURL(req *http.Request, u *url.URL) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), publicURLKey{}, u))
+}
+
+func publicURLFrom(ctx context.Context) *url.URL {
+	u, _ := ctx.Value(publicURLKey{}).(*url.URL)
+	return u
+}
+
+// rewriteTransport applies rewrite rules to upstream responses.
+type rewriteTransport struct {
+	http.RoundTripper
+	rewriter  *rewriter
+	upstreams []string
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.rewriter.rewriteResponse(resp, publicURLFrom(req.Context()), t.upstreams)
+	return resp, nil
+}
+
+func (t *rewriteTransport) WrappedRoundTripper() http.RoundTripper {
+	return t.RoundTripper
+}
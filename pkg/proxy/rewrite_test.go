@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	client "github.com/zryfish/kunnel/pkg/agent"
+)
+
+func TestRewriteRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules client.Rules
+		path  string
+		// expected path
+		rewritten string
+	}{
+		{name: "none", path: "/api/v1", rewritten: "/api/v1"},
+		{name: "strip prefix", rules: client.Rules{StripPrefix: "/api"}, path: "/api/v1", rewritten: "/v1"},
+		{name: "strip whole path", rules: client.Rules{StripPrefix: "/api"}, path: "/api", rewritten: "/"},
+		{name: "strip prefix at segment only", rules: client.Rules{StripPrefix: "/api"}, path: "/apis/v1", rewritten: "/apis/v1"},
+		{name: "add prefix", rules: client.Rules{AddPrefix: "/app/"}, path: "/v1", rewritten: "/app/v1"},
+		{name: "strip then add", rules: client.Rules{StripPrefix: "/api", AddPrefix: "/backend"}, path: "/api/v1", rewritten: "/backend/v1"},
+		{
+			name:      "regexp with submatches",
+			rules:     client.Rules{PathRewrites: []client.PathRewrite{{Regexp: `^/users/(\d+)/profile$`, Replacement: "/profile?id=$1"}}},
+			path:      "/users/42/profile",
+			rewritten: "/profile?id=42",
+		},
+		{
+			name:      "regexp not matching",
+			rules:     client.Rules{PathRewrites: []client.PathRewrite{{Regexp: `^/users/(\d+)$`, Replacement: "/u/$1"}}},
+			path:      "/users/me",
+			rewritten: "/users/me",
+		},
+		{
+			name: "regexps in order after prefixes",
+			rules: client.Rules{StripPrefix: "/api", PathRewrites: []client.PathRewrite{
+				{Regexp: `^/v1/`, Replacement: "/v2/"},
+				{Regexp: `/v2/old`, Replacement: "/v2/new"},
+			}},
+			path:      "/api/v1/old",
+			rewritten: "/v2/new",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := newRewriter(&test.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://web.kunnel.test"+test.path, nil)
+			r.rewriteRequest(req)
+			if req.URL.Path != test.rewritten {
+				t.Fatalf("expected path %s, got %s", test.rewritten, req.URL.Path)
+			}
+		})
+	}
+}
+
+func TestRewriteHeaders(t *testing.T) {
+	r, _ := newRewriter(&client.Rules{
+		RequestHeaders: client.HeaderRules{
+			Set:    map[string]string{"X-Env": "prod"},
+			Add:    map[string][]string{"X-Tag": {"a", "b=c"}},
+			Remove: []string{"Cookie"},
+		},
+		ResponseHeaders: client.HeaderRules{
+			Set:    map[string]string{"Cache-Control": "no-store"},
+			Remove: []string{"Server"},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://web.kunnel.test/", nil)
+	req.Header.Set("X-Env", "dev")
+	req.Header.Set("X-Tag", "x")
+	req.Header.Set("Cookie", "session=1")
+	r.rewriteRequest(req)
+	if v := req.Header.Values("X-Env"); len(v) != 1 || v[0] != "prod" {
+		t.Fatalf("expected X-Env replaced, got %v", v)
+	}
+	if v := req.Header.Values("X-Tag"); len(v) != 3 || v[0] != "x" || v[2] != "b=c" {
+		t.Fatalf("expected X-Tag appended, got %v", v)
+	}
+	if _, ok := req.Header["Cookie"]; ok {
+		t.Fatal("expected Cookie removed")
+	}
+
+	resp := &http.Response{Header: http.Header{"Server": {"nginx"}, "Cache-Control": {"max-age=60"}}}
+	r.rewriteResponse(resp, nil, nil)
+	if resp.Header.Get("Cache-Control") != "no-store" || len(resp.Header.Get("Server")) != 0 {
+		t.Fatalf("expected response headers rewritten, got %v", resp.Header)
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	public, _ := url.Parse("https://web.kunnel.test")
+	upstreams := []string{"127.0.0.1", "127.0.0.1:8080", "localhost"}
+
+	tests := []struct {
+		name     string
+		rules    client.Rules
+		location string
+		// expected Location
+		rewritten string
+	}{
+		{name: "upstream address", location: "http://127.0.0.1:8080/login?next=/", rewritten: "https://web.kunnel.test/login?next=/"},
+		{name: "upstream hostname with other port", location: "http://localhost:9090/login", rewritten: "https://web.kunnel.test/login"},
+		{name: "upstream hostname case insensitive", location: "http://LOCALHOST/", rewritten: "https://web.kunnel.test/"},
+		{name: "other host", location: "https://accounts.example.com/login", rewritten: "https://accounts.example.com/login"},
+		{name: "relative", location: "/login", rewritten: "/login"},
+		{name: "relative reversing prefixes", rules: client.Rules{StripPrefix: "/api", AddPrefix: "/backend"}, location: "/backend/login", rewritten: "/api/login"},
+		{name: "upstream reversing prefixes", rules: client.Rules{StripPrefix: "/api"}, location: "http://127.0.0.1:8080/login", rewritten: "https://web.kunnel.test/api/login"},
+		{name: "other host keeps path", rules: client.Rules{StripPrefix: "/api"}, location: "https://example.com/login", rewritten: "https://example.com/login"},
+		{name: "relative path kept", rules: client.Rules{StripPrefix: "/api"}, location: "login", rewritten: "login"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rules.RewriteRedirects = true
+			r, _ := newRewriter(&test.rules)
+			resp := &http.Response{Header: http.Header{"Location": {test.location}}}
+			r.rewriteResponse(resp, public, upstreams)
+			if location := resp.Header.Get("Location"); location != test.rewritten {
+				t.Fatalf("expected Location %s, got %s", test.rewritten, location)
+			}
+		})
+	}
+
+	// redirects are kept unless asked
+	r, _ := newRewriter(&client.Rules{})
+	resp := &http.Response{Header: http.Header{"Location": {"http://127.0.0.1:8080/"}}}
+	r.rewriteResponse(resp, public, upstreams)
+	if location := resp.Header.Get("Location"); location != "http://127.0.0.1:8080/" {
+		t.Fatalf("expected Location kept, got %s", location)
+	}
+}
+
+func TestRewriteCookieDomain(t *testing.T) {
+	// local host, its address and host override, like http proxy has
+	upstreams := []string{"127.0.0.1", "127.0.0.1:8080", "app.internal"}
+
+	tests := []struct {
+		name   string
+		cookie string
+		// expected Set-Cookie
+		rewritten string
+	}{
+		{name: "upstream domain", cookie: "session=1; Domain=app.internal; Path=/", rewritten: "session=1; Domain=web.kunnel.test; Path=/"},
+		{name: "leading dot", cookie: "session=1; Domain=.app.internal", rewritten: "session=1; Domain=web.kunnel.test"},
+		{name: "attribute case insensitive", cookie: "session=1; domain=app.internal; HttpOnly", rewritten: "session=1; Domain=web.kunnel.test; HttpOnly"},
+		{name: "upstream address", cookie: "session=1; Domain=127.0.0.1", rewritten: "session=1; Domain=web.kunnel.test"},
+		{name: "other domain", cookie: "session=1; Domain=example.com", rewritten: "session=1; Domain=example.com"},
+		{name: "no domain", cookie: "session=1; Path=/", rewritten: "session=1; Path=/"},
+		{name: "cookie named domain", cookie: "domain=app.internal; Path=/", rewritten: "domain=app.internal; Path=/"},
+		{name: "value with equal sign", cookie: "token=a=b; Domain=app.internal", rewritten: "token=a=b; Domain=web.kunnel.test"},
+	}
+
+	public, _ := url.Parse("https://web.kunnel.test")
+	r, _ := newRewriter(&client.Rules{RewriteRedirects: true})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{"Set-Cookie": {test.cookie, "other=1; Domain=.app.internal"}}}
+			r.rewriteResponse(resp, public, upstreams)
+			cookies := resp.Header.Values("Set-Cookie")
+			if cookies[0] != test.rewritten {
+				t.Fatalf("expected Set-Cookie %s, got %s", test.rewritten, cookies[0])
+			}
+			if cookies[1] != "other=1; Domain=web.kunnel.test" {
+				t.Fatalf("expected every cookie rewritten, got %s", cookies[1])
+			}
+		})
+	}
+}
@@ -5,188 +5,1006 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
 	client "github.com/zryfish/kunnel/pkg/agent"
+	"github.com/zryfish/kunnel/pkg/control"
+	"github.com/zryfish/kunnel/pkg/mux"
+	"github.com/zryfish/kunnel/pkg/transport"
 	"github.com/zryfish/kunnel/pkg/utils"
 	"github.com/zryfish/kunnel/pkg/version"
 	"golang.org/x/crypto/ssh"
 	"k8s.io/klog"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
-}
-
 type Options struct {
-	Host       string
-	Port       int
-	Domain     string
+	Host string
+	Port int
+	// Domains are base domains of tunnels, the first one is default
+	Domains    []string
 	TlsKeyFile string
 	TlsCrtFile string
+	// Certificates are more certificates selected by SNI
+	Certificates []CertificateFiles
+	AccessLog    *AccessLogOptions
+
+	// TrustedProxies are CIDRs of load balancers in front of server,
+	// whose forwarding headers and PROXY protocol headers are honored
+	TrustedProxies []string
+	ProxyProtocol  bool
+
+	// Tokens agents authenticate with, agents are anonymous if empty
+	Tokens []string
+	// Balancer is strategy balancing requests across agents of a tunnel,
+	// round-robin or least-connections
+	Balancer string
+
+	// Cluster shares routing state with other server replicas, nil for
+	// a standalone server
+	Cluster *ClusterOptions
+
+	Limits Limits
+	// AllowClients and DenyClients are CIDRs of clients allowed or denied
+	// to access tunnels, all allowed if both empty
+	AllowClients []string
+	DenyClients  []string
+
+	// AgentListen is address agents connect to, agents connect to
+	// public listener if empty
+	AgentListen string
+	// AgentClientCA is CA file verifying client certificates of agents,
+	// only agents with valid certificates are accepted if set
+	AgentClientCA string
+	// AgentTCPListen is address of raw TCP listener agents could connect
+	// to, over TLS if server has certificates. Disabled if empty
+	AgentTCPListen string
+	// AgentQUICListen is address of UDP listener agents could connect to
+	// by QUIC, requires certificates. Disabled if empty
+	AgentQUICListen string
+	// AgentIdentities map client certificates of agents to identities
+	AgentIdentities []AgentIdentity
+	// AgentKeepAlive is interval of pings to agents, agents not replying
+	// within 3 intervals are disconnected. Disabled if 0
+	AgentKeepAlive time.Duration
+	// RedirectListen is address of plain HTTP listener redirecting
+	// requests to HTTPS, disabled if empty
+	RedirectListen string
+
+	// AdminListen is address of admin API, disabled if empty
+	AdminListen string
+	// DrainTimeout is how long draining waits for requests in flight
+	DrainTimeout time.Duration
+}
+
+type CertificateFiles struct {
+	CrtFile string
+	KeyFile string
 }
 
+// capabilities are features server tells agents on handshake.
+var capabilities = []control.Capability{control.NamedTunnels, control.Hostnames, control.UpstreamTLS, control.ProxyProtocol}
+
 type Server struct {
 	httpServer *HttpServer
-	sshConfig  *ssh.ServerConfig
+	muxConfig  *mux.ServerConfig
+	options    *Options
 	host       string
 	port       int
-	domain     string
-	sessions   map[string]*HttpProxy
-	tlsConfig  *tls.Config
+	domains    []string
+	// sessions are tunnels by their domains and custom hostnames
+	sessions  map[string]*Tunnel
+	mu        sync.RWMutex
+	tlsConfig *tls.Config
+
+	settingsMu sync.RWMutex
+	current    *settings
+
+	cluster *Cluster
+	// storeMu guards syncing, domains whose session store records are
+	// being updated, set if they changed meanwhile
+	storeMu sync.Mutex
+	syncing map[string]bool
+
+	agentServer    *HttpServer
+	agentListen    string
+	agentTlsConfig *tls.Config
+	// verifyAgents requires agents to present verified client certificates
+	verifyAgents   bool
+	redirectServer *HttpServer
+	redirectListen string
+	tcpListen      string
+	tcpListener    net.Listener
+	quicListen     string
+	quicListener   *transport.QUICListener
+	polls          *transport.PollServer
+
+	adminServer *HttpServer
+	adminListen string
+	// draining is set once server starts draining, accessed atomically
+	draining int32
+	drained  chan struct{}
 }
 
 func NewServer(options *Options) (*Server, error) {
 	s := &Server{
 		httpServer: NewHttpServer(),
+		options:    options,
 		host:       options.Host,
 		port:       options.Port,
-		domain:     options.Domain,
-		sessions:   make(map[string]*HttpProxy),
+		domains:    append([]string(nil), options.Domains...),
+		sessions:   make(map[string]*Tunnel),
+		syncing:    make(map[string]bool),
+
+		agentListen:    options.AgentListen,
+		redirectListen: options.RedirectListen,
+		tcpListen:      options.AgentTCPListen,
+		quicListen:     options.AgentQUICListen,
+		adminListen:    options.AdminListen,
+		drained:        make(chan struct{}),
 	}
 
-	if len(options.TlsCrtFile) != 0 && len(options.TlsKeyFile) != 0 {
-		cer, err := tls.LoadX509KeyPair(options.TlsCrtFile, options.TlsKeyFile)
+	var err error
+	if s.current, err = newSettings(options, nil); err != nil {
+		return nil, err
+	}
+
+	if len(s.domains) == 0 {
+		s.domains = []string{""}
+	}
+	for i := range s.domains {
+		s.domains[i] = canonical(s.domains[i])
+	}
+
+	if len(s.current.certificates) != 0 {
+		// certificates are looked up for each handshake, so they could be reloaded
+		s.tlsConfig = &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return s.settings().certificate(hello), nil
+			},
+		}
+	}
+
+	s.agentTlsConfig = s.tlsConfig
+	if len(options.AgentClientCA) != 0 {
+		if s.tlsConfig == nil {
+			return nil, errors.New("verifying agent certificates requires tls certificates")
+		}
+		pem, err := ioutil.ReadFile(options.AgentClientCA)
 		if err != nil {
-			return nil, fmt.Errorf("error loading tls certificate, %v", err)
+			return nil, fmt.Errorf("unable to read agent client CA, %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in agent client CA %s", options.AgentClientCA)
+		}
+		if len(s.agentListen) != 0 {
+			s.agentTlsConfig = s.tlsConfig.Clone()
+			s.agentTlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			// public clients don't have certificates
+			s.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 		}
+		s.agentTlsConfig.ClientCAs = pool
+		s.verifyAgents = true
+	}
 
-		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cer}}
+	// HTTP/2 CONNECT streams of agents, public listener keeps HTTP/1.1
+	// which upgraded requests of tunnels rely on
+	if len(s.agentListen) != 0 && s.agentTlsConfig != nil {
+		if s.agentTlsConfig == s.tlsConfig {
+			s.agentTlsConfig = s.tlsConfig.Clone()
+		}
+		s.agentTlsConfig.NextProtos = []string{"h2", "http/1.1"}
 	}
 
+	s.httpServer.proxyProtocol = options.ProxyProtocol
+	s.httpServer.trustedProxies = s.current.trustedProxies
+
+	var owner string
+	if options.Cluster != nil {
+		s.cluster, err = NewCluster(options.Cluster)
+		if err != nil {
+			return nil, err
+		}
+		owner = s.cluster.PollOwner()
+	}
+	s.polls = transport.NewPollServer(owner)
+
 	key, _ := generateKey()
 	private, err := ssh.ParsePrivateKey(key)
 	if err != nil {
 		klog.Fatalf("Failed to parse ssh key %v", err)
 	}
 
-	s.sshConfig = &ssh.ServerConfig{
-		ServerVersion:    "SSH-" + version.ProtocolVersion + "-server",
-		PasswordCallback: s.authenticate,
+	s.muxConfig = &mux.ServerConfig{
+		Authenticate: s.authenticate,
+		HostKey:      private,
+		Timeout:      30 * time.Second,
 	}
-	s.sshConfig.AddHostKey(private)
 
 	return s, nil
 
 }
 
-func (s *Server) authenticate(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-	klog.V(4).Infof("%s is connecting from %s", c.User(), c.RemoteAddr())
-	return nil, nil
+func (s *Server) authenticate(user string, remote net.Addr, password []byte) (bool, error) {
+	klog.V(4).Infof("%s is connecting from %s", user, remote)
+	tokens := s.settings().tokens
+	if len(tokens) == 0 {
+		return false, nil
+	}
+
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), password) == 1 {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("invalid token for %s", user)
 }
 
 func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
-	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
-	protocol := r.Header.Get("Sec-WebSocket-Protocol")
-	if upgrade == "websocket" && strings.HasPrefix(protocol, "kunnel-") {
-		if protocol == version.ProtocolVersion {
-			s.handleWebsocket(w, r)
-			return
-		}
-		klog.V(4).Infof("Ingoring client connection using protocol '%s', expected '%s'", protocol, version.ProtocolVersion)
+	// agents connect to their own listener if any, then everything
+	// here is tunnel traffic
+	if len(s.agentListen) == 0 && transport.IsAgentRequest(r) {
+		s.handleAgent(w, r)
 		return
 	}
 
 	s.handleRequest(w, r)
 }
 
-func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
-	klog.V(4).Info("New connection")
-	wsConn, err := upgrader.Upgrade(w, req, nil)
+func (s *Server) handleAgent(w http.ResponseWriter, r *http.Request) {
+	if !transport.IsAgentRequest(r) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	name, offered := transport.Of(r)
+	protocol := version.Negotiate(offered)
+	if len(protocol) == 0 {
+		klog.V(2).Infof("Rejecting agent from %s speaking protocol versions '%s', expected one of '%s'", r.RemoteAddr, strings.Join(offered, "', '"), strings.Join(version.Protocols, "', '"))
+		transport.UpgradeRequired(w, version.Protocols)
+		return
+	}
+
+	// sessions opened keep polling while draining, on replicas opened them
+	if name == transport.Poll && r.Method != http.MethodPost {
+		if owner := transport.PollOwner(r); s.cluster != nil && len(owner) != 0 && s.cluster.ForwardPoll(w, r, owner) {
+			return
+		}
+		s.polls.ServeHTTP(w, r)
+		return
+	}
+
+	if s.isDraining() {
+		klog.V(4).Infof("Rejecting agent from %s, server is draining", r.RemoteAddr)
+		http.Error(w, "server is draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.URL.Path == transport.DiscoveryPath {
+		s.handleDiscovery(w, protocol)
+		return
+	}
+
+	identity, err := s.agentIdentity(transport.TLSState(r))
 	if err != nil {
-		klog.Error("Failed to upgrade connection", err)
+		klog.V(2).Infof("Rejecting agent from %s, %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
-	connection := utils.NewWebSocketConn(wsConn)
+	switch name {
+	case transport.WebSocket:
+		conn, err := transport.UpgradeWebSocket(w, r, protocol)
+		if err != nil {
+			klog.Error("Failed to upgrade connection", err)
+			return
+		}
+		s.serveAgent(conn, protocol, identity)
+	case transport.HTTP2:
+		conn, err := transport.AcceptConnect(w, r, protocol)
+		if err != nil {
+			klog.V(2).Infof("Rejecting agent from %s, %v", r.RemoteAddr, err)
+			return
+		}
+		s.serveAgent(conn, protocol, identity)
+	case transport.Poll:
+		s.polls.Open(w, r, protocol, func(conn net.Conn) { s.serveAgent(conn, protocol, identity) })
+	}
+}
+
+// handleDiscovery tells agents transports and protocol versions server
+// supports, and protocol version negotiated.
+func (s *Server) handleDiscovery(w http.ResponseWriter, protocol string) {
+	discovery := &transport.Discovery{
+		Transports: []string{transport.WebSocket, transport.Poll},
+		Protocol:   protocol,
+		Protocols:  version.Protocols,
+		Control:    control.Version,
+	}
+	if len(s.agentListen) != 0 && s.agentTlsConfig != nil {
+		discovery.Transports = append(discovery.Transports, transport.HTTP2)
+	}
+	if s.tcpListener != nil {
+		discovery.Transports = append(discovery.Transports, transport.TCP)
+		discovery.TCPPort = s.tcpListener.Addr().(*net.TCPAddr).Port
+	}
+	if s.quicListener != nil {
+		discovery.Transports = append(discovery.Transports, transport.QUIC)
+		discovery.QUICPort = s.quicListener.Addr().(*net.UDPAddr).Port
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discovery)
+}
+
+// serveTCP serves agents connecting to raw TCP listener.
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			// agents offer protocol versions in a line, and are told
+			// the one picked the same way
+			offered, err := transport.ReadPreamble(conn)
+			if err != nil {
+				klog.V(4).Infof("Ingoring client connection from %s, %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			protocol := version.Negotiate(offered)
+			if len(protocol) == 0 {
+				klog.V(2).Infof("Rejecting agent from %s speaking protocol versions '%s', expected one of '%s'", conn.RemoteAddr(), strings.Join(offered, "', '"), strings.Join(version.Protocols, "', '"))
+				conn.Close()
+				return
+			}
+			if s.isDraining() {
+				conn.Close()
+				return
+			}
+			if err := transport.WritePreamble(conn, protocol); err != nil {
+				conn.Close()
+				return
+			}
 
-	sshConn, chans, reqs, err := ssh.NewServerConn(connection, s.sshConfig)
+			var state *tls.ConnectionState
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				st := tlsConn.ConnectionState()
+				state = &st
+			}
+			identity, err := s.agentIdentity(state)
+			if err != nil {
+				klog.V(2).Infof("Rejecting agent from %s, %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			s.serveAgent(conn, protocol, identity)
+		}()
+	}
+}
+
+// serveQUIC serves agents connecting to UDP listener, whose protocol
+// versions are negotiated by listener.
+func (s *Server) serveQUIC() {
+	for {
+		conn, err := s.quicListener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			if s.isDraining() {
+				conn.Close()
+				return
+			}
+			state := conn.ConnectionState()
+			identity, err := s.agentIdentity(&state)
+			if err != nil {
+				klog.V(2).Infof("Rejecting agent from %s, %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			s.serveAgent(conn, conn.Protocol(), identity)
+		}()
+	}
+}
+
+// agentIdentity returns identity of verified client certificate of agent,
+// nil if server doesn't verify agents.
+func (s *Server) agentIdentity(state *tls.ConnectionState) (*AgentIdentity, error) {
+	if !s.verifyAgents {
+		return nil, nil
+	}
+	return s.settings().certificateIdentity(state)
+}
+
+// handleRedirect redirects plain HTTP requests to HTTPS on public listener.
+func (s *Server) handleRedirect(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.port))
+	}
+
+	u := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+	code := http.StatusPermanentRedirect
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		code = http.StatusMovedPermanently
+	}
+	http.Redirect(w, req, u.String(), code)
+}
+
+// serveAgent serves agent connected by any transport, multiplexing by
+// protocol it speaks, until it's gone.
+func (s *Server) serveAgent(conn net.Conn, protocol string, identity *AgentIdentity) {
+	klog.V(4).Infof("New connection speaking %s", protocol)
+	defer conn.Close()
+
+	// credential agent authenticated by, named tunnels are bound to it
+	var credential string
+	c := *s.muxConfig
+	if identity != nil {
+		// certificate authenticates agent instead of token
+		credential = "identity:" + identity.Name
+		c.Authenticate = func(string, net.Addr, []byte) (bool, error) { return true, nil }
+	} else {
+		c.Authenticate = func(user string, remote net.Addr, token []byte) (bool, error) {
+			authenticated, err := s.authenticate(user, remote, token)
+			if authenticated {
+				sum := sha256.Sum256(token)
+				credential = "token:" + hex.EncodeToString(sum[:])
+			}
+			return authenticated, err
+		}
+	}
+	muxConfig := &c
+
+	agentConn, streams, reqs, err := mux.NewServerConn(conn, protocol, muxConfig)
 	if err != nil {
 		klog.Error("Failed to handshake with client", err)
 		return
 	}
 
-	var sreq *ssh.Request
+	var sreq *mux.Request
 	select {
 	case sreq = <-reqs:
 	case <-time.After(10 * time.Second):
-		sshConn.Close()
+		agentConn.Close()
+		return
+	}
+	if sreq == nil {
 		return
 	}
 
-	if sreq.Type != "config" {
-		s.Reply(sreq, "", errors.New("expecting config request"))
+	handshake := &control.Handshake{Version: control.Version, Config: sreq.Payload}
+	switch sreq.Type {
+	case control.HandshakeRequest:
+		if err := control.Unmarshal(sreq.Payload, handshake); err != nil {
+			reply(sreq, rejection(err, control.InvalidRequest))
+			return
+		}
+		if handshake.Version != control.Version {
+			reply(sreq, rejection(control.Errorf(control.UnsupportedVersion, "control protocol version %d is not supported", handshake.Version), ""))
+			return
+		}
+	case control.ConfigRequest:
+		// agents predating control protocol send config only
+	default:
+		reply(sreq, rejection(control.Errorf(control.InvalidRequest, "expecting %s request, got %s", control.HandshakeRequest, sreq.Type), ""))
 		return
 	}
 
 	config := &client.Config{}
-	if err := config.Unmarshal(sreq.Payload); err != nil {
-		klog.Error("Unable to unmarshal config from client", err)
+	if err := config.Unmarshal(handshake.Config); err != nil {
+		reply(sreq, rejection(err, control.InvalidConfig))
+		return
+	}
+
+	if err := config.Validate(); err != nil {
+		reply(sreq, rejection(err, control.InvalidConfig))
+		return
+	}
+
+	if identity != nil && !identity.allows(config.Tunnel) {
+		reply(sreq, rejection(control.Errorf(control.Unauthorized, "identity %s is not allowed to join tunnel %q", identity.Name, config.Tunnel), ""))
 		return
 	}
 
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
-			return utils.NewSshConn(sshConn, fmt.Sprintf("%s:%d", config.LocalHost, config.LocalPort)), nil
+			// addr is one of tunnel targets, see HttpProxy.route
+			conn, err = agentConn.OpenStream(addr)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open stream to agent %s, %v", agentIdentity(agentConn), err)
+			}
+
+			if len(config.ProxyProtocol) != 0 {
+				src, dst := clientAddrFrom(ctx)
+				if err := utils.WriteProxyHeader(conn, config.ProxyProtocol, src, dst); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
 		},
+		// PROXY protocol header describes a single client, connection
+		// can't be shared between clients
+		DisableKeepAlives: len(config.ProxyProtocol) != 0,
 	}
 
-	if config.Protocol == "https" {
-		transport.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: true,
+	upstreamTLS, err := config.UpstreamTLS.TLSConfig()
+	if err != nil {
+		reply(sreq, rejection(err, control.InvalidConfig))
+		return
+	}
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := transport.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// targets are dialed by cluster ips, verified by their service names
+		tlsConfig := upstreamTLS.Clone()
+		tlsConfig.ServerName = config.ServerName(addr)
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	proxy, err := NewHttpProxy(config, transport)
+	if err != nil {
+		reply(sreq, rejection(err, control.InvalidConfig))
+		return
+	}
+	proxy.agent = agentIdentity(agentConn)
+	if identity != nil {
+		proxy.agent = identity.Name
+	}
+	proxy.conn = agentConn
+	proxy.events = handshake.Supports(control.Events)
+
+	base, err := s.baseDomain(config.Domain)
+	if err != nil {
+		reply(sreq, rejection(err, control.InvalidConfig))
+		return
+	}
+
+	var domain string
+	if len(config.Hostnames) != 0 && len(config.Tunnel) == 0 {
+		// anonymous agents get a new domain each time, hostnames
+		// delegated to one would be lost once agent reconnects
+		reply(sreq, rejection(control.Errorf(control.InvalidConfig, "custom hostnames require a named tunnel"), ""))
+		return
+	}
+	if len(config.Tunnel) != 0 {
+		if !agentConn.Authenticated() {
+			reply(sreq, rejection(control.Errorf(control.Unauthorized, "named tunnels require agents to authenticate"), ""))
+			return
 		}
+		domain = subDomain(config.Tunnel, base)
+	} else {
+		domain = subDomain(s.generateSubDomain(), base)
 	}
 
-	proxy := NewHttpProxy(config.Name, config.LocalHost, config.Protocol, config.LocalPort, config.Host, config.Hedaers, transport)
+	if err := s.verifyHostnames(config.Hostnames, domain); err != nil {
+		reply(sreq, rejection(err, control.InvalidConfig))
+		return
+	}
+
+	tunnel, err := s.join(domain, config.Hostnames, proxy, credential)
+	if err != nil {
+		reply(sreq, rejection(err, control.Internal))
+		return
+	}
+	klog.V(2).Infof("Agent %s joined tunnel %s", proxy.agent, tunnel)
 
-	subDomain := s.generateSubDomain() + s.domain
+	response := &control.Response{
+		Version:      control.Version,
+		Capabilities: capabilities,
+		Endpoints:    []control.Endpoint{{Hostname: domain, URL: "https://" + domain}},
+	}
+	for _, hostname := range config.Hostnames {
+		response.Endpoints = append(response.Endpoints, control.Endpoint{Hostname: hostname, URL: "https://" + hostname, Custom: true})
+	}
+	if s.isDraining() {
+		response.Warnings = append(response.Warnings, "server is draining, agent will be asked to reconnect")
+	}
+	reply(sreq, response)
 
-	s.Reply(sreq, subDomain, nil)
-	s.sessions[subDomain] = proxy
+	// agent may join after draining notices sent
+	if s.isDraining() {
+		proxy.drain()
+	}
 
-	go s.handleSSHRequests(reqs)
-	go s.handleSSHChannels(chans)
-	sshConn.Wait()
+	go s.handleAgentRequests(reqs)
+	go s.handleAgentStreams(streams)
+	gone := make(chan struct{})
+	if interval := s.options.AgentKeepAlive; interval > 0 {
+		go func() {
+			if err := mux.KeepAlive(agentConn, control.PingRequest, interval, 3*interval, gone, nil); err != nil {
+				klog.Warningf("Agent %s of tunnel %s is not responding, %v", proxy.agent, tunnel, err)
+				agentConn.Close()
+			}
+		}()
+	}
+	agentConn.Wait()
+	close(gone)
+
+	s.leave(domain, proxy)
+	klog.V(2).Infof("Agent %s left tunnel %s", proxy.agent, tunnel)
+}
+
+// baseDomain returns base domain agent asked for, or the default one.
+func (s *Server) baseDomain(requested string) (string, error) {
+	if len(requested) == 0 {
+		return s.domains[0], nil
+	}
+	for _, domain := range s.domains {
+		if canonical(domain) == canonical(requested) {
+			return domain, nil
+		}
+	}
+	return "", fmt.Errorf("domain %s is not served by server", requested)
+}
+
+// verifyHostnames checks custom hostnames are delegated to tunnel domain.
+func (s *Server) verifyHostnames(hostnames []string, domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, hostname := range hostnames {
+		for _, base := range s.domains {
+			if len(base) != 0 && underDomain(hostname, base) {
+				return fmt.Errorf("hostname %s is under domain %s served by server, use a tunnel instead", hostname, base)
+			}
+		}
+		if err := verifyHostname(ctx, net.DefaultResolver, hostname, domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// join adds proxy to tunnel of domain, custom hostnames of agent become
+// aliases of the tunnel until the last agent brought them leaves. Agents join tunnels only by the
+// credential of those already joined, so tokens and identities can't
+// take over tunnels of others.
+func (s *Server) join(domain string, hostnames []string, proxy *HttpProxy, credential string) (*Tunnel, error) {
+	limits := s.settings().limits
+
+	s.mu.Lock()
+	if limits.MaxAgents > 0 {
+		agents := 0
+		for name, tunnel := range s.sessions {
+			if name == tunnel.name {
+				agents += tunnel.Len()
+			}
+		}
+		if agents >= limits.MaxAgents {
+			s.mu.Unlock()
+			return nil, control.Errorf(control.LimitExceeded, "server reached limit of %d agents", limits.MaxAgents)
+		}
+	}
+
+	tunnel, ok := s.sessions[domain]
+	if ok && tunnel.name != domain {
+		s.mu.Unlock()
+		return nil, control.Errorf(control.Conflict, "domain %s is used as hostname of tunnel %s", domain, tunnel.name)
+	}
+	if ok && tunnel.credential != credential {
+		s.mu.Unlock()
+		return nil, control.Errorf(control.Conflict, "tunnel %s is used by agents of another token or identity", domain)
+	}
+	if ok && limits.MaxAgentsPerTunnel > 0 && tunnel.Len() >= limits.MaxAgentsPerTunnel {
+		s.mu.Unlock()
+		return nil, control.Errorf(control.LimitExceeded, "tunnel %s reached limit of %d agents", domain, limits.MaxAgentsPerTunnel)
+	}
+	for _, hostname := range hostnames {
+		if t, exists := s.sessions[canonical(hostname)]; exists && t != tunnel {
+			s.mu.Unlock()
+			return nil, control.Errorf(control.Conflict, "hostname %s is used by tunnel %s", hostname, t.name)
+		}
+	}
+
+	var added []string
+	if !ok {
+		tunnel = NewTunnel(domain, s.settings().balancer)
+		tunnel.credential = credential
+		s.sessions[domain] = tunnel
+		added = append(added, domain)
+	}
+	owned := make(map[string]bool)
+	for _, hostname := range hostnames {
+		hostname = canonical(hostname)
+		if owned[hostname] {
+			continue
+		}
+		owned[hostname] = true
+		proxy.hostnames = append(proxy.hostnames, hostname)
+		if tunnel.hostnames[hostname] == 0 {
+			s.sessions[hostname] = tunnel
+			added = append(added, hostname)
+		}
+		tunnel.hostnames[hostname]++
+	}
+	tunnel.Add(proxy)
+	s.mu.Unlock()
+
+	s.syncStore(added)
+	return tunnel, nil
+}
+
+func (s *Server) leave(domain string, proxy *HttpProxy) {
+	s.mu.Lock()
+	tunnel, ok := s.sessions[domain]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	var removed []string
+	for _, hostname := range proxy.hostnames {
+		if tunnel.hostnames[hostname]--; tunnel.hostnames[hostname] == 0 {
+			delete(tunnel.hostnames, hostname)
+			removed = append(removed, hostname)
+		}
+	}
+	if tunnel.Remove(proxy) == 0 {
+		removed = append(removed, domain)
+	}
+	for _, name := range removed {
+		delete(s.sessions, name)
+	}
+	s.mu.Unlock()
+
+	s.syncStore(removed)
+}
+
+// syncStore updates session store records of domains joined or left in
+// background, so slow stores don't hold agents back.
+func (s *Server) syncStore(domains []string) {
+	if s.cluster == nil {
+		return
+	}
+
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+	for _, domain := range domains {
+		if _, ok := s.syncing[domain]; ok {
+			// synced again once update in progress is done
+			s.syncing[domain] = true
+			continue
+		}
+		s.syncing[domain] = false
+		go s.syncDomain(domain)
+	}
+}
+
+// syncDomain records domain held or released by whether it's served now,
+// until it doesn't change while being recorded.
+func (s *Server) syncDomain(domain string) {
+	for {
+		if _, ok := s.tunnel(domain); ok {
+			s.cluster.Acquire(domain)
+		} else {
+			s.cluster.Release(domain)
+		}
+
+		s.storeMu.Lock()
+		if !s.syncing[domain] {
+			delete(s.syncing, domain)
+			s.storeMu.Unlock()
+			return
+		}
+		s.syncing[domain] = false
+		s.storeMu.Unlock()
+	}
+}
+
+// proxies returns proxies of all agents joined.
+func (s *Server) proxies() []*HttpProxy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var proxies []*HttpProxy
+	for name, tunnel := range s.sessions {
+		if name != tunnel.name {
+			continue
+		}
+		tunnel.mu.RLock()
+		proxies = append(proxies, tunnel.proxies...)
+		tunnel.mu.RUnlock()
+	}
+	return proxies
+}
+
+func (s *Server) tunnel(domain string) (*Tunnel, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tunnel, ok := s.sessions[canonical(domain)]
+	return tunnel, ok
 }
 
 func (s *Server) Run(ctx context.Context) error {
 	if err := s.Start(s.host, s.port); err != nil {
 		return err
 	}
+	if s.cluster != nil {
+		if err := s.cluster.Start(http.HandlerFunc(s.handleCluster)); err != nil {
+			return err
+		}
+		go s.cluster.Run(ctx)
+	}
+	if len(s.agentListen) != 0 {
+		s.agentServer = NewHttpServer()
+		s.agentServer.ConnContext = transport.ConnContext
+		if err := s.agentServer.GoListenAndServeTls(s.agentListen, wrap(http.HandlerFunc(s.handleAgent)), s.agentTlsConfig); err != nil {
+			return err
+		}
+	}
+	if len(s.tcpListen) != 0 {
+		l, err := net.Listen("tcp", s.tcpListen)
+		if err != nil {
+			return err
+		}
+		if s.agentTlsConfig != nil {
+			l = tls.NewListener(l, s.agentTlsConfig)
+		}
+		s.tcpListener = l
+		go s.serveTCP()
+	}
+	if len(s.quicListen) != 0 {
+		if s.agentTlsConfig == nil {
+			return errors.New("quic listener requires tls certificates")
+		}
+		l, err := transport.ListenQUIC(s.quicListen, s.agentTlsConfig, version.Negotiate)
+		if err != nil {
+			return err
+		}
+		s.quicListener = l
+		go s.serveQUIC()
+	}
+	if len(s.redirectListen) != 0 {
+		s.redirectServer = NewHttpServer()
+		if err := s.redirectServer.GoListenAndServeTls(s.redirectListen, http.HandlerFunc(s.handleRedirect), nil); err != nil {
+			return err
+		}
+	}
+	if len(s.adminListen) != 0 {
+		s.adminServer = NewHttpServer()
+		if err := s.adminServer.GoListenAndServeTls(s.adminListen, http.HandlerFunc(s.handleAdmin), nil); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (s *Server) Reply(sreq *ssh.Request, domain string, err error) {
-	if sreq != nil {
-		message := &utils.Message{
-			Domain: domain,
-			Err:    err,
-		}
-		ok := true
-		if err != nil {
-			ok = false
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Drain stops accepting agents and asks connected ones to reconnect,
+// which lands them on other replicas, then waits for requests in flight
+// up to drain timeout before closing server.
+func (s *Server) Drain() error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.settings().drainTimeout)
+	defer cancel()
+
+	proxies := s.proxies()
+	klog.Infof("Draining server, %d agents connected", len(proxies))
+	for _, proxy := range proxies {
+		proxy.drain()
+	}
+
+	err := s.httpServer.Shutdown(ctx)
+
+	// upgraded requests are hijacked, which Shutdown doesn't wait for
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for err == nil && s.active() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
 		}
+	}
+	if err != nil {
+		klog.Warningf("Drain timed out with %d requests in flight", s.active())
+	}
 
-		body, err := message.Marshal()
-		if err != nil {
-			klog.Error(err)
+	for _, proxy := range s.proxies() {
+		proxy.conn.Close()
+	}
+
+	s.Close()
+	close(s.drained)
+	klog.Info("Server drained")
+	return err
+}
+
+// active returns number of requests being proxied.
+func (s *Server) active() int64 {
+	var n int64
+	for _, proxy := range s.proxies() {
+		n += atomic.LoadInt64(&proxy.active)
+	}
+	return n
+}
+
+func (s *Server) handleAdmin(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/drain":
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		sreq.Reply(ok, body)
+		go s.Drain()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
+// reply replies handshake of agent, or config request of agents predating
+// control protocol. Rejected agents are disconnected by caller returning.
+func reply(sreq *mux.Request, response *control.Response) {
+	if response.Error != nil {
+		klog.V(2).Infof("Rejecting agent, %v", response.Error)
+	}
+
+	if sreq.Type != control.ConfigRequest {
+		sreq.Reply(response.Error == nil, control.Marshal(response))
+		return
+	}
+
+	message := &utils.Message{}
+	if response.Error != nil {
+		message.Err, message.Error = errors.New(response.Error.Message), response.Error.Message
+	} else {
+		message.Domain = response.Endpoints[0].Hostname
+	}
+	body, err := message.Marshal()
+	if err != nil {
+		klog.Error(err)
+		return
+	}
+	sreq.Reply(response.Error == nil, body)
+}
+
+// rejection returns response rejecting agent by err, of code if err
+// isn't an error of control protocol.
+func rejection(err error, code control.Code) *control.Response {
+	return &control.Response{Version: control.Version, Error: control.AsError(err, code)}
+}
+
 func (s *Server) Start(host string, port int) error {
 	h := http.Handler(http.HandlerFunc(s.handleClientHandler))
 	h = wrap(h)
@@ -195,10 +1013,31 @@ func (s *Server) Start(host string, port int) error {
 }
 
 func (s *Server) Wait() error {
-	return s.httpServer.Wait()
+	err := s.httpServer.Wait()
+	if s.isDraining() {
+		<-s.drained
+	}
+	return err
 }
 
 func (s *Server) Close() error {
+	if accessLogger := s.settings().accessLogger; accessLogger != nil {
+		accessLogger.Close()
+	}
+	if s.cluster != nil {
+		s.cluster.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	if s.quicListener != nil {
+		s.quicListener.Close()
+	}
+	for _, server := range []*HttpServer{s.agentServer, s.redirectServer, s.adminServer} {
+		if server != nil {
+			server.Close()
+		}
+	}
 	return s.httpServer.Close()
 }
 
@@ -212,10 +1051,10 @@ func wrap(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) handleSSHRequests(reqs <-chan *ssh.Request) {
+func (s *Server) handleAgentRequests(reqs <-chan *mux.Request) {
 	for req := range reqs {
 		switch req.Type {
-		case "ping":
+		case control.PingRequest:
 			req.Reply(true, nil)
 		default:
 			klog.V(4).Info("Unknown request", req)
@@ -224,10 +1063,100 @@ func (s *Server) handleSSHRequests(reqs <-chan *ssh.Request) {
 }
 
 func (s *Server) handleRequest(w http.ResponseWriter, req *http.Request) {
+	s.serveTunnel(w, req, s.settings().trustedProxies, s.cluster != nil)
+}
+
+// handleCluster serves requests from other replicas, which are either
+// session queries or store requests, requests of poll sessions opened here, or public
+// requests forwarded to agents joined here.
+func (s *Server) handleCluster(w http.ResponseWriter, req *http.Request) {
+	if !s.cluster.Authorized(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if len(req.Header.Get(clusterForwardedHeader)) != 0 {
+		trusted := s.settings().trustedProxies
+		if addr := remoteTCPAddr(req.RemoteAddr); addr != nil {
+			ip := addr.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			trusted = append([]*net.IPNet{{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}}, trusted...)
+		}
+		// never forward again, replicas may disagree on owners for a while
+		s.serveTunnel(w, req, trusted, false)
+		return
+	}
+
+	if req.URL.Path == transport.PollPath {
+		s.polls.ServeHTTP(w, req)
+		return
+	}
+
+	if s.cluster.ServeStore(w, req) {
+		return
+	}
+
+	if strings.HasPrefix(req.URL.Path, clusterSessionsPath) {
+		domain := strings.TrimPrefix(req.URL.Path, clusterSessionsPath)
+		if req.Method == http.MethodPost {
+			s.cluster.invalidate(domain)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if _, ok := s.tunnel(domain); ok {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) serveTunnel(w http.ResponseWriter, req *http.Request, trusted []*net.IPNet, forward bool) {
 	host := req.Host
+	req.Header.Del(clusterTokenHeader)
+	req.Header.Del(clusterForwardedHeader)
+
+	client := forwardedFor(req, trusted)
+	setForwardedHeaders(req, trusted)
+	if client != nil {
+		req = withClientAddr(req, client)
+	}
+
+	st := s.settings()
+	var entry *AccessLogEntry
+	if st.accessLogger != nil && st.accessLogger.acquire() {
+		entry = newAccessLogEntry(req)
+		if client != nil {
+			entry.ClientIP = client.IP.String()
+		}
+		recorder := &responseRecorder{ResponseWriter: w}
+		w, req = recorder, withAccessLogEntry(req, entry)
+		defer func() {
+			entry.Status = recorder.status
+			entry.Bytes = atomic.LoadInt64(&recorder.bytes)
+			entry.Duration = time.Since(entry.Time)
+			st.accessLogger.Log(entry)
+			st.accessLogger.release()
+		}()
+	}
 
-	session, ok := s.sessions[host]
+	var ip net.IP
+	if client != nil {
+		ip = client.IP
+	}
+	if !st.allowed(ip) {
+		klog.V(4).Infof("Client %s is not allowed to access %s", ip, host)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	session, ok := s.tunnel(host)
 	if !ok {
+		if forward && s.cluster.Forward(w, req) {
+			return
+		}
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte("No upstream found"))
 		return
@@ -236,19 +1165,27 @@ func (s *Server) handleRequest(w http.ResponseWriter, req *http.Request) {
 	session.ServeHTTP(w, req)
 }
 
-func (s *Server) handleSSHChannels(chans <-chan ssh.NewChannel) {
-	for ch := range chans {
-		remote := string(ch.ExtraData())
-		stream, reqs, err := ch.Accept()
+func (s *Server) handleAgentStreams(streams <-chan mux.NewStream) {
+	for ch := range streams {
+		remote := ch.Target()
+		stream, err := ch.Accept()
 		if err != nil {
 			klog.Error("failed to accept stream", err)
 			continue
 		}
-		go ssh.DiscardRequests(reqs)
 		go utils.HandleTCPStream(stream, remote)
 	}
 }
 
+// agentIdentity returns the name agent authenticated with,
+// or its remote address for anonymous agents.
+func agentIdentity(conn mux.Conn) string {
+	if len(conn.User()) != 0 {
+		return conn.User()
+	}
+	return conn.RemoteAddr().String()
+}
+
 func generateKey() ([]byte, error) {
 	r := rand.Reader
 
@@ -273,5 +1210,14 @@ func (s *Server) generateSubDomain() string {
 	for i := range r {
 		r[i] = letters[int(b[i])*len(letters)/256]
 	}
-	return string(r) + "."
+	return string(r)
+}
+
+// subDomain returns domain of tunnel name under base, which is name
+// itself if server has no domain.
+func subDomain(name, base string) string {
+	if len(base) == 0 {
+		return canonical(name)
+	}
+	return canonical(name + "." + base)
 }
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/zryfish/kunnel/pkg/utils"
+	"k8s.io/klog"
+)
+
+type Limits struct {
+	// MaxAgents is maximum number of agents connected, unlimited if 0
+	MaxAgents int
+	// MaxAgentsPerTunnel is maximum number of agents joined a tunnel, unlimited if 0
+	MaxAgentsPerTunnel int
+}
+
+// settings are part of options which could be changed by reloading,
+// a snapshot never modified once built.
+type settings struct {
+	tokens         []string
+	balancer       string
+	trustedProxies []*net.IPNet
+	certificates   []tls.Certificate
+	accessLog      AccessLogOptions
+	accessLogger   *AccessLogger
+	limits         Limits
+	allowClients   []*net.IPNet
+	denyClients    []*net.IPNet
+	drainTimeout   time.Duration
+	identities     []AgentIdentity
+}
+
+// newSettings builds settings from options, access logger of old
+// settings is reused if access log options not changed.
+func newSettings(options *Options, old *settings) (*settings, error) {
+	st := &settings{
+		tokens:       options.Tokens,
+		balancer:     options.Balancer,
+		limits:       options.Limits,
+		drainTimeout: options.DrainTimeout,
+		identities:   options.AgentIdentities,
+	}
+
+	if st.drainTimeout <= 0 {
+		st.drainTimeout = 30 * time.Second
+	}
+
+	switch st.balancer {
+	case "":
+		st.balancer = RoundRobin
+	case RoundRobin, LeastConnections:
+	default:
+		return nil, fmt.Errorf("unknown balancer %s", options.Balancer)
+	}
+
+	files := options.Certificates
+	if len(options.TlsCrtFile) != 0 && len(options.TlsKeyFile) != 0 {
+		files = append([]CertificateFiles{{CrtFile: options.TlsCrtFile, KeyFile: options.TlsKeyFile}}, files...)
+	}
+	for _, f := range files {
+		cer, err := tls.LoadX509KeyPair(f.CrtFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls certificate %s, %v", f.CrtFile, err)
+		}
+		st.certificates = append(st.certificates, cer)
+	}
+
+	var err error
+	if st.trustedProxies, err = utils.ParseCIDRs(options.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies, %v", err)
+	}
+	if st.allowClients, err = utils.ParseCIDRs(options.AllowClients); err != nil {
+		return nil, fmt.Errorf("invalid allowed clients, %v", err)
+	}
+	if st.denyClients, err = utils.ParseCIDRs(options.DenyClients); err != nil {
+		return nil, fmt.Errorf("invalid denied clients, %v", err)
+	}
+
+	if options.AccessLog != nil {
+		st.accessLog = *options.AccessLog
+	}
+	if old != nil && reflect.DeepEqual(old.accessLog, st.accessLog) {
+		st.accessLogger = old.accessLogger
+	} else if st.accessLogger, err = NewAccessLogger(&st.accessLog); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// certificate returns the first certificate valid for server name
+// client asked for, or the first one if none matches.
+func (st *settings) certificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	if len(st.certificates) == 0 {
+		return nil
+	}
+	if len(hello.ServerName) != 0 {
+		for i := range st.certificates {
+			if hello.SupportsCertificate(&st.certificates[i]) == nil {
+				return &st.certificates[i]
+			}
+		}
+	}
+	return &st.certificates[0]
+}
+
+// allowed reports whether client is allowed to access tunnels.
+func (st *settings) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(st.allowClients) == 0
+	}
+	if utils.ContainsIP(st.denyClients, ip) {
+		return false
+	}
+	return len(st.allowClients) == 0 || utils.ContainsIP(st.allowClients, ip)
+}
+
+func (s *Server) settings() *settings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.current
+}
+
+// Reload applies options to running server without dropping tunnels.
+// Listeners, domain and cluster can't be changed without restarting.
+func (s *Server) Reload(options *Options) error {
+	if options.Host != s.options.Host || options.Port != s.options.Port || !reflect.DeepEqual(options.Domains, s.options.Domains) ||
+		options.ProxyProtocol != s.options.ProxyProtocol || options.AdminListen != s.options.AdminListen ||
+		options.AgentListen != s.options.AgentListen || options.AgentClientCA != s.options.AgentClientCA ||
+		options.RedirectListen != s.options.RedirectListen || options.AgentTCPListen != s.options.AgentTCPListen ||
+		options.AgentQUICListen != s.options.AgentQUICListen ||
+		!reflect.DeepEqual(options.Cluster, s.options.Cluster) {
+		klog.Warning("Listeners, domain and cluster options changed, restart server to apply them")
+	}
+
+	old := s.settings()
+	st, err := newSettings(options, old)
+	if err != nil {
+		return err
+	}
+
+	if (len(st.certificates) == 0) != (len(old.certificates) == 0) {
+		klog.Warning("TLS enabled or disabled, restart server to apply it")
+	}
+
+	s.settingsMu.Lock()
+	s.current = st
+	s.settingsMu.Unlock()
+	s.httpServer.SetTrustedProxies(st.trustedProxies)
+
+	// closed once requests holding old settings have been logged
+	if old.accessLogger != nil && old.accessLogger != st.accessLogger {
+		old.accessLogger.Close()
+	}
+
+	klog.Info("Server configuration reloaded")
+	return nil
+}
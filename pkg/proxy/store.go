@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+const (
+	StorePeers      = "peers"
+	StoreKubernetes = "kubernetes"
+)
+
+// SessionStore tracks which server replicas hold agents of a tunnel domain.
+type SessionStore interface {
+	// Acquire records replica holds agents of domain
+	Acquire(ctx context.Context, domain string) error
+
+	// Release records replica no longer holds agents of domain
+	Release(ctx context.Context, domain string) error
+
+	// Owners returns cluster addresses of replicas holding agents of domain
+	Owners(ctx context.Context, domain string) ([]string, error)
+}
+
+// peersStore is a self-contained store for a static set of replicas, which
+// doesn't record anything but asks every peer whether it holds the domain.
+// It needs neither a quorum nor data on disk, at the cost of a query of
+// every peer per lookup missed in cache, RaftStore records owners instead.
+type peersStore struct {
+	peers  []string
+	token  string
+	client *http.Client
+}
+
+// NewPeersStore returns store asking peers by client, which presents
+// cluster certificate.
+func NewPeersStore(peers []string, token string, client *http.Client) SessionStore {
+	return &peersStore{
+		peers:  peers,
+		token:  token,
+		client: client,
+	}
+}
+
+// Acquire tells peers to forget owners of domain they cached, misses
+// included, so requests are forwarded here at once.
+func (p *peersStore) Acquire(ctx context.Context, domain string) error {
+	p.notify(ctx, domain)
+	return nil
+}
+
+// Release tells peers to forget owners of domain they cached.
+func (p *peersStore) Release(ctx context.Context, domain string) error {
+	p.notify(ctx, domain)
+	return nil
+}
+
+func (p *peersStore) notify(ctx context.Context, domain string) {
+	var wg sync.WaitGroup
+	for _, peer := range p.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if _, err := p.query(ctx, http.MethodPost, peer, domain); err != nil {
+				klog.V(2).Infof("Failed to notify peer %s of %s, %v", peer, domain, err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (p *peersStore) Owners(ctx context.Context, domain string) ([]string, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var owners []string
+
+	for _, peer := range p.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			ok, err := p.query(ctx, http.MethodGet, peer, domain)
+			if err != nil {
+				klog.V(2).Infof("Failed to query peer %s for %s, %v", peer, domain, err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				owners = append(owners, peer)
+				mu.Unlock()
+			}
+		}(peer)
+	}
+
+	wg.Wait()
+	return owners, nil
+}
+
+// query sends session request of domain to peer, GET reports whether
+// peer holds domain, POST tells peer to forget owners of it cached.
+func (p *peersStore) query(ctx context.Context, method, peer, domain string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(peer, "/")+clusterSessionsPath+url.PathEscape(domain), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(clusterTokenHeader, p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/klog"
+)
+
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+)
+
+// Tunnel balances requests for a hostname across agents joined it.
+type Tunnel struct {
+	name     string
+	balancer string
+
+	mu      sync.RWMutex
+	proxies []*HttpProxy
+	next    uint64
+
+	// hostnames are custom hostnames aliasing tunnel, by number of
+	// agents brought them, guarded by Server.mu
+	hostnames map[string]int
+	// credential is token or identity agents of tunnel authenticated by,
+	// set by the first one joined
+	credential string
+}
+
+type attemptKey struct{}
+
+// attempt records whether proxying to an agent failed before
+// any response written, so request could be retried on another one.
+type attempt struct {
+	failed bool
+}
+
+func NewTunnel(name, balancer string) *Tunnel {
+	return &Tunnel{
+		name:      name,
+		balancer:  balancer,
+		hostnames: make(map[string]int),
+	}
+}
+
+func (t *Tunnel) Add(proxy *HttpProxy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.proxies = append(t.proxies, proxy)
+}
+
+// Remove removes proxy from tunnel, returns number of proxies left.
+func (t *Tunnel) Remove(proxy *HttpProxy) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, p := range t.proxies {
+		if p == proxy {
+			t.proxies = append(t.proxies[:i], t.proxies[i+1:]...)
+			break
+		}
+	}
+	return len(t.proxies)
+}
+
+func (t *Tunnel) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.proxies)
+}
+
+// pick chooses a proxy not in excluded for the seq-th request,
+// returns nil if none left.
+func (t *Tunnel) pick(seq uint64, excluded map[*HttpProxy]bool) (*HttpProxy, int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var candidates []*HttpProxy
+	for _, p := range t.proxies {
+		if !excluded[p] {
+			candidates = append(candidates, p)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, 0
+	}
+
+	if t.balancer == LeastConnections {
+		picked := candidates[0]
+		for _, p := range candidates[1:] {
+			if atomic.LoadInt64(&p.active) < atomic.LoadInt64(&picked.active) {
+				picked = p
+			}
+		}
+		return picked, len(candidates)
+	}
+
+	return candidates[seq%uint64(len(candidates))], len(candidates)
+}
+
+func (t *Tunnel) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	seq := atomic.AddUint64(&t.next, 1)
+	excluded := make(map[*HttpProxy]bool)
+	for {
+		proxy, left := t.pick(seq, excluded)
+		if proxy == nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("No upstream found"))
+			return
+		}
+
+		if left == 1 || !retryable(req) {
+			proxy.ServeHTTP(w, req)
+			return
+		}
+
+		a := &attempt{}
+		proxy.ServeHTTP(w, req.Clone(context.WithValue(req.Context(), attemptKey{}, a)))
+		if !a.failed {
+			return
+		}
+
+		klog.V(2).Infof("Tunnel %s: agent %s failed, retrying %s %s on another agent", t.name, proxy.agent, req.Method, req.URL)
+		excluded[proxy] = true
+	}
+}
+
+func (t *Tunnel) String() string {
+	return fmt.Sprintf("%s (%d agents)", t.name, t.Len())
+}
+
+// retryable reports whether request is idempotent and has no body,
+// so it's safe to be sent to another agent.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+}
+
+// failAttempt marks request attempt failed, returns false if request can't be retried.
+func failAttempt(ctx context.Context) bool {
+	a, ok := ctx.Value(attemptKey{}).(*attempt)
+	if !ok {
+		return false
+	}
+	a.failed = true
+	return true
+}
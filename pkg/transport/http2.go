@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// http2Transport carries connection in a CONNECT stream of HTTP/2, which
+// passes through proxies and load balancers speaking HTTP/2 only.
+type http2Transport struct{}
+
+func (t *http2Transport) Name() string {
+	return HTTP2
+}
+
+func (t *http2Transport) Dial(ctx context.Context, server *url.URL, options *DialOptions) (net.Conn, string, error) {
+	if !secure(server) {
+		return nil, "", errors.New("http/2 transport requires tls")
+	}
+
+	transport := &http.Transport{
+		DialContext:       func(ctx context.Context, _, addr string) (net.Conn, error) { return options.dial(ctx, addr) },
+		TLSClientConfig:   options.tlsConfig(server),
+		ForceAttemptHTTP2: true,
+	}
+
+	pr, pw := io.Pipe()
+	// stream outlives ctx, which only bounds establishing it
+	req, err := http.NewRequest(http.MethodConnect, httpURL(server).String(), pr)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set(ProtocolHeader, strings.Join(options.offered(), ", "))
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := transport.RoundTrip(req)
+		ch <- result{resp, err}
+	}()
+
+	var r result
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		pw.CloseWithError(ctx.Err())
+		go func() {
+			if r := <-ch; r.resp != nil {
+				r.resp.Body.Close()
+			}
+			transport.CloseIdleConnections()
+		}()
+		return nil, "", ctx.Err()
+	}
+
+	if r.err != nil {
+		pw.Close()
+		transport.CloseIdleConnections()
+		return nil, "", r.err
+	}
+	if r.resp.StatusCode != http.StatusOK || r.resp.ProtoMajor != 2 {
+		pw.Close()
+		r.resp.Body.Close()
+		transport.CloseIdleConnections()
+		if err := upgradeRequired(r.resp); err != nil {
+			return nil, "", err
+		}
+		return nil, "", fmt.Errorf("unable to open http/2 stream, %s %s", r.resp.Proto, r.resp.Status)
+	}
+	protocol, err := options.picked(r.resp.Header.Get(ProtocolHeader))
+	if err != nil {
+		pw.Close()
+		r.resp.Body.Close()
+		transport.CloseIdleConnections()
+		return nil, "", err
+	}
+
+	return &streamConn{
+		reader: r.resp.Body,
+		writer: pw,
+		local:  addr("http2-client"),
+		remote: addr(hostPort(server)),
+		onClose: func() {
+			pw.Close()
+			r.resp.Body.Close()
+			transport.CloseIdleConnections()
+		},
+	}, protocol, nil
+}
+
+// AcceptConnect accepts CONNECT stream of HTTP/2 request as connection
+// speaking protocol, handler must not return before connection is closed.
+func AcceptConnect(w http.ResponseWriter, r *http.Request, protocol string) (net.Conn, error) {
+	flusher, ok := w.(http.Flusher)
+	if r.ProtoMajor != 2 || !ok {
+		http.Error(w, "CONNECT streams require HTTP/2", http.StatusHTTPVersionNotSupported)
+		return nil, errors.New("CONNECT streams require HTTP/2")
+	}
+
+	w.Header().Set(ProtocolHeader, protocol)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &streamConn{
+		reader:  r.Body,
+		writer:  &flushWriter{w: w, flusher: flusher},
+		local:   addr(r.Host),
+		remote:  addr(r.RemoteAddr),
+		onClose: func() { r.Body.Close() },
+	}, nil
+}
+
+type tlsConnKey struct{}
+
+// ConnContext keeps TLS connection in context of its requests, for
+// HTTP/2 CONNECT requests come without TLS state.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		return context.WithValue(ctx, tlsConnKey{}, tlsConn)
+	}
+	return ctx
+}
+
+// TLSState returns TLS state of agent request, nil if plain.
+func TLSState(r *http.Request) *tls.ConnectionState {
+	if r.TLS != nil {
+		return r.TLS
+	}
+	if tlsConn, ok := r.Context().Value(tlsConnKey{}).(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	f.flusher.Flush()
+	return n, err
+}
+
+// streamConn is connection over a pair of streams.
+type streamConn struct {
+	noDeadline
+	reader  io.Reader
+	writer  io.Writer
+	local   net.Addr
+	remote  net.Addr
+	onClose func()
+
+	// mu serializes writes, which must stop once closed
+	mu     sync.Mutex
+	closed bool
+	once   sync.Once
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return c.writer.Write(b)
+}
+
+func (c *streamConn) Close() error {
+	c.once.Do(func() {
+		// unblocks writes before waiting for them
+		c.onClose()
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,357 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pollTimeout is how long server holds a poll without data
+	pollTimeout = 20 * time.Second
+	// pollExpiry closes sessions not polled for a while
+	pollExpiry = time.Minute
+	// pollMaxPending is maximum bytes waiting for agent to poll
+	pollMaxPending = 1 << 20
+)
+
+// pollTransport carries connection in plain HTTP requests, for networks
+// breaking long lived or upgraded connections. Agent opens a session by
+// POST, sends data by PUT, and receives data by GET held by server until
+// data is available.
+type pollTransport struct{}
+
+func (t *pollTransport) Name() string {
+	return Poll
+}
+
+func (t *pollTransport) Dial(ctx context.Context, server *url.URL, options *DialOptions) (net.Conn, string, error) {
+	transport := &http.Transport{
+		DialContext:     func(ctx context.Context, _, addr string) (net.Conn, error) { return options.dial(ctx, addr) },
+		TLSClientConfig: options.tlsConfig(server),
+	}
+	client := &http.Client{Transport: transport, Timeout: pollTimeout + 30*time.Second}
+
+	u := httpURL(server)
+	u.Path = PollPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set(ProtocolHeader, strings.Join(options.offered(), ", "))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	id, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	resp.Body.Close()
+	if err := upgradeRequired(resp); err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unable to open poll session, %s", resp.Status)
+	}
+	protocol, err := options.picked(resp.Header.Get(ProtocolHeader))
+	if err != nil {
+		return nil, "", err
+	}
+
+	u.RawQuery = url.Values{"id": {string(id)}}.Encode()
+	pr, pw := io.Pipe()
+	c := &pollConn{
+		client:   client,
+		url:      u.String(),
+		protocol: protocol,
+		reader:   pr,
+		writer:   pw,
+		remote:   addr(hostPort(server)),
+		done:     make(chan struct{}),
+	}
+	go c.poll()
+	return c, protocol, nil
+}
+
+// pollConn is agent side of poll session.
+type pollConn struct {
+	noDeadline
+	client   *http.Client
+	url      string
+	protocol string
+	reader   *io.PipeReader
+	writer   *io.PipeWriter
+	remote   net.Addr
+
+	// mu serializes writes, so they arrive in order
+	mu   sync.Mutex
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *pollConn) request(method string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ProtocolHeader, c.protocol)
+	return c.client.Do(req)
+}
+
+func (c *pollConn) poll() {
+	for {
+		resp, err := c.request(http.MethodGet, nil)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("poll session closed, %s", resp.Status)
+			resp.Body.Close()
+		}
+		if err != nil {
+			c.writer.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(c.writer, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *pollConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *pollConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	resp, err := c.request(http.MethodPut, b)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("poll session closed, %s", resp.Status)
+	}
+	return len(b), nil
+}
+
+func (c *pollConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.reader.Close()
+		if resp, err := c.request(http.MethodDelete, nil); err == nil {
+			resp.Body.Close()
+		}
+		c.client.CloseIdleConnections()
+	})
+	return nil
+}
+
+func (c *pollConn) LocalAddr() net.Addr  { return addr("poll-client") }
+func (c *pollConn) RemoteAddr() net.Addr { return c.remote }
+
+// PollServer serves poll sessions of agents. Sessions live in memory of
+// the server opened them, tagged by owner in their ids, so requests
+// landing on other replicas could be routed to it by PollOwner.
+type PollServer struct {
+	owner string
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+}
+
+// NewPollServer returns server of sessions tagged by owner, which
+// mustn't contain dots.
+func NewPollServer(owner string) *PollServer {
+	return &PollServer{owner: owner, sessions: make(map[string]*pollSession)}
+}
+
+// PollOwner returns owner tagging session of request, empty if none.
+func PollOwner(r *http.Request) string {
+	id := r.URL.Query().Get("id")
+	if i := strings.LastIndex(id, "."); i >= 0 {
+		return id[i+1:]
+	}
+	return ""
+}
+
+// Open opens session for agent request speaking protocol, serve is called
+// with connection of session, which is closed once serve returns.
+func (p *PollServer) Open(w http.ResponseWriter, r *http.Request, protocol string, serve func(net.Conn)) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id := hex.EncodeToString(b) + "." + p.owner
+	session := &pollSession{
+		local:  addr(r.Host),
+		remote: addr(r.RemoteAddr),
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	session.cond = sync.NewCond(&session.mu)
+	session.reader, session.writer = io.Pipe()
+	session.onClose = func() {
+		p.mu.Lock()
+		delete(p.sessions, id)
+		p.mu.Unlock()
+	}
+	session.expiry = time.AfterFunc(pollExpiry, func() { session.Close() })
+
+	p.mu.Lock()
+	p.sessions[id] = session
+	p.mu.Unlock()
+
+	go func() {
+		serve(session)
+		session.Close()
+	}()
+	w.Header().Set(ProtocolHeader, protocol)
+	w.Write([]byte(id))
+}
+
+// ServeHTTP serves requests of opened sessions.
+func (p *PollServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	session, ok := p.sessions[r.URL.Query().Get("id")]
+	p.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such session", http.StatusGone)
+		return
+	}
+	session.expiry.Reset(pollExpiry)
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := session.take(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	case http.MethodPut:
+		if _, err := io.Copy(session.writer, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		session.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// pollSession is server side of poll session, data written waits in
+// pending until agent polls.
+type pollSession struct {
+	noDeadline
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+	local   net.Addr
+	remote  net.Addr
+	expiry  *time.Timer
+	onClose func()
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	notify  chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (s *pollSession) Read(b []byte) (int, error) {
+	return s.reader.Read(b)
+}
+
+func (s *pollSession) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.pending) >= pollMaxPending && !s.isClosed() {
+		s.cond.Wait()
+	}
+	if s.isClosed() {
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	s.pending = append(s.pending, b...)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+// take returns data pending, waiting for some up to poll timeout.
+func (s *pollSession) take(ctx context.Context) ([]byte, error) {
+	timer := time.NewTimer(pollTimeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		if len(s.pending) != 0 {
+			data := s.pending
+			s.pending = nil
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			return data, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.notify:
+		case <-s.closed:
+			return nil, errors.New("session closed")
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *pollSession) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *pollSession) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.expiry.Stop()
+		s.reader.Close()
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		s.onClose()
+	})
+	return nil
+}
+
+func (s *pollSession) LocalAddr() net.Addr  { return s.local }
+func (s *pollSession) RemoteAddr() net.Addr { return s.remote }
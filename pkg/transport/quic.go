@@ -0,0 +1,364 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/zryfish/kunnel/pkg/version"
+)
+
+const (
+	// quicALPN is application protocol of QUIC connections, protocol
+	// versions are negotiated by preambles as of TCP
+	quicALPN = "kunnel"
+
+	// quicRouteInterval is how often agents check whether route to
+	// server changes, like when they move between networks
+	quicRouteInterval = 5 * time.Second
+)
+
+// quicTransport connects to UDP listener of server by QUIC. Agent opens
+// the first stream, carrying preambles as of TCP followed by control
+// channel, and every tunnel stream is a native QUIC stream, so a lost
+// packet only stalls the stream it belongs to. Connections migrate to a
+// new socket once route to server changes, keeping their streams.
+type quicTransport struct{}
+
+func (t *quicTransport) Name() string {
+	return QUIC
+}
+
+func (t *quicTransport) Dial(ctx context.Context, server *url.URL, options *DialOptions) (net.Conn, string, error) {
+	if options.QUICPort == 0 {
+		return nil, "", errors.New("server has no quic listener")
+	}
+	if options.NetDial != nil {
+		return nil, "", errors.New("quic can't be dialed through proxies")
+	}
+	if !secure(server) {
+		return nil, "", errors.New("quic requires secure server url")
+	}
+	offered := quicProtocols(options.offered())
+	if len(offered) == 0 {
+		return nil, "", fmt.Errorf("none of protocol versions %s could be spoken over quic", strings.Join(options.offered(), ", "))
+	}
+
+	remote, err := net.ResolveUDPAddr("udp", net.JoinHostPort(server.Hostname(), strconv.Itoa(options.QUICPort)))
+	if err != nil {
+		return nil, "", err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	tr := &quic.Transport{Conn: udp, ConnectionIDLength: 4}
+	tlsConfig := options.tlsConfig(server)
+	tlsConfig.NextProtos = []string{quicALPN}
+	qc, err := tr.Dial(ctx, remote, tlsConfig, quicConfig())
+	if err != nil {
+		tr.Close()
+		udp.Close()
+		return nil, "", err
+	}
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		tr.Close()
+		udp.Close()
+		return nil, "", err
+	}
+	conn := newQUICConn(qc, stream, "")
+	conn.sockets = []*quicSocket{{tr, udp}}
+	go conn.closeSockets()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	o := *options
+	o.Protocols = offered
+	protocol, err := exchangePreambles(conn, &o)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	conn.SetDeadline(time.Time{})
+	conn.protocol = protocol
+
+	go conn.followRoute(remote)
+	return conn, protocol, nil
+}
+
+// quicProtocols returns protocol versions which could be spoken over
+// QUIC, SSH channels can't be carried by native streams.
+func quicProtocols(protocols []string) []string {
+	var supported []string
+	for _, p := range protocols {
+		if p != version.ProtocolSSH {
+			supported = append(supported, p)
+		}
+	}
+	return supported
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		// fails fast when UDP is blocked, so agents fall back to
+		// other transports
+		HandshakeIdleTimeout: 5 * time.Second,
+		MaxIdleTimeout:       60 * time.Second,
+		KeepAlivePeriod:      15 * time.Second,
+		MaxIncomingStreams:   10000,
+	}
+}
+
+// QUICConn is a QUIC connection, whose reads and writes are its first
+// stream, carrying streams natively.
+type QUICConn struct {
+	*quic.Stream
+	conn     *quic.Conn
+	protocol string
+
+	mu sync.Mutex
+	// sockets are those connection has been on, kept until it's closed
+	// as closing any closes connection too
+	sockets []*quicSocket
+}
+
+type quicSocket struct {
+	transport *quic.Transport
+	conn      *net.UDPConn
+}
+
+func newQUICConn(conn *quic.Conn, stream *quic.Stream, protocol string) *QUICConn {
+	return &QUICConn{Stream: stream, conn: conn, protocol: protocol}
+}
+
+func (c *QUICConn) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Protocol is protocol version picked by server.
+func (c *QUICConn) Protocol() string {
+	return c.protocol
+}
+
+// ConnectionState returns TLS state of connection.
+func (c *QUICConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+func (c *QUICConn) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	s, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return quicStream{s}, nil
+}
+
+func (c *QUICConn) AcceptStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	s, err := c.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return quicStream{s}, nil
+}
+
+// Wait blocks until connection is closed, returning io.EOF if either side
+// closes it normally.
+func (c *QUICConn) Wait() error {
+	<-c.conn.Context().Done()
+	err := context.Cause(c.conn.Context())
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.ErrorCode == 0 {
+		return io.EOF
+	}
+	return err
+}
+
+// Migrate moves connection to a new UDP socket, so it follows agents
+// moving between networks, keeping its streams.
+func (c *QUICConn) Migrate(ctx context.Context) error {
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: udp, ConnectionIDLength: 4}
+	path, err := c.conn.AddPath(tr)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	c.mu.Lock()
+	c.sockets = append(c.sockets, &quicSocket{tr, udp})
+	c.mu.Unlock()
+
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		return fmt.Errorf("new path to %s not validated, %v", c.RemoteAddr(), err)
+	}
+	return path.Switch()
+}
+
+// followRoute migrates connection once source address of route to server
+// changes.
+func (c *QUICConn) followRoute(remote *net.UDPAddr) {
+	source := routeSource(remote)
+	ticker := time.NewTicker(quicRouteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		s := routeSource(remote)
+		if s == nil || s.Equal(source) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(c.conn.Context(), 10*time.Second)
+		if err := c.Migrate(ctx); err == nil {
+			source = s
+		}
+		cancel()
+	}
+}
+
+// routeSource returns source address of route to remote, nil if there is
+// no route. Nothing is sent.
+func routeSource(remote *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func (c *QUICConn) closeSockets() {
+	<-c.conn.Context().Done()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.sockets {
+		s.transport.Close()
+		s.conn.Close()
+	}
+}
+
+// quicStream closes both directions of stream, as closing QUIC streams
+// only closes writing.
+type quicStream struct {
+	*quic.Stream
+}
+
+func (s quicStream) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// QUICListener accepts agents connecting by QUIC.
+type QUICListener struct {
+	listener *quic.Listener
+	conns    chan *QUICConn
+	done     chan struct{}
+	err      error
+}
+
+// ListenQUIC listens on UDP address for agents speaking protocol versions
+// negotiated from those offered.
+func ListenQUIC(addr string, tlsConfig *tls.Config, negotiate func(offered []string) string) (*QUICListener, error) {
+	config := tlsConfig.Clone()
+	config.NextProtos = []string{quicALPN}
+	l, err := quic.ListenAddr(addr, config, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	listener := &QUICListener{listener: l, conns: make(chan *QUICConn), done: make(chan struct{})}
+	go listener.serve(negotiate)
+	return listener, nil
+}
+
+func (l *QUICListener) serve(negotiate func(offered []string) string) {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go func() {
+			c, err := acceptQUIC(conn, negotiate)
+			if err != nil {
+				conn.CloseWithError(1, err.Error())
+				return
+			}
+			select {
+			case l.conns <- c:
+			case <-l.done:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// acceptQUIC accepts the first stream of agent, and exchanges preambles
+// on it.
+func acceptQUIC(conn *quic.Conn, negotiate func(offered []string) string) (*QUICConn, error) {
+	ctx, cancel := context.WithTimeout(conn.Context(), 10*time.Second)
+	defer cancel()
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := newQUICConn(conn, stream, "")
+	offered, err := ReadPreamble(c)
+	if err != nil {
+		return nil, err
+	}
+	protocol := negotiate(quicProtocols(offered))
+	if len(protocol) == 0 {
+		return nil, fmt.Errorf("none of protocol versions %s spoken", strings.Join(offered, ", "))
+	}
+	if err := WritePreamble(c, protocol); err != nil {
+		return nil, err
+	}
+	c.protocol = protocol
+	return c, nil
+}
+
+// Accept waits for agent connecting, whose protocol version is
+// negotiated.
+func (l *QUICListener) Accept() (*QUICConn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *QUICListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *QUICListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tcpTransport connects to raw TCP listener of server, over TLS if server
+// url is secure. Agent starts connection with protocol versions it offers
+// in a line, server replies the version picked in a line, followed by
+// multiplexed streams.
+type tcpTransport struct{}
+
+func (t *tcpTransport) Name() string {
+	return TCP
+}
+
+func (t *tcpTransport) Dial(ctx context.Context, server *url.URL, options *DialOptions) (net.Conn, string, error) {
+	if options.TCPPort == 0 {
+		return nil, "", errors.New("server has no tcp listener")
+	}
+
+	conn, err := options.dial(ctx, net.JoinHostPort(server.Hostname(), strconv.Itoa(options.TCPPort)))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if secure(server) {
+		tlsConn := tls.Client(conn, options.tlsConfig(server))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+		conn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	protocol, err := exchangePreambles(conn, options)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, protocol, nil
+}
+
+func exchangePreambles(conn net.Conn, options *DialOptions) (string, error) {
+	if err := WritePreamble(conn, options.offered()...); err != nil {
+		return "", err
+	}
+	picked, err := ReadPreamble(conn)
+	if err != nil {
+		// server closes connections of agents speaking none of its versions
+		return "", fmt.Errorf("server accepted none of protocol versions %s, %v", strings.Join(options.offered(), ", "), err)
+	}
+	if len(picked) != 1 {
+		return "", fmt.Errorf("invalid preamble from %s", conn.RemoteAddr())
+	}
+	return options.picked(picked[0])
+}
+
+// WritePreamble writes protocol versions in a line.
+func WritePreamble(conn net.Conn, protocols ...string) error {
+	_, err := conn.Write([]byte(strings.Join(protocols, ", ") + "\n"))
+	return err
+}
+
+// ReadPreamble reads protocol versions in a line, byte by byte so nothing
+// after it is consumed.
+func ReadPreamble(conn net.Conn) ([]string, error) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 256 {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return splitProtocols(string(line)), nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, fmt.Errorf("invalid preamble from %s", conn.RemoteAddr())
+}
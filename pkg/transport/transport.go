@@ -0,0 +1,311 @@
+// Package transport carries connections between agents and server over
+// QUIC, WebSocket, raw TCP with TLS, HTTP/2 CONNECT streams, or HTTP long
+// polling.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	WebSocket = "websocket"
+	TCP       = "tcp"
+	HTTP2     = "h2"
+	Poll      = "poll"
+	QUIC      = "quic"
+
+	// ProtocolHeader carries protocol versions of agents using HTTP
+	// transports other than WebSocket, separated by commas, and the one
+	// server picks in its response
+	ProtocolHeader = "X-Kunnel-Protocol"
+	// ProtocolsHeader carries protocol versions server speaks, when it
+	// requires agents to upgrade
+	ProtocolsHeader = "X-Kunnel-Protocols"
+
+	// DiscoveryPath is where server lists transports it supports
+	DiscoveryPath = "/_kunnel/transports"
+	// PollPath is where long polling sessions are served
+	PollPath = "/_kunnel/poll"
+)
+
+// DefaultOrder is order agents try transports in, transports server
+// doesn't support are skipped.
+var DefaultOrder = []string{QUIC, TCP, WebSocket, HTTP2, Poll}
+
+// Transport dials connections from agents to server.
+type Transport interface {
+	Name() string
+
+	// Dial connects to server, offering protocol versions of options,
+	// returns connection and the version server picks. Connection lives
+	// beyond ctx.
+	Dial(ctx context.Context, server *url.URL, options *DialOptions) (net.Conn, string, error)
+}
+
+type DialOptions struct {
+	// Protocol is protocol version negotiated by discovery, assumed of
+	// servers not telling the version picked on connecting
+	Protocol string
+
+	// Protocols are protocol versions agent offers on discovery and on
+	// connecting, newest first
+	Protocols []string
+
+	// TLSConfig verifies server and presents client certificate, nil
+	// for defaults
+	TLSConfig *tls.Config
+
+	// NetDial dials TCP connections, like through proxies, net.Dialer
+	// if nil
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TCPPort is port of raw TCP listener advertised by server
+	TCPPort int
+
+	// QUICPort is port of UDP listener advertised by server
+	QUICPort int
+}
+
+func (o *DialOptions) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if o.NetDial != nil {
+		return o.NetDial(ctx, "tcp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// offered returns protocol versions offered on connecting.
+func (o *DialOptions) offered() []string {
+	if len(o.Protocols) == 0 {
+		return []string{o.Protocol}
+	}
+	return o.Protocols
+}
+
+// picked returns protocol version server picked, or the one negotiated
+// by discovery if server didn't tell.
+func (o *DialOptions) picked(protocol string) (string, error) {
+	if len(protocol) == 0 {
+		return o.Protocol, nil
+	}
+	for _, p := range o.offered() {
+		if p == protocol {
+			return protocol, nil
+		}
+	}
+	return "", fmt.Errorf("server picked protocol version %s not offered", protocol)
+}
+
+func (o *DialOptions) tlsConfig(server *url.URL) *tls.Config {
+	config := &tls.Config{}
+	if o.TLSConfig != nil {
+		config = o.TLSConfig.Clone()
+	}
+	if len(config.ServerName) == 0 {
+		config.ServerName = server.Hostname()
+	}
+	return config
+}
+
+// Get returns transport of name, nil if unknown.
+func Get(name string) Transport {
+	switch name {
+	case WebSocket:
+		return &websocketTransport{}
+	case TCP:
+		return &tcpTransport{}
+	case HTTP2:
+		return &http2Transport{}
+	case Poll:
+		return &pollTransport{}
+	case QUIC:
+		return &quicTransport{}
+	}
+	return nil
+}
+
+// Validate checks transport names.
+func Validate(names []string) error {
+	for _, name := range names {
+		if Get(name) == nil {
+			return fmt.Errorf("unknown transport %s, must be one of %s", name, strings.Join(DefaultOrder, ", "))
+		}
+	}
+	return nil
+}
+
+// Discovery is what server tells agents about transports and protocol
+// versions it supports.
+type Discovery struct {
+	Transports []string `json:"transports"`
+	// TCPPort is port of raw TCP listener, 0 if disabled
+	TCPPort int `json:"tcpPort,omitempty"`
+	// QUICPort is port of UDP listener, 0 if disabled
+	QUICPort int `json:"quicPort,omitempty"`
+	// Protocol is the newest protocol version both agent and server speak
+	Protocol string `json:"protocol,omitempty"`
+	// Protocols are protocol versions server speaks, newest first
+	Protocols []string `json:"protocols,omitempty"`
+	// Control is version of control protocol server speaks, 0 if it
+	// predates control protocol
+	Control int `json:"control,omitempty"`
+}
+
+// Discover asks server for transports it supports, and negotiates
+// protocol version with it. UpgradeRequiredError is returned if server
+// speaks none of versions offered, Protocol of discovery is empty if
+// server predates negotiation.
+func Discover(ctx context.Context, server *url.URL, options *DialOptions) (*Discovery, error) {
+	transport := &http.Transport{
+		DialContext:     func(ctx context.Context, _, addr string) (net.Conn, error) { return options.dial(ctx, addr) },
+		TLSClientConfig: options.tlsConfig(server),
+	}
+	defer transport.CloseIdleConnections()
+
+	u := httpURL(server)
+	u.Path = DiscoveryPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ProtocolHeader, strings.Join(options.Protocols, ", "))
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := upgradeRequired(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to discover transports, %s", resp.Status)
+	}
+
+	discovery := &Discovery{}
+	if err := json.NewDecoder(resp.Body).Decode(discovery); err != nil {
+		return nil, fmt.Errorf("invalid transports from server, %v", err)
+	}
+	return discovery, nil
+}
+
+// UpgradeRequiredError is returned to agents speaking none of protocol
+// versions of server.
+type UpgradeRequiredError struct {
+	// Protocols are protocol versions server speaks
+	Protocols []string
+}
+
+func (e *UpgradeRequiredError) Error() string {
+	return fmt.Sprintf("server speaks protocol versions %s only, upgrade agent or server", strings.Join(e.Protocols, ", "))
+}
+
+// UpgradeRequired tells agent server speaks none of protocol versions
+// it offers.
+func UpgradeRequired(w http.ResponseWriter, protocols []string) {
+	w.Header().Set(ProtocolsHeader, strings.Join(protocols, ", "))
+	http.Error(w, (&UpgradeRequiredError{Protocols: protocols}).Error(), http.StatusUpgradeRequired)
+}
+
+// upgradeRequired returns UpgradeRequiredError if server responds so.
+func upgradeRequired(resp *http.Response) error {
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		return nil
+	}
+	return &UpgradeRequiredError{Protocols: splitProtocols(resp.Header.Get(ProtocolsHeader))}
+}
+
+func splitProtocols(header string) []string {
+	var protocols []string
+	for _, p := range strings.Split(header, ",") {
+		if p = strings.TrimSpace(p); len(p) != 0 {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+// Supports reports whether discovered server supports transport.
+func (d *Discovery) Supports(name string) bool {
+	for _, t := range d.Transports {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAgentRequest reports whether request comes from an agent rather
+// than a client of tunnels.
+func IsAgentRequest(r *http.Request) bool {
+	if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
+		return strings.HasPrefix(r.Header.Get("Sec-WebSocket-Protocol"), "kunnel-")
+	}
+	return strings.HasPrefix(r.Header.Get(ProtocolHeader), "kunnel-") &&
+		(r.URL.Path == DiscoveryPath || r.URL.Path == PollPath || r.Method == http.MethodConnect)
+}
+
+// Of returns transport of agent request, and protocol versions agent
+// offers.
+func Of(r *http.Request) (string, []string) {
+	switch {
+	case strings.ToLower(r.Header.Get("Upgrade")) == "websocket":
+		return WebSocket, websocket.Subprotocols(r)
+	case r.Method == http.MethodConnect:
+		return HTTP2, splitProtocols(r.Header.Get(ProtocolHeader))
+	case r.URL.Path == PollPath:
+		return Poll, splitProtocols(r.Header.Get(ProtocolHeader))
+	}
+	return "", splitProtocols(r.Header.Get(ProtocolHeader))
+}
+
+// httpURL returns http or https url of websocket url of server.
+func httpURL(server *url.URL) *url.URL {
+	u := *server
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	return &u
+}
+
+// hostPort returns address of server, with default port of scheme.
+func hostPort(server *url.URL) string {
+	if len(server.Port()) != 0 {
+		return server.Host
+	}
+	if server.Scheme == "wss" || server.Scheme == "https" {
+		return net.JoinHostPort(server.Hostname(), "443")
+	}
+	return net.JoinHostPort(server.Hostname(), "80")
+}
+
+func secure(server *url.URL) bool {
+	return server.Scheme == "wss" || server.Scheme == "https"
+}
+
+// addr is address of connections without one.
+type addr string
+
+func (a addr) Network() string { return "tcp" }
+func (a addr) String() string  { return string(a) }
+
+// noDeadline is embedded by connections whose deadlines are managed by
+// their HTTP requests.
+type noDeadline struct{}
+
+func (noDeadline) SetDeadline(t time.Time) error      { return nil }
+func (noDeadline) SetReadDeadline(t time.Time) error  { return nil }
+func (noDeadline) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,293 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zryfish/kunnel/pkg/version"
+)
+
+const (
+	testProtocol = "kunnel-test"
+	// oldProtocol is offered too and negotiated by discovery, servers
+	// under test pick testProtocol instead
+	oldProtocol = "kunnel-old"
+)
+
+// echo copies what conn reads back to it until closed.
+func echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+// roundTrip sends data through conn to an echoing server, and checks it
+// comes back intact.
+func roundTrip(t *testing.T, conn interface {
+	io.ReadWriter
+	SetReadDeadline(time.Time) error
+}) {
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	errs := make(chan error, 1)
+	go func() {
+		// small writes and a large one, as multiplexers write both
+		_, err := conn.Write(data[:10])
+		if err == nil {
+			_, err = conn.Write(data[10:])
+		}
+		errs <- err
+	}()
+
+	received := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, received) {
+		t.Fatal("data received differs from data sent")
+	}
+}
+
+func dial(t *testing.T, name, server string, options *DialOptions) net.Conn {
+	u, err := url.Parse(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options.Protocol = oldProtocol
+	options.Protocols = []string{testProtocol, oldProtocol}
+	conn, protocol, err := Get(name).Dial(ctx, u, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if protocol != testProtocol {
+		t.Fatalf("expected protocol %s picked by server, got %s", testProtocol, protocol)
+	}
+	return conn
+}
+
+// clientTLS returns config trusting certificate of server.
+func clientTLS(server *httptest.Server) *tls.Config {
+	return server.Client().Transport.(*http.Transport).TLSClientConfig
+}
+
+func TestTCP(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		name := "plain"
+		if secure {
+			name = "tls"
+		}
+		t.Run(name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := &DialOptions{TCPPort: l.Addr().(*net.TCPAddr).Port}
+			scheme := "ws"
+			if secure {
+				// borrows certificate of a test server
+				server := httptest.NewTLSServer(http.NotFoundHandler())
+				t.Cleanup(server.Close)
+				l = tls.NewListener(l, server.TLS)
+				options.TLSConfig = clientTLS(server)
+				scheme = "wss"
+			}
+			t.Cleanup(func() { l.Close() })
+
+			preambles := make(chan []string, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				offered, err := ReadPreamble(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				preambles <- offered
+				if err := WritePreamble(conn, testProtocol); err != nil {
+					conn.Close()
+					return
+				}
+				echo(conn)
+			}()
+
+			conn := dial(t, TCP, scheme+"://127.0.0.1", options)
+			roundTrip(t, conn)
+			if offered := <-preambles; len(offered) != 2 || offered[0] != testProtocol || offered[1] != oldProtocol {
+				t.Fatalf("expected %s and %s offered, got %v", testProtocol, oldProtocol, offered)
+			}
+		})
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, offered := Of(r); name != WebSocket || len(offered) != 2 || offered[0] != testProtocol {
+			http.Error(w, "unexpected agent request", http.StatusBadRequest)
+			return
+		}
+		conn, err := UpgradeWebSocket(w, r, testProtocol)
+		if err != nil {
+			return
+		}
+		echo(conn)
+	}))
+	t.Cleanup(server.Close)
+
+	roundTrip(t, dial(t, WebSocket, server.URL, &DialOptions{}))
+}
+
+func TestHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, _ := Of(r); name != HTTP2 {
+			http.Error(w, "unexpected agent request", http.StatusBadRequest)
+			return
+		}
+		conn, err := AcceptConnect(w, r, testProtocol)
+		if err != nil {
+			return
+		}
+		echo(conn)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roundTrip(t, dial(t, HTTP2, server.URL, &DialOptions{TLSConfig: clientTLS(server)}))
+}
+
+func TestPoll(t *testing.T) {
+	polls := NewPollServer("replica")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, _ := Of(r); name != Poll {
+			http.Error(w, "unexpected agent request", http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodPost {
+			if owner := PollOwner(r); owner != "replica" {
+				http.Error(w, "unexpected owner "+owner, http.StatusBadRequest)
+				return
+			}
+			polls.ServeHTTP(w, r)
+			return
+		}
+		polls.Open(w, r, testProtocol, echo)
+	}))
+	t.Cleanup(server.Close)
+
+	conn := dial(t, Poll, server.URL, &DialOptions{})
+	roundTrip(t, conn)
+
+	// session is gone once agent closes it
+	conn.Close()
+	session := conn.(*pollConn).url
+	resp, err := http.Get(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected closed session gone, got %s", resp.Status)
+	}
+	if !strings.Contains(session, ".replica") {
+		t.Fatalf("expected session id tagged by owner, got %s", session)
+	}
+}
+
+func TestQUIC(t *testing.T) {
+	// borrows certificate of a test server
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+	l, err := ListenQUIC("127.0.0.1:0", server.TLS, func(offered []string) string {
+		if len(offered) != 2 || offered[0] != testProtocol {
+			return ""
+		}
+		return testProtocol
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan *QUICConn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+			go echo(conn)
+			go func() {
+				for {
+					s, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer s.Close()
+						io.Copy(s, s)
+					}()
+				}
+			}()
+		}
+	}()
+
+	options := &DialOptions{QUICPort: l.Addr().(*net.UDPAddr).Port, TLSConfig: clientTLS(server)}
+	conn := dial(t, QUIC, "wss://127.0.0.1", options).(*QUICConn)
+	roundTrip(t, conn)
+	agent := <-accepted
+	if agent.Protocol() != testProtocol {
+		t.Fatalf("expected protocol %s accepted, got %s", testProtocol, agent.Protocol())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	roundTrip(t, stream.(quicStream))
+
+	// streams survive migrating to another socket
+	before := agent.RemoteAddr().String()
+	if err := conn.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, stream.(quicStream))
+	roundTrip(t, conn)
+	if after := agent.RemoteAddr().String(); after == before {
+		t.Fatalf("expected agent address changed from %s after migrating", before)
+	}
+
+	// ssh can't be carried by native streams
+	u, _ := url.Parse("wss://127.0.0.1")
+	if _, _, err := Get(QUIC).Dial(ctx, u, &DialOptions{Protocol: version.ProtocolSSH, QUICPort: options.QUICPort, TLSConfig: options.TLSConfig}); err == nil {
+		t.Fatal("expected ssh rejected over quic")
+	}
+
+	conn.Close()
+	if err := agent.Wait(); err != io.EOF {
+		t.Fatalf("expected connection closed normally, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zryfish/kunnel/pkg/utils"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+type websocketTransport struct{}
+
+func (t *websocketTransport) Name() string {
+	return WebSocket
+}
+
+func (t *websocketTransport) Dial(ctx context.Context, server *url.URL, options *DialOptions) (net.Conn, string, error) {
+	dialer := websocket.Dialer{
+		ReadBufferSize:   1024,
+		WriteBufferSize:  1024,
+		HandshakeTimeout: 45 * time.Second,
+		Subprotocols:     options.offered(),
+		TLSClientConfig:  options.TLSConfig,
+		NetDialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return options.dial(ctx, addr)
+		},
+	}
+
+	u := *server
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+
+	wsConn, resp, err := dialer.DialContext(ctx, u.String(), http.Header{})
+	if err != nil {
+		if resp != nil {
+			if err := upgradeRequired(resp); err != nil {
+				return nil, "", err
+			}
+		}
+		return nil, "", err
+	}
+	protocol, err := options.picked(wsConn.Subprotocol())
+	if err != nil {
+		wsConn.Close()
+		return nil, "", err
+	}
+	return utils.NewWebSocketConn(wsConn), protocol, nil
+}
+
+// UpgradeWebSocket upgrades agent request to connection speaking protocol.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request, protocol string) (net.Conn, error) {
+	wsConn, err := upgrader.Upgrade(w, r, http.Header{"Sec-Websocket-Protocol": {protocol}})
+	if err != nil {
+		return nil, err
+	}
+	return utils.NewWebSocketConn(wsConn), nil
+}
@@ -2,17 +2,38 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
+// Message is reply to config request of agents predating control
+// protocol, see package control.
 type Message struct {
-	Err    error
+	// Err is encoded as it always was for agents predating control
+	// protocol, null or an empty object, losing its message
+	Err error
+	// Error is message of Err, for agents knowing it
+	Error  string `json:",omitempty"`
 	Domain string
 }
 
+// Unmarshal decodes message, Err is set from Error, or to a generic error
+// if only Err is sent, which can't be decoded as is.
 func (m *Message) Unmarshal(b []byte) error {
-	if err := json.Unmarshal(b, m); err != nil {
-		return fmt.Errorf("invalid json config")
+	msg := &struct {
+		Err    json.RawMessage
+		Error  string
+		Domain string
+	}{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return fmt.Errorf("invalid message, %v", err)
+	}
+
+	m.Err, m.Error, m.Domain = nil, msg.Error, msg.Domain
+	if len(msg.Error) != 0 {
+		m.Err = errors.New(msg.Error)
+	} else if len(msg.Err) != 0 && string(msg.Err) != "null" {
+		m.Err = errors.New("config rejected by server")
 	}
 	return nil
 }
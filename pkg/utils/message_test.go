@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// legacyMessage is message as agents predating control protocol decode it.
+type legacyMessage struct {
+	Err    error
+	Domain string
+}
+
+func TestMessageLegacy(t *testing.T) {
+	accepted, _ := (&Message{Domain: "test.kunnel.run"}).Marshal()
+	legacy := &legacyMessage{}
+	if err := json.Unmarshal(accepted, legacy); err != nil || legacy.Err != nil || legacy.Domain != "test.kunnel.run" {
+		t.Fatalf("legacy agent can't decode accepted message %s, %v", accepted, err)
+	}
+
+	// legacy agents fail decoding errors, as they always did
+	rejected, _ := (&Message{Err: errors.New("rejected"), Error: "rejected"}).Marshal()
+	if err := json.Unmarshal(rejected, &legacyMessage{}); err == nil {
+		t.Fatalf("legacy agent decodes rejected message %s", rejected)
+	}
+}
+
+func TestMessageUnmarshal(t *testing.T) {
+	cases := []struct {
+		payload string
+		domain  string
+		err     string
+	}{
+		{`{"Err":null,"Domain":"test.kunnel.run"}`, "test.kunnel.run", ""},
+		{`{"Err":{},"Error":"rejected","Domain":""}`, "", "rejected"},
+		// servers predating Error lose message
+		{`{"Err":{},"Domain":""}`, "", "config rejected by server"},
+	}
+	for _, c := range cases {
+		msg := &Message{}
+		if err := msg.Unmarshal([]byte(c.payload)); err != nil {
+			t.Fatalf("%s: %v", c.payload, err)
+		}
+		var err string
+		if msg.Err != nil {
+			err = msg.Err.Error()
+		}
+		if msg.Domain != c.domain || err != c.err {
+			t.Fatalf("%s: decoded %q, %q, expecting %q, %q", c.payload, msg.Domain, err, c.domain, c.err)
+		}
+	}
+	if err := (&Message{}).Unmarshal([]byte("{")); err == nil {
+		t.Fatal("malformed message decoded")
+	}
+}
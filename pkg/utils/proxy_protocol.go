@@ -0,0 +1,354 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+var (
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrInvalidProxyProtocol = errors.New("invalid proxy protocol header")
+)
+
+// WriteProxyHeader writes HAProxy PROXY protocol header of given version
+// describing a connection from src to dst.
+func WriteProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		header = proxyHeaderV1(src, dst)
+	case ProxyProtocolV2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("unknown proxy protocol version %s", version)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	s, d := tcpAddr(src), tcpAddr(dst)
+	if s == nil || d == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	if s.IP.To4() == nil || d.IP.To4() == nil {
+		family = "TCP6"
+		s.IP, d.IP = s.IP.To16(), d.IP.To16()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port))
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	buf := bytes.NewBuffer(append([]byte{}, proxyProtocolV2Signature...))
+
+	s, d := tcpAddr(src), tcpAddr(dst)
+	if s == nil || d == nil {
+		// LOCAL command, receiver uses real connection endpoints
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	sip, dip := s.IP.To4(), d.IP.To4()
+	family := byte(0x11) // TCP over IPv4
+	if sip == nil || dip == nil {
+		family = 0x21 // TCP over IPv6
+		sip, dip = s.IP.To16(), d.IP.To16()
+	}
+
+	buf.WriteByte(0x21) // version 2, PROXY command
+	buf.WriteByte(family)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(sip)+len(dip)+4))
+	buf.Write(sip)
+	buf.Write(dip)
+	_ = binary.Write(buf, binary.BigEndian, uint16(s.Port))
+	_ = binary.Write(buf, binary.BigEndian, uint16(d.Port))
+	return buf.Bytes()
+}
+
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if addr == nil {
+		return nil
+	}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return &net.TCPAddr{IP: a.IP, Port: a.Port}
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// ProxyProtocolListener accepts connections optionally prefixed with
+// PROXY protocol v1 or v2 header, reporting the address carried by the
+// header as connection's remote address. Headers are only honored for
+// connections from trusted networks, connections from elsewhere are
+// passed as they are, so headers they send fail as garbage.
+type ProxyProtocolListener struct {
+	net.Listener
+	timeout time.Duration
+
+	mu      sync.RWMutex
+	trusted []*net.IPNet
+}
+
+func NewProxyProtocolListener(l net.Listener, trusted []*net.IPNet) *ProxyProtocolListener {
+	return &ProxyProtocolListener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  10 * time.Second,
+	}
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.RLock()
+	trusted := l.trusted
+	l.mu.RUnlock()
+	if addr := tcpAddr(conn.RemoteAddr()); addr == nil || !ContainsIP(trusted, addr.IP) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.timeout,
+	}, nil
+}
+
+// SetTrusted replaces trusted networks, applied to connections
+// accepted afterwards.
+func (l *ProxyProtocolListener) SetTrusted(trusted []*net.IPNet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trusted = trusted
+}
+
+// proxyProtocolConn parses PROXY header lazily on first use, so
+// Accept won't be blocked by slow clients.
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	remote  net.Addr
+	local   net.Addr
+	err     error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.local, c.err = ReadProxyHeader(c.reader)
+	if c.err != nil {
+		klog.V(2).Infof("Invalid proxy protocol header from %s, %v", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+// ReadProxyHeader reads PROXY protocol v1 or v2 header from r, addresses
+// are nil if r doesn't start with a header.
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch b[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyProtocolV2Signature[0]:
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	b, err := r.Peek(6)
+	if err != nil || string(b) != "PROXY " {
+		// not a proxy protocol header, maybe plain http
+		return nil, nil, nil
+	}
+
+	// v1 header is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidProxyProtocol
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidProxyProtocol
+	}
+
+	src, err := parseTCPAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseTCPAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseTCPAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 65535 {
+		return nil, ErrInvalidProxyProtocol
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	b, err := r.Peek(16)
+	if err != nil || !bytes.Equal(b[:12], proxyProtocolV2Signature) {
+		return nil, nil, nil
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, nil, ErrInvalidProxyProtocol
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL command, keep real connection endpoints
+	if header[12]&0x0f == 0 {
+		return nil, nil, nil
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, ErrInvalidProxyProtocol
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// ParseCIDRs parses a list of CIDRs or single IP addresses.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s, %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyHeaderV2Of returns v2 header of command and family byte, with
+// payload.
+func proxyHeaderV2Of(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := append(append(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 2).To4()...), 0x30, 0x39, 0x00, 0x50)
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x00, 0x50)
+
+	tests := []struct {
+		name   string
+		header string
+		src    string
+		dst    string
+		// invalid header fails, truncated one fails by error of reader
+		invalid bool
+		failed  bool
+	}{
+		{name: "v1 tcp4", header: "PROXY TCP4 192.0.2.1 192.0.2.2 12345 80\r\n", src: "192.0.2.1:12345", dst: "192.0.2.2:80"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n", src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:80"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 unknown with addresses", header: "PROXY UNKNOWN 192.0.2.1 192.0.2.2 12345 80\r\n"},
+		{name: "v1 without crlf", header: "PROXY TCP4 192.0.2.1 192.0.2.2 12345 80\n", invalid: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", invalid: true},
+		{name: "v1 truncated", header: "PROXY TCP4 192.0.2.1", failed: true},
+		{name: "v1 unknown family", header: "PROXY UDP4 192.0.2.1 192.0.2.2 12345 80\r\n", invalid: true},
+		{name: "v1 missing port", header: "PROXY TCP4 192.0.2.1 192.0.2.2 12345\r\n", invalid: true},
+		{name: "v1 invalid address", header: "PROXY TCP4 192.0.2.256 192.0.2.2 12345 80\r\n", invalid: true},
+		{name: "v1 invalid port", header: "PROXY TCP4 192.0.2.1 192.0.2.2 12345 65536\r\n", invalid: true},
+		{name: "v2 tcp4", header: string(proxyHeaderV2Of(0x21, 0x11, ipv4)), src: "192.0.2.1:12345", dst: "192.0.2.2:80"},
+		{name: "v2 tcp6", header: string(proxyHeaderV2Of(0x21, 0x21, ipv6)), src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:80"},
+		{name: "v2 tcp4 with tlvs", header: string(proxyHeaderV2Of(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00))), src: "192.0.2.1:12345", dst: "192.0.2.2:80"},
+		{name: "v2 local", header: string(proxyHeaderV2Of(0x20, 0x00, nil))},
+		{name: "v2 local with addresses", header: string(proxyHeaderV2Of(0x20, 0x11, ipv4))},
+		{name: "v2 unspecified family", header: string(proxyHeaderV2Of(0x21, 0x00, nil))},
+		{name: "v2 unknown version", header: string(proxyHeaderV2Of(0x11, 0x11, ipv4)), invalid: true},
+		{name: "v2 short addresses", header: string(proxyHeaderV2Of(0x21, 0x21, ipv4)), invalid: true},
+		{name: "v2 truncated payload", header: string(proxyHeaderV2Of(0x21, 0x11, ipv4)[:20]), failed: true},
+		{name: "v2 truncated header", header: string(proxyProtocolV2Signature[:8])},
+		{name: "no header", header: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := "GET / HTTP/1.1\r\n"
+			if test.failed {
+				data = ""
+			}
+			r := bufio.NewReader(strings.NewReader(test.header + data))
+			src, dst, err := ReadProxyHeader(r)
+			switch {
+			case test.invalid:
+				if err != ErrInvalidProxyProtocol {
+					t.Fatalf("expected invalid header, got %v", err)
+				}
+				return
+			case test.failed:
+				if err == nil {
+					t.Fatal("expected truncated header failing")
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			if addr := addrString(src); addr != test.src {
+				t.Fatalf("expected source %q, got %q", test.src, addr)
+			}
+			if addr := addrString(dst); addr != test.dst {
+				t.Fatalf("expected destination %q, got %q", test.dst, addr)
+			}
+
+			// what follows header is kept, or everything if there's none
+			if len(test.src) == 0 && !strings.HasPrefix(test.header, "PROXY") && !strings.HasPrefix(test.header, string(proxyProtocolV2Signature)) {
+				data = test.header + data
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != data {
+				t.Fatalf("expected %q following header, got %q", data, rest)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, addrs := range [][2]net.Addr{{src, src}, {dst, dst}, {src, dst}, {nil, dst}} {
+			buf := &bytes.Buffer{}
+			if err := WriteProxyHeader(buf, version, addrs[0], addrs[1]); err != nil {
+				t.Fatal(err)
+			}
+			s, d, err := ReadProxyHeader(bufio.NewReader(buf))
+			if err != nil {
+				t.Fatalf("%s header of %v: %v", version, addrs, err)
+			}
+			if addrs[0] == nil {
+				// unknown source is sent as unknown connection
+				if s != nil || d != nil {
+					t.Fatalf("%s header of %v: expected no addresses, got %v %v", version, addrs, s, d)
+				}
+				continue
+			}
+			// mixed families are sent as IPv6
+			if !s.(*net.TCPAddr).IP.Equal(addrs[0].(*net.TCPAddr).IP) || !d.(*net.TCPAddr).IP.Equal(addrs[1].(*net.TCPAddr).IP) {
+				t.Fatalf("%s header of %v: got %v %v", version, addrs, s, d)
+			}
+		}
+	}
+	if err := WriteProxyHeader(&bytes.Buffer{}, "v3", src, dst); err == nil {
+		t.Fatal("expected unknown version failing")
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		remote  string
+	}{
+		{name: "trusted", trusted: []string{"127.0.0.0/8"}, remote: "192.0.2.1:12345"},
+		{name: "untrusted", trusted: []string{"10.0.0.0/8"}, remote: "127.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trusted, err := ParseCIDRs(test.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pl := NewProxyProtocolListener(l, trusted)
+			defer pl.Close()
+
+			header := "PROXY TCP4 192.0.2.1 192.0.2.2 12345 80\r\n"
+			go func() {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.Write([]byte(header + "hello"))
+			}()
+
+			conn, err := pl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if remote := conn.RemoteAddr().String(); !strings.HasPrefix(remote, test.remote) {
+				t.Fatalf("expected remote address %s, got %s", test.remote, remote)
+			}
+
+			// header of untrusted peer is data
+			expected := "hello"
+			if test.name == "untrusted" {
+				expected = header + expected
+			}
+			b, _ := ioutil.ReadAll(conn)
+			if string(b) != expected {
+				t.Fatalf("expected %q read, got %q", expected, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n", "ddddddd\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest is gone beyond backups kept
+	for name, expected := range map[string]string{
+		path:        "ddddddd\n",
+		path + ".1": "ccccccc\n",
+		path + ".2": "bbbbbbb\n",
+	} {
+		if content := readFile(t, name); content != expected {
+			t.Fatalf("expected %q in %s, got %q", expected, name, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected no more than 2 backups, %v", err)
+	}
+}
+
+func TestRotatingFileTruncates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := NewRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content := readFile(t, path); content != "bbbbbbb\n" {
+		t.Fatalf("expected file truncated, got %q", content)
+	}
+}
+
+func TestRotatingFileFailing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// backup can't be renamed to a directory that isn't empty
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content := readFile(t, path); !strings.HasSuffix(content, "ccccccc\n") {
+		t.Fatalf("expected file written to once rotating failed, got %q", content)
+	}
+}
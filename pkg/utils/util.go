@@ -16,6 +16,11 @@ func HandleTCPStream(src io.ReadWriteCloser, remote string) {
 		return
 	}
 
+	HandleStream(src, dst, remote)
+}
+
+// HandleStream pipes src to dst dialed to remote, until either is closed.
+func HandleStream(src io.ReadWriteCloser, dst io.ReadWriteCloser, remote string) {
 	s, r := pipe(src, dst)
 	klog.V(2).Infof("send remote %s %d, received %d", remote, s, r)
 }
@@ -2,22 +2,49 @@ package utils
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"k8s.io/klog"
 )
 
+const (
+	// pingInterval is interval of websocket pings, keeping idle
+	// connections through proxies alive
+	pingInterval = 30 * time.Second
+	// pongTimeout is how long connection is kept without hearing from
+	// peer, pongs or messages
+	pongTimeout = 3 * pingInterval
+)
+
 type wsConn struct {
 	*websocket.Conn
 	buff []byte
+
+	// seen is unix nanoseconds peer is heard from last, accessed
+	// atomically
+	seen      int64
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
+// NewWebSocketConn returns conn reading and writing binary messages of
+// websocketConn. Peer is pinged every 30s, and connection is closed if
+// nothing is heard from peer for 90s.
 func NewWebSocketConn(websocketConn *websocket.Conn) net.Conn {
-	c := wsConn{
+	c := &wsConn{
 		Conn: websocketConn,
+		seen: time.Now().UnixNano(),
+		done: make(chan struct{}),
 	}
-	return &c
+	websocketConn.SetPongHandler(func(string) error {
+		c.touch()
+		return nil
+	})
+	go c.keepAlive()
+	return c
 }
 
 func (c *wsConn) Read(dst []byte) (int, error) {
@@ -30,7 +57,9 @@ func (c *wsConn) Read(dst []byte) (int, error) {
 		t, msg, err := c.ReadMessage()
 		if err != nil {
 			return 0, err
-		} else if t != websocket.BinaryMessage {
+		}
+		c.touch()
+		if t != websocket.BinaryMessage {
 			klog.Warning(" recieved non-binary message")
 		} else {
 			src = msg
@@ -56,9 +85,43 @@ func (c *wsConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// SetDeadline sets read and write deadlines. Websocket connections fail
+// once a read times out, reads after that fail too.
 func (c *wsConn) SetDeadline(t time.Time) error {
 	if err := c.Conn.SetReadDeadline(t); err != nil {
 		return err
 	}
-	return nil
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *wsConn) touch() {
+	atomic.StoreInt64(&c.seen, time.Now().UnixNano())
+}
+
+// keepAlive pings peer until connection is closed, closing it once peer
+// is silent for longer than pongTimeout. Pongs are handled by reads.
+func (c *wsConn) keepAlive() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		if silence := time.Since(time.Unix(0, atomic.LoadInt64(&c.seen))); silence > pongTimeout {
+			klog.Warningf("No websocket pong from %s in %s, closing connection", c.RemoteAddr(), silence.Round(time.Second))
+			c.Close()
+			return
+		}
+		if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingInterval)); err != nil {
+			klog.V(4).Infof("Unable to ping %s, %v", c.RemoteAddr(), err)
+		}
+	}
 }
@@ -1,5 +1,41 @@
 package version
 
-const ProtocolVersion = "kunnel-v0.0.1"
+const (
+	// ProtocolSSH multiplexes streams by SSH channels
+	ProtocolSSH = "kunnel-v0.0.1"
+	// ProtocolQmux multiplexes streams by qmux channels
+	ProtocolQmux = "kunnel-v0.0.2"
+
+	// ProtocolVersion is the newest protocol version
+	ProtocolVersion = ProtocolQmux
+)
+
+// Protocols are protocol versions server and agents speak, newest first.
+// Previous versions are kept, so that servers and agents could be
+// upgraded independently.
+var Protocols = []string{ProtocolQmux, ProtocolSSH}
+
+// Supported reports whether server speaks protocol.
+func Supported(protocol string) bool {
+	for _, p := range Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the newest protocol version spoken among those
+// offered by agent, empty if none.
+func Negotiate(offered []string) string {
+	for _, p := range Protocols {
+		for _, o := range offered {
+			if o == p {
+				return p
+			}
+		}
+	}
+	return ""
+}
 
 var BuildVersion = "v0.1"